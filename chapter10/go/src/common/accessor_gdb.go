@@ -0,0 +1,111 @@
+package main
+
+// a simple implementation of the Fluent Bit record accessor syntax so configuration values can refer to
+// attributes within a record e.g. $log['level'] or $kubernetes['labels']['app']. We also accept the
+// record['level'] form used in table name templates, and a bare attribute name
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// each element of the path is either a string key into a map, or an int index into an array
+type recordPath []interface{}
+
+// parse the accessor expression into its path elements
+func parseRecordPath(expr string) (recordPath, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "$") {
+		expr = expr[1:]
+	} else if strings.HasPrefix(expr, "record[") {
+		expr = expr[len("record"):]
+	}
+	if len(expr) == 0 {
+		return nil, errors.New("empty record accessor")
+	}
+
+	var path recordPath
+	// the first key can be given without brackets
+	if expr[0] != '[' {
+		end := strings.IndexByte(expr, '[')
+		if end < 0 {
+			end = len(expr)
+		}
+		path = append(path, expr[:end])
+		expr = expr[end:]
+	}
+
+	for len(expr) > 0 {
+		if expr[0] != '[' {
+			return nil, errors.New("expected [ in record accessor at " + expr)
+		}
+		end := strings.IndexByte(expr, ']')
+		if end < 0 {
+			return nil, errors.New("missing ] in record accessor")
+		}
+		element := strings.TrimSpace(expr[1:end])
+		if len(element) >= 2 && (element[0] == '\'' || element[0] == '"') && element[len(element)-1] == element[0] {
+			path = append(path, element[1:len(element)-1])
+		} else if idx, err := strconv.Atoi(element); err == nil {
+			path = append(path, idx)
+		} else {
+			return nil, errors.New("invalid element " + element + " in record accessor")
+		}
+		expr = expr[end+1:]
+	}
+	return path, nil
+}
+
+// walk the record using the path. The maps from msgpack may have string or byte array keys
+// so we compare keys as strings
+func lookupRecordPath(record interface{}, path recordPath) (interface{}, bool) {
+	current := record
+	for _, element := range path {
+		switch key := element.(type) {
+		case string:
+			found := false
+			switch node := current.(type) {
+			case RowDefinition:
+				current, found = lookupMapKey(node, key)
+			case map[interface{}]interface{}:
+				current, found = lookupMapKey(node, key)
+			case map[string]interface{}:
+				current, found = node[key]
+			}
+			if !found {
+				return nil, false
+			}
+		case int:
+			node, ok := current.([]interface{})
+			if !ok || key < 0 || key >= len(node) {
+				return nil, false
+			}
+			current = node[key]
+		}
+	}
+	return current, true
+}
+
+// maps with interface keys need us to check the key as a string and a byte array
+func lookupMapKey(node map[interface{}]interface{}, key string) (interface{}, bool) {
+	if val, found := node[key]; found {
+		return val, true
+	}
+	for k, val := range node {
+		if keyToStr(k) == key {
+			return val, true
+		}
+	}
+	return nil, false
+}
+
+// the last string element of the path, which is a sensible default when we need a column name for the value
+func (path recordPath) leafName() string {
+	for idx := len(path) - 1; idx >= 0; idx-- {
+		if name, ok := path[idx].(string); ok {
+			return name
+		}
+	}
+	return ""
+}
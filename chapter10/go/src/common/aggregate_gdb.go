@@ -0,0 +1,433 @@
+package main
+
+// Rather than writing every record, the output can roll the records up over a tumbling window. When aggregate_window
+// is set, the records are grouped by the window their timestamp falls in and the values of the aggregate_keys, and
+// for each group we keep the number of records along with the count, sum, min, max and average of each of the
+// aggregate_fields. When a window closes its groups are upserted into the table_name, which needs the columns:
+//   window_start - the start of the window (UTC)
+//   a column for each key, named after the last part of the record accessor e.g. $kubernetes['pod_name'] is pod_name
+//   event_count  - the number of records
+//   <field>_count, <field>_sum, <field>_min, <field>_max, <field>_avg - for each aggregate field
+// and a unique key on window_start plus the key columns. A key missing from the record is written as NULL, so the
+// unique key needs to treat NULLs as equal for late records to merge. If the window has already been written (e.g. a
+// record arrived late), the values are merged with those already in the table.
+// The windows are held in memory until they close, any windows still open when the plugin exits are written then.
+// While the database can't be reached, the closed windows are kept, up to maxPendingAggregates groups, while a group
+// the database rejects is dropped or written to the dead_letter_table.
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const aggregateWindowCol = "window_start"
+const aggregateCountCol = "event_count"
+
+// the most groups kept for closed windows that couldn't be written, beyond which the oldest windows are dropped
+const maxPendingAggregates = 100000
+
+// the most groups written in a transaction, and the longest we wait for one to be written
+const aggregateBatchSize = 500
+const maxAggregateWriteTimeout = 30 * time.Second
+
+// the running values for a numeric field
+type fieldAggregate struct {
+	count int64
+	sum   float64
+	min   float64
+	max   float64
+}
+
+// the aggregates for a window and set of key values
+type aggregateGroup struct {
+	windowStart time.Time
+	keyValues   []interface{}
+	count       int64
+	fields      []fieldAggregate
+}
+
+// the open windows for a plugin instance
+type windowAggregator struct {
+	mutex  sync.Mutex
+	params SqlParams
+	window time.Duration
+	keys   []recordPath
+	fields []recordPath
+	groups map[string]*aggregateGroup
+	pool   *dbPool
+}
+
+// parse a comma separated list of record accessors
+func parseRecordPathList(listStr string) ([]recordPath, error) {
+	var paths []recordPath
+	for _, pathStr := range strings.Split(listStr, ",") {
+		if pathStr = strings.TrimSpace(pathStr); len(pathStr) == 0 {
+			continue
+		}
+		path, err := parseRecordPath(pathStr)
+		if err != nil {
+			return nil, errors.New(pathStr + " - " + err.Error())
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// check the aggregation settings. Aggregation replaces the normal writing of records, so the options that
+// change how individual records are written can't be used with it
+func validateAggregateParams(params *SqlParams) error {
+	params.AggregateWindow = strings.TrimSpace(params.AggregateWindow)
+	if len(params.AggregateWindow) == 0 {
+		return nil
+	}
+	window, err := parseDurationStr(params.AggregateWindow)
+	if err != nil || window < time.Second {
+		return errors.New(Plugin_AggregateWindow + " needs to be a duration of at least 1s for " + params.PluginName)
+	}
+	if isTableTemplate(params.TableName) {
+		return errors.New(Plugin_AggregateWindow + " can't be used with a " + Plugin_TableName + " template for " + params.PluginName)
+	}
+	if params.DBType != PostgresDBType && params.DBType != mysqlDBType {
+		return errors.New(Plugin_AggregateWindow + " is not supported for " + params.DBType)
+	}
+	if params.WriteMode != writeModeInsert {
+		return errors.New(Plugin_WriteMode + " " + params.WriteMode + " can't be used with " + Plugin_AggregateWindow + " for " + params.PluginName)
+	}
+	for _, option := range []struct{ name, value string }{
+		{Plugin_ChildTables, params.ChildTables},
+		{Plugin_Dimensions, params.Dimensions},
+		{Plugin_TenantKey, params.TenantKey},
+		{Plugin_UnmatchedTable, params.UnmatchedTable},
+	} {
+		if len(option.value) > 0 {
+			return errors.New(option.name + " can't be used with " + Plugin_AggregateWindow + " for " + params.PluginName)
+		}
+	}
+
+	nameRegex := regexp.MustCompile(defaultTableRegex)
+	for _, setting := range []struct{ name, value string }{{Plugin_AggregateKeys, params.AggregateKeys}, {Plugin_AggregateFields, params.AggregateFields}} {
+		paths, err := parseRecordPathList(setting.value)
+		if err != nil {
+			return errors.New("invalid " + setting.name + " " + err.Error())
+		}
+		for _, path := range paths {
+			if !nameRegex.MatchString(path.leafName()) {
+				return errors.New(setting.name + " " + path.leafName() + " can't be used as a column name")
+			}
+		}
+	}
+	return nil
+}
+
+// set up the aggregator for the instance along with the worker that writes the windows as they close
+func startAggregation(params *SqlParams) {
+	if len(params.AggregateWindow) == 0 {
+		return
+	}
+	window, _ := parseDurationStr(params.AggregateWindow)
+	keys, _ := parseRecordPathList(params.AggregateKeys)
+	fields, _ := parseRecordPathList(params.AggregateFields)
+	// the aggregator keeps hold of the pool, as the last windows are written while the instance is being released
+	resources := getResources(params)
+	aggregator := &windowAggregator{params: *params, window: window, keys: keys, fields: fields, groups: make(map[string]*aggregateGroup), pool: resources.pool}
+
+	resourcesMutex.Lock()
+	resources.aggregator = aggregator
+	resourcesMutex.Unlock()
+
+	startWorker(params, "aggregation", window, func() {
+		aggregator.flushWindows(false)
+	})
+}
+
+// add the records to their windows, then write any windows that have closed. The records have been consumed once
+// they're in the windows, so a problem writing the windows doesn't fail the chunk - the windows are kept and
+// written the next time around
+func aggregateRecords(params *SqlParams, records []FlushRecord) (writeOutcome, error) {
+	resources := getResources(params)
+	resourcesMutex.Lock()
+	aggregator := resources.aggregator
+	resourcesMutex.Unlock()
+	if aggregator == nil {
+		return writeFailed, errors.New("no aggregator for " + params.PluginName + " " + params.InstanceName)
+	}
+
+	records, _, err := filterRecords(params, records)
+	if err != nil {
+		return writeFailed, err
+	}
+
+	aggregator.mutex.Lock()
+	for _, recd := range records {
+		aggregator.add(recd)
+	}
+	aggregator.mutex.Unlock()
+
+	aggregator.flushWindows(false)
+	return writeOk, nil
+}
+
+// add a record to the aggregates for its window and key values
+func (aggregator *windowAggregator) add(recd FlushRecord) {
+	windowStart := recd.Timestamp.UTC().Truncate(aggregator.window)
+	keyValues := make([]interface{}, len(aggregator.keys))
+	groupKey := windowStart.Format(time.RFC3339)
+	for idx, path := range aggregator.keys {
+		// a missing key is kept apart from any value, including an empty string
+		if val, found := lookupRecordPath(recd.Record, path); found && val != nil {
+			keyValues[idx] = toDBValue(val)
+			groupKey = groupKey + "\x00" + typeToStr(keyValues[idx], false)
+		} else {
+			groupKey = groupKey + "\x01"
+		}
+	}
+
+	group, found := aggregator.groups[groupKey]
+	if !found {
+		group = &aggregateGroup{windowStart: windowStart, keyValues: keyValues, fields: make([]fieldAggregate, len(aggregator.fields))}
+		aggregator.groups[groupKey] = group
+	}
+	group.count++
+
+	for idx, path := range aggregator.fields {
+		val, found := lookupRecordPath(recd.Record, path)
+		if !found {
+			continue
+		}
+		num, isNum := toNumber(toDBValue(val))
+		if !isNum {
+			continue
+		}
+		field := &group.fields[idx]
+		if field.count == 0 || num < field.min {
+			field.min = num
+		}
+		if field.count == 0 || num > field.max {
+			field.max = num
+		}
+		field.count++
+		field.sum = field.sum + num
+	}
+}
+
+// the columns of the row for a group, and their values
+func aggregateColumns(keys []recordPath, fields []recordPath, group *aggregateGroup) ([]string, []interface{}) {
+	cols := []string{aggregateWindowCol}
+	args := []interface{}{group.windowStart}
+	for idx, path := range keys {
+		cols = append(cols, path.leafName())
+		args = append(args, group.keyValues[idx])
+	}
+	cols = append(cols, aggregateCountCol)
+	args = append(args, group.count)
+
+	for idx, path := range fields {
+		field := group.fields[idx]
+		name := path.leafName()
+		cols = append(cols, name+"_count", name+"_sum", name+"_min", name+"_max", name+"_avg")
+		if field.count == 0 {
+			args = append(args, 0, nil, nil, nil, nil)
+		} else {
+			args = append(args, field.count, field.sum, field.min, field.max, field.sum/float64(field.count))
+		}
+	}
+	return cols, args
+}
+
+// the upsert for a group, merging the values with any already written for the window
+func buildAggregateExpr(params *SqlParams, keys []recordPath, fields []recordPath, group *aggregateGroup) (string, []interface{}) {
+	cols, args := aggregateColumns(keys, fields, group)
+	conflictCols := []string{aggregateWindowCol}
+	for _, path := range keys {
+		conflictCols = append(conflictCols, path.leafName())
+	}
+
+	// the averages come first as MySQL applies the assignments in order, so the counts and sums mustn't have been updated
+	updates := func(existing, incoming func(string) string) []string {
+		var avgUpdates []string
+		updates := []string{aggregateCountCol + " = " + existing(aggregateCountCol) + " + " + incoming(aggregateCountCol)}
+		for _, path := range fields {
+			name := path.leafName()
+			avgUpdates = append(avgUpdates, name+"_avg = (COALESCE("+existing(name+"_sum")+", 0) + COALESCE("+incoming(name+"_sum")+", 0)) / "+
+				"NULLIF("+existing(name+"_count")+" + "+incoming(name+"_count")+", 0)")
+			updates = append(updates,
+				name+"_count = "+existing(name+"_count")+" + "+incoming(name+"_count"),
+				name+"_sum = COALESCE("+existing(name+"_sum")+", 0) + COALESCE("+incoming(name+"_sum")+", 0)",
+				name+"_min = LEAST(COALESCE("+existing(name+"_min")+", "+incoming(name+"_min")+"), COALESCE("+incoming(name+"_min")+", "+existing(name+"_min")+"))",
+				name+"_max = GREATEST(COALESCE("+existing(name+"_max")+", "+incoming(name+"_max")+"), COALESCE("+incoming(name+"_max")+", "+existing(name+"_max")+"))")
+		}
+		return append(avgUpdates, updates...)
+	}
+
+	return getDialect(params).upsertExpr(params.TableName, cols, conflictCols, updates), args
+}
+
+// write the groups for the windows that have closed, or all of them when we're exiting. The closed groups are taken
+// out of the windows so records can still be added while they're written, and are written oldest first in batches,
+// each in its own transaction. A group the database rejects is dropped (or written to the dead_letter_table) so it
+// can't hold back the others, and the groups are only put back to be tried again when the error is worth retrying
+func (aggregator *windowAggregator) flushWindows(all bool) {
+	params := &aggregator.params
+	now := time.Now().UTC()
+
+	aggregator.mutex.Lock()
+	closed := make(map[string]*aggregateGroup)
+	var closedKeys []string
+	for groupKey, group := range aggregator.groups {
+		if all || !group.windowStart.Add(aggregator.window).After(now) {
+			closed[groupKey] = group
+			closedKeys = append(closedKeys, groupKey)
+			delete(aggregator.groups, groupKey)
+		}
+	}
+	aggregator.mutex.Unlock()
+	if len(closedKeys) == 0 {
+		return
+	}
+	sort.Slice(closedKeys, func(i, j int) bool {
+		return closed[closedKeys[i]].windowStart.Before(closed[closedKeys[j]].windowStart)
+	})
+
+	written := 0
+	for len(closedKeys) > 0 {
+		batch := closedKeys
+		if len(batch) > aggregateBatchSize {
+			batch = batch[:aggregateBatchSize]
+		}
+		rejected, err := aggregator.writeGroups(batch, closed)
+		if err != nil && classifyDBError(err) == errClassRetry {
+			log.Printf("[%s]%s unable to write %d aggregates, will try again - %v", params.PluginName, params.InstanceName, len(closedKeys), err)
+			aggregator.keep(closedKeys, closed)
+			break
+		}
+		if err != nil {
+			log.Printf("[%s]%s dropped %d aggregates that could not be written - %v", params.PluginName, params.InstanceName, len(batch), err)
+		} else {
+			written = written + len(batch) - rejected
+		}
+		closedKeys = closedKeys[len(batch):]
+	}
+	if written > 0 {
+		log.Printf("[%s]%s wrote %d aggregates to %s", params.PluginName, params.InstanceName, written, params.TableName)
+	}
+}
+
+// put back the groups that couldn't be written, merging them with any groups for the same window and keys that
+// records have been added to since
+func (aggregator *windowAggregator) keep(groupKeys []string, groups map[string]*aggregateGroup) {
+	aggregator.mutex.Lock()
+	defer aggregator.mutex.Unlock()
+	for _, groupKey := range groupKeys {
+		if group, found := aggregator.groups[groupKey]; found {
+			group.merge(groups[groupKey])
+		} else {
+			aggregator.groups[groupKey] = groups[groupKey]
+		}
+	}
+	aggregator.dropOldest()
+}
+
+// add the aggregates of another group for the same window and keys
+func (group *aggregateGroup) merge(other *aggregateGroup) {
+	group.count = group.count + other.count
+	for idx, otherField := range other.fields {
+		field := &group.fields[idx]
+		if otherField.count == 0 {
+			continue
+		}
+		if field.count == 0 || otherField.min < field.min {
+			field.min = otherField.min
+		}
+		if field.count == 0 || otherField.max > field.max {
+			field.max = otherField.max
+		}
+		field.count = field.count + otherField.count
+		field.sum = field.sum + otherField.sum
+	}
+}
+
+// write the groups in a transaction, each within a savepoint so a group the database rejects can be set aside,
+// returning the number of groups rejected
+func (aggregator *windowAggregator) writeGroups(groupKeys []string, groups map[string]*aggregateGroup) (int, error) {
+	params := &aggregator.params
+	timeout := InsertTimeout * time.Duration(len(groupKeys))
+	if timeout > maxAggregateWriteTimeout {
+		timeout = maxAggregateWriteTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	db, err := aggregator.pool.get(params)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rejected := 0
+	for _, groupKey := range groupKeys {
+		group := groups[groupKey]
+		if err = setSavepoint(ctx, tx, params, recordSavepoint); err != nil {
+			return 0, err
+		}
+		sqlStmt, args := buildAggregateExpr(params, aggregator.keys, aggregator.fields, group)
+		if _, err = tx.ExecContext(ctx, sqlStmt, args...); err != nil {
+			if classifyDBError(err) != errClassRecord {
+				return 0, err
+			}
+			groupErr := err
+			if err = rollbackToSavepoint(ctx, tx, params, recordSavepoint); err != nil {
+				return 0, err
+			}
+			if err = handleRejectedRecord(ctx, tx, params, aggregator.groupRecord(group), groupErr); err != nil {
+				return 0, err
+			}
+			rejected++
+		}
+		if err = releaseSavepoint(ctx, tx, params, recordSavepoint); err != nil {
+			return 0, err
+		}
+	}
+	return rejected, tx.Commit()
+}
+
+// the group as a record, so a rejected group can be logged or written to the dead_letter_table
+func (aggregator *windowAggregator) groupRecord(group *aggregateGroup) FlushRecord {
+	cols, args := aggregateColumns(aggregator.keys, aggregator.fields, group)
+	record := make(RowDefinition, len(cols))
+	for idx, col := range cols {
+		record[col] = args[idx]
+	}
+	return FlushRecord{Timestamp: group.windowStart, Record: record}
+}
+
+// so the groups don't grow without limit while the database is unavailable, the groups of the oldest closed
+// windows are dropped once there are more than maxPendingAggregates. Called with the mutex held
+func (aggregator *windowAggregator) dropOldest() {
+	if len(aggregator.groups) <= maxPendingAggregates {
+		return
+	}
+	params := &aggregator.params
+	groupKeys := make([]string, 0, len(aggregator.groups))
+	for groupKey := range aggregator.groups {
+		groupKeys = append(groupKeys, groupKey)
+	}
+	sort.Slice(groupKeys, func(i, j int) bool {
+		return aggregator.groups[groupKeys[i]].windowStart.Before(aggregator.groups[groupKeys[j]].windowStart)
+	})
+	dropped := groupKeys[:len(groupKeys)-maxPendingAggregates]
+	latest := aggregator.groups[dropped[len(dropped)-1]].windowStart
+	for _, groupKey := range dropped {
+		delete(aggregator.groups, groupKey)
+	}
+	log.Printf("[%s]%s dropped %d aggregates for windows up to %s as more than %d are waiting to be written", params.PluginName,
+		params.InstanceName, len(dropped), latest.Format(time.RFC3339), maxPendingAggregates)
+}
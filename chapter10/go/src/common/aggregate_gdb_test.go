@@ -0,0 +1,163 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAggregator(t *testing.T, keys string, fields string) *windowAggregator {
+	keyPaths, err := parseRecordPathList(keys)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	fieldPaths, err := parseRecordPathList(fields)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return &windowAggregator{params: SqlParams{DBType: PostgresDBType, TableName: "log_summary"}, window: time.Minute,
+		keys: keyPaths, fields: fieldPaths, groups: make(map[string]*aggregateGroup)}
+}
+
+func TestAggregateAdd(t *testing.T) {
+	aggregator := newTestAggregator(t, "$service, $http['status']", "$duration")
+	at := time.Date(2024, 3, 1, 12, 0, 30, 0, time.UTC)
+	for _, recd := range []FlushRecord{
+		{Timestamp: at, Record: RowDefinition{"service": "web", "http": map[interface{}]interface{}{"status": int64(200)}, "duration": int64(10)}},
+		{Timestamp: at.Add(20 * time.Second), Record: RowDefinition{"service": []byte("web"), "http": map[interface{}]interface{}{"status": int64(200)}, "duration": 30.5}},
+		{Timestamp: at, Record: RowDefinition{"service": "web", "http": map[interface{}]interface{}{"status": int64(200)}, "duration": "slow"}},
+		{Timestamp: at, Record: RowDefinition{"service": "web", "duration": "4"}},
+		{Timestamp: at, Record: RowDefinition{"service": "", "http": map[interface{}]interface{}{"status": int64(200)}}},
+		{Timestamp: at, Record: RowDefinition{"service": nil, "http": map[interface{}]interface{}{"status": int64(200)}}},
+		{Timestamp: at.Add(time.Minute), Record: RowDefinition{"service": "web", "http": map[interface{}]interface{}{"status": int64(200)}}},
+	} {
+		aggregator.add(recd)
+	}
+
+	windowStart := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		windowStart time.Time
+		keyValues   []interface{}
+		count       int64
+		duration    fieldAggregate
+	}{
+		{windowStart, []interface{}{"web", int64(200)}, 3, fieldAggregate{count: 2, sum: 40.5, min: 10, max: 30.5}},
+		{windowStart, []interface{}{"web", nil}, 1, fieldAggregate{count: 1, sum: 4, min: 4, max: 4}},
+		{windowStart, []interface{}{"", int64(200)}, 1, fieldAggregate{}},
+		{windowStart, []interface{}{nil, int64(200)}, 1, fieldAggregate{}},
+		{windowStart.Add(time.Minute), []interface{}{"web", int64(200)}, 1, fieldAggregate{}},
+	}
+	if len(aggregator.groups) != len(tests) {
+		t.Errorf("got %d groups, expected %d", len(aggregator.groups), len(tests))
+	}
+	for _, test := range tests {
+		var found *aggregateGroup
+		for _, group := range aggregator.groups {
+			if group.windowStart.Equal(test.windowStart) && reflect.DeepEqual(group.keyValues, test.keyValues) {
+				found = group
+			}
+		}
+		if found == nil {
+			t.Errorf("no group for %v %v", test.windowStart, test.keyValues)
+			continue
+		}
+		if found.count != test.count || found.fields[0] != test.duration {
+			t.Errorf("%v %v: got %d records and %+v, expected %d and %+v", test.windowStart, test.keyValues, found.count, found.fields[0],
+				test.count, test.duration)
+		}
+	}
+}
+
+func TestAggregateGroupMerge(t *testing.T) {
+	group := &aggregateGroup{count: 2, fields: []fieldAggregate{{count: 2, sum: 10, min: 4, max: 6}, {}}}
+	group.merge(&aggregateGroup{count: 3, fields: []fieldAggregate{{count: 1, sum: 1, min: 1, max: 1}, {count: 2, sum: 5, min: 2, max: 3}}})
+	expected := []fieldAggregate{{count: 3, sum: 11, min: 1, max: 6}, {count: 2, sum: 5, min: 2, max: 3}}
+	if group.count != 5 || !reflect.DeepEqual(group.fields, expected) {
+		t.Errorf("got %d records and %+v, expected 5 and %+v", group.count, group.fields, expected)
+	}
+}
+
+func TestBuildAggregateExpr(t *testing.T) {
+	aggregator := newTestAggregator(t, "$service", "$duration, $bytes")
+	windowStart := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	group := &aggregateGroup{windowStart: windowStart, keyValues: []interface{}{nil}, count: 2,
+		fields: []fieldAggregate{{count: 2, sum: 30, min: 10, max: 20}, {}}}
+
+	tests := []struct {
+		dbType string
+		prefix string
+		update string
+	}{
+		{PostgresDBType, "INSERT INTO log_summary AS existing (window_start,service,event_count,duration_count,duration_sum,duration_min," +
+			"duration_max,duration_avg,bytes_count,bytes_sum,bytes_min,bytes_max,bytes_avg) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13) " +
+			"ON CONFLICT (window_start, service) DO UPDATE SET ",
+			"event_count = existing.event_count + EXCLUDED.event_count"},
+		{mysqlDBType, "INSERT INTO log_summary (window_start,service,event_count,duration_count,duration_sum,duration_min," +
+			"duration_max,duration_avg,bytes_count,bytes_sum,bytes_min,bytes_max,bytes_avg) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?) " +
+			"ON DUPLICATE KEY UPDATE ",
+			"event_count = event_count + VALUES(event_count)"},
+	}
+	for _, test := range tests {
+		params := &SqlParams{DBType: test.dbType, TableName: "log_summary"}
+		sqlStmt, args := buildAggregateExpr(params, aggregator.keys, aggregator.fields, group)
+		if !strings.HasPrefix(sqlStmt, test.prefix) || !strings.Contains(sqlStmt, test.update) {
+			t.Errorf("%s: got %s, expected it to start %s and contain %s", test.dbType, sqlStmt, test.prefix, test.update)
+		}
+		// MySQL applies the assignments in order, so the average has to come before the sum and count it uses
+		if strings.Index(sqlStmt, "duration_avg =") > strings.Index(sqlStmt, "duration_sum =") {
+			t.Errorf("%s: the average is updated after the sum", test.dbType)
+		}
+		expected := []interface{}{windowStart, nil, int64(2), int64(2), 30.0, 10.0, 20.0, 15.0, 0, nil, nil, nil, nil}
+		if !reflect.DeepEqual(args, expected) {
+			t.Errorf("%s: got %v, expected %v", test.dbType, args, expected)
+		}
+	}
+
+	recd := aggregator.groupRecord(group)
+	if !recd.Timestamp.Equal(windowStart) || recd.Record["duration_avg"] != 15.0 || recd.Record["service"] != nil || len(recd.Record) != 13 {
+		t.Errorf("got %v, expected the group's columns as a record", recd)
+	}
+}
+
+func TestAggregateDropOldest(t *testing.T) {
+	aggregator := newTestAggregator(t, "$service", "")
+	windowStart := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for idx := 0; idx < maxPendingAggregates+2; idx++ {
+		aggregator.groups[strconv.Itoa(idx)] = &aggregateGroup{windowStart: windowStart.Add(time.Duration(idx) * time.Minute)}
+	}
+	aggregator.dropOldest()
+	if len(aggregator.groups) != maxPendingAggregates {
+		t.Errorf("got %d groups, expected %d", len(aggregator.groups), maxPendingAggregates)
+	}
+	for _, groupKey := range []string{"0", "1"} {
+		if _, found := aggregator.groups[groupKey]; found {
+			t.Errorf("group %s should have been dropped as one of the oldest", groupKey)
+		}
+	}
+}
+
+func TestValidateAggregateParams(t *testing.T) {
+	tests := []struct {
+		params SqlParams
+		valid  bool
+	}{
+		{SqlParams{}, true},
+		{SqlParams{DBType: PostgresDBType, WriteMode: writeModeInsert, AggregateWindow: "1m", AggregateKeys: "$service", AggregateFields: "$duration"}, true},
+		{SqlParams{DBType: mysqlDBType, WriteMode: writeModeInsert, AggregateWindow: "30s", AggregateKeys: "$kubernetes['pod_name']"}, true},
+		{SqlParams{DBType: PostgresDBType, WriteMode: writeModeInsert, AggregateWindow: "500ms"}, false},
+		{SqlParams{DBType: PostgresDBType, WriteMode: writeModeInsert, AggregateWindow: "soon"}, false},
+		{SqlParams{DBType: sqliteDBType, WriteMode: writeModeInsert, AggregateWindow: "1m"}, false},
+		{SqlParams{DBType: PostgresDBType, WriteMode: writeModeCDC, AggregateWindow: "1m"}, false},
+		{SqlParams{DBType: PostgresDBType, WriteMode: writeModeInsert, AggregateWindow: "1m", TableName: "logs_${tag[1]}"}, false},
+		{SqlParams{DBType: PostgresDBType, WriteMode: writeModeInsert, AggregateWindow: "1m", Dimensions: "$service"}, false},
+		{SqlParams{DBType: PostgresDBType, WriteMode: writeModeInsert, AggregateWindow: "1m", AggregateKeys: "$service['"}, false},
+		{SqlParams{DBType: PostgresDBType, WriteMode: writeModeInsert, AggregateWindow: "1m", AggregateFields: "$log['bad name']"}, false},
+	}
+	for _, test := range tests {
+		if err := validateAggregateParams(&test.params); (err == nil) != test.valid {
+			t.Errorf("%s %s %s: got %v, expected valid %t", test.params.DBType, test.params.AggregateWindow, test.params.AggregateKeys, err, test.valid)
+		}
+	}
+}
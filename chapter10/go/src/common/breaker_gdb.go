@@ -0,0 +1,157 @@
+package main
+
+// A circuit breaker around the database calls. During an outage every flush or query would otherwise wait on
+// connection attempts and time outs, backing up the Fluent Bit engine. After circuit_breaker_failures consecutive
+// failures that look like the database is unavailable (see classifyDBError), the breaker opens and calls return
+// straight away - the output asks for a retry and the input skips the query. Once circuit_breaker_cooldown has
+// passed the breaker half opens and the next call probes the database with a ping. If that works the breaker closes,
+// otherwise it stays open for another cool down. Each breaker is kept with the connection pool it guards, so every
+// plugin instance (and each tenant database) has its own, using the instance's settings.
+// A negative circuit_breaker_failures turns the breaker off.
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultBreakerFailures = 5
+const defaultBreakerCooldown = 30 * time.Second
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (state breakerState) String() string {
+	switch state {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// returned instead of calling the database while the breaker is open
+var errBreakerOpen = errors.New("circuit breaker open, database calls suspended")
+
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	name      string
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	threshold int
+	cooldown  time.Duration
+	pool      *dbPool
+}
+
+// check the breaker settings
+func validateBreakerParams(params *SqlParams) error {
+	params.CircuitCooldown = strings.TrimSpace(params.CircuitCooldown)
+	if _, err := parseDurationStr(params.CircuitCooldown); err != nil {
+		return errors.New(Plugin_CircuitBreakerCooldown + " - " + err.Error())
+	}
+	return nil
+}
+
+// get the breaker for the instance's own database
+func getBreaker(params *SqlParams) *circuitBreaker {
+	return getResources(params).pool.circuitBreaker(params)
+}
+
+// set up a breaker for the pool, with the settings in the params
+func newCircuitBreaker(params *SqlParams, pool *dbPool) *circuitBreaker {
+	breaker := &circuitBreaker{name: params.DBType + " " + params.Host + ":" + params.Port + "/" + params.DBName, pool: pool}
+	if len(params.DSN) > 0 {
+		// the DSN may hold the password, so isn't used in the name
+		breaker.name = params.DBType + " " + Plugin_DSN + " of " + params.PluginName + params.InstanceName
+	}
+	breaker.threshold = params.CircuitFailures
+	if breaker.threshold == 0 {
+		breaker.threshold = defaultBreakerFailures
+	}
+	breaker.cooldown, _ = parseDurationStr(params.CircuitCooldown)
+	if breaker.cooldown <= 0 {
+		breaker.cooldown = defaultBreakerCooldown
+	}
+	return breaker
+}
+
+func (breaker *circuitBreaker) changeState(params *SqlParams, state breakerState, reason string) {
+	log.Printf("[%s]%s circuit breaker for %s changed from %s to %s - %s", params.PluginName, params.InstanceName, breaker.name, breaker.state, state, reason)
+	incrementMetric(params, "circuit_breaker_transitions_total", map[string]string{"state": state.String()}, 1)
+	breaker.state = state
+	if state == breakerOpen {
+		breaker.openedAt = time.Now()
+	}
+	if state == breakerClosed {
+		breaker.failures = 0
+	}
+}
+
+// check whether we can call the database. When the cool down has passed, a ping through the breaker's pool decides
+// whether the breaker closes. The ping is made without holding the lock, and while it is in flight the other calls
+// are turned away as if the breaker were still open
+func (breaker *circuitBreaker) allow(params *SqlParams) error {
+	if breaker.threshold < 0 {
+		return nil
+	}
+	breaker.mutex.Lock()
+	if breaker.state == breakerClosed {
+		breaker.mutex.Unlock()
+		return nil
+	}
+	if breaker.state == breakerHalfOpen || time.Since(breaker.openedAt) < breaker.cooldown {
+		breaker.mutex.Unlock()
+		return errBreakerOpen
+	}
+	breaker.changeState(params, breakerHalfOpen, "cool down of "+breaker.cooldown.String()+" over, probing the database")
+	breaker.mutex.Unlock()
+
+	err := breaker.pool.check(params)
+
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if err != nil {
+		breaker.changeState(params, breakerOpen, "probe failed - "+err.Error())
+		return errBreakerOpen
+	}
+	breaker.changeState(params, breakerClosed, "probe succeeded")
+	return nil
+}
+
+// record the result of a database call. Only errors suggesting the database is unavailable count as failures,
+// and a success starts the count again. Such an error also has the pool checked before it is next used
+func (breaker *circuitBreaker) record(params *SqlParams, err error) {
+	if err == errBreakerOpen {
+		return
+	}
+	retry := err != nil && classifyDBError(err) == errClassRetry
+	if retry {
+		breaker.pool.markSuspect()
+	}
+	if breaker.threshold < 0 {
+		return
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if err == nil {
+		breaker.failures = 0
+		return
+	}
+	if !retry {
+		return
+	}
+	breaker.failures++
+	if breaker.state == breakerClosed && breaker.failures >= breaker.threshold {
+		breaker.changeState(params, breakerOpen, err.Error())
+	}
+}
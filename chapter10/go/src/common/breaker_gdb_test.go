@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+)
+
+func (breaker *circuitBreaker) currentState() breakerState {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	return breaker.state
+}
+
+// as if the cool down had passed
+func (breaker *circuitBreaker) cooledDown() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.openedAt = time.Now().Add(-2 * breaker.cooldown)
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	params := &SqlParams{PluginName: "gdb-test", DBType: PostgresDBType, CircuitFailures: 2, CircuitCooldown: "1m"}
+	pool, connector := newTestPool(t)
+	breaker := pool.circuitBreaker(params)
+	if breaker.threshold != 2 || breaker.cooldown != time.Minute || pool.circuitBreaker(params) != breaker {
+		t.Fatalf("got a threshold of %d and cool down of %v, expected 2 and 1m", breaker.threshold, breaker.cooldown)
+	}
+
+	// only errors suggesting the database is unavailable count, and a success starts the count again
+	breaker.record(params, errors.New("syntax error"))
+	breaker.record(params, driver.ErrBadConn)
+	breaker.record(params, nil)
+	breaker.record(params, driver.ErrBadConn)
+	if breaker.currentState() != breakerClosed || breaker.failures != 1 {
+		t.Errorf("got %s with %d failures, expected closed with 1", breaker.currentState(), breaker.failures)
+	}
+	if !pool.suspect {
+		t.Errorf("the pool should be checked before it is next used")
+	}
+	breaker.record(params, driver.ErrBadConn)
+	if breaker.currentState() != breakerOpen {
+		t.Fatalf("got %s, expected open after 2 failures", breaker.currentState())
+	}
+	if err := breaker.allow(params); err != errBreakerOpen {
+		t.Errorf("got %v during the cool down, expected %v", err, errBreakerOpen)
+	}
+	if connector.pings != 0 {
+		t.Errorf("got %d pings during the cool down, expected none", connector.pings)
+	}
+
+	// once cooled down a failed probe opens the breaker for another cool down
+	connector.set(func(connector *testConnector) { connector.down = errors.New("connection refused") })
+	breaker.cooledDown()
+	if err := breaker.allow(params); err != errBreakerOpen || breaker.currentState() != breakerOpen {
+		t.Errorf("got %v and %s, expected the probe to fail and the breaker to open", err, breaker.currentState())
+	}
+	pings := connector.pings
+	if err := breaker.allow(params); err != errBreakerOpen || connector.pings != pings {
+		t.Errorf("got %v with %d more pings, expected a new cool down", err, connector.pings-pings)
+	}
+
+	// and a successful probe closes it
+	connector.set(func(connector *testConnector) { connector.down = nil })
+	breaker.cooledDown()
+	if err := breaker.allow(params); err != nil || breaker.currentState() != breakerClosed || breaker.failures != 0 {
+		t.Errorf("got %v and %s, expected the probe to succeed and the breaker to close", err, breaker.currentState())
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	params := &SqlParams{PluginName: "gdb-test", DBType: PostgresDBType, CircuitFailures: -1}
+	pool, _ := newTestPool(t)
+	breaker := pool.circuitBreaker(params)
+	for idx := 0; idx < 2*defaultBreakerFailures; idx++ {
+		breaker.record(params, driver.ErrBadConn)
+	}
+	if err := breaker.allow(params); err != nil || breaker.currentState() != breakerClosed {
+		t.Errorf("got %v and %s, expected a disabled breaker to stay closed", err, breaker.currentState())
+	}
+}
+
+func TestBreakerProbeInFlight(t *testing.T) {
+	params := &SqlParams{PluginName: "gdb-test", DBType: PostgresDBType, CircuitFailures: 1}
+	pool, connector := newTestPool(t)
+	breaker := pool.circuitBreaker(params)
+	breaker.record(params, driver.ErrBadConn)
+	breaker.cooledDown()
+
+	block := make(chan struct{})
+	connector.set(func(connector *testConnector) { connector.block = block })
+	result := make(chan error)
+	go func() { result <- breaker.allow(params) }()
+	for deadline := time.Now().Add(time.Second); breaker.currentState() != breakerHalfOpen && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the other calls are turned away straight away rather than waiting for the probe
+	if err := breaker.allow(params); err != errBreakerOpen {
+		t.Errorf("got %v while probing, expected %v", err, errBreakerOpen)
+	}
+	close(block)
+	if err := <-result; err != nil || breaker.currentState() != breakerClosed {
+		t.Errorf("got %v and %s, expected the probe to close the breaker", err, breaker.currentState())
+	}
+}
+
+func TestBreakerPerInstance(t *testing.T) {
+	first := &SqlParams{PluginName: "gdb-test", InstanceName: "first", ContextId: nextContextId(), DBType: PostgresDBType,
+		Host: "db", Port: "5432", DBName: "logs"}
+	second := *first
+	second.InstanceName = "second"
+	second.ContextId = nextContextId()
+	second.CircuitFailures = -1
+	defer releaseInstanceResources(first)
+	defer releaseInstanceResources(&second)
+
+	// the instances use the same database, but each keeps its own settings
+	firstBreaker := getBreaker(first)
+	secondBreaker := getBreaker(&second)
+	if firstBreaker == secondBreaker || firstBreaker.threshold != defaultBreakerFailures || secondBreaker.threshold != -1 {
+		t.Errorf("got thresholds of %d and %d, expected separate breakers with %d and -1", firstBreaker.threshold,
+			secondBreaker.threshold, defaultBreakerFailures)
+	}
+	if getBreaker(first) != firstBreaker {
+		t.Errorf("expected the instance to keep its breaker")
+	}
+}
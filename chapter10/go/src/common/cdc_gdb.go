@@ -0,0 +1,229 @@
+package main
+
+// Support for using the output as a replication target. With write_mode set to cdc, each record carries an operation
+// in the op_field (op by default) telling us whether it should be inserted, or used to update or delete the row
+// identified by the pk. The records are applied in the order Fluent Bit gives them to us, within the one transaction.
+// The operation values we recognise follow the common change data capture conventions:
+//   insert - insert, i, c, create, r, read, snapshot
+//   update - update, u
+//   delete - delete, d
+// The pk can be a comma separated list of columns for a composite key.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+)
+
+const writeModeInsert = "insert"
+const writeModeCDC = "cdc"
+const defaultOpField = "op"
+
+type changeOp int
+
+const (
+	changeInsert changeOp = iota
+	changeUpdate
+	changeDelete
+)
+
+// map the operation value in the record to the change to make
+func parseChangeOp(opStr string) (changeOp, error) {
+	switch strings.ToLower(strings.TrimSpace(opStr)) {
+	case "insert", "i", "c", "create", "r", "read", "snapshot":
+		return changeInsert, nil
+	case "update", "u":
+		return changeUpdate, nil
+	case "delete", "d":
+		return changeDelete, nil
+	}
+	return changeInsert, errors.New("unknown operation '" + opStr + "'")
+}
+
+// check the settings for the write mode, defaulting to inserts
+func validateWriteMode(params *SqlParams) error {
+	params.WriteMode = strings.ToLower(strings.TrimSpace(params.WriteMode))
+	switch params.WriteMode {
+	case "", writeModeInsert:
+		params.WriteMode = writeModeInsert
+		return nil
+	case writeModeStatement, writeModeProcedure:
+		return validateStatementParams(params)
+	case writeModeCDC:
+	default:
+		return errors.New("Unknown " + Plugin_WriteMode + " " + params.WriteMode + " for " + params.PluginName)
+	}
+
+	params.PK = strings.TrimSpace(params.PK)
+	if len(params.PK) == 0 {
+		return errors.New(Plugin_WriteMode + " " + writeModeCDC + " needs a " + Plugin_PK + " for " + params.PluginName)
+	}
+	params.OpField = strings.TrimSpace(params.OpField)
+	if len(params.OpField) == 0 {
+		params.OpField = defaultOpField
+	}
+	if _, err := parseRecordPath(params.OpField); err != nil {
+		return errors.New("invalid " + Plugin_OpField + " - " + err.Error())
+	}
+
+	// the changes have to be applied in order to a single table, and a change the database rejects can't be skipped
+	if len(params.UnmatchedTable) > 0 {
+		return errors.New(Plugin_UnmatchedTable + " can't be used with the " + writeModeCDC + " " + Plugin_WriteMode)
+	}
+	if len(params.DeadLetterTable) > 0 {
+		return errors.New(Plugin_DeadLetterTable + " can't be used with the " + writeModeCDC + " " + Plugin_WriteMode)
+	}
+	if tmpl, err := parseTableTemplate(params); err == nil && !tmpl.static {
+		return errors.New("a " + Plugin_TableName + " template can't be used with the " + writeModeCDC + " " + Plugin_WriteMode)
+	}
+	return nil
+}
+
+// apply the change, failing when an update or delete doesn't find the row - the replica no longer matches the
+// source, so carrying on would only take them further apart
+func execChange(ctx context.Context, tx *sql.Tx, params *SqlParams, values RowDefinition) error {
+	op, err := recordChangeOp(params, values)
+	if err != nil {
+		return recordContentError{err}
+	}
+	sqlStmt, args, err := buildChangeExpr(params, values)
+	if err != nil {
+		return recordContentError{err}
+	}
+	log.Printf("[%s]%s write expression: %s", params.PluginName, params.InstanceName, sqlStmt)
+	result, err := tx.ExecContext(ctx, sqlStmt, args...)
+	if err != nil || op == changeInsert {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return recordContentError{errors.New("no row in " + params.TableName + " has the " + Plugin_PK + " values of the change")}
+	}
+	return nil
+}
+
+// the column names of the primary key
+func pkColumns(params *SqlParams) []string {
+	var cols []string
+	for _, col := range strings.Split(params.PK, ",") {
+		if col = strings.TrimSpace(col); len(col) > 0 {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+// the change the record's operation asks for
+func recordChangeOp(params *SqlParams, values RowDefinition) (changeOp, error) {
+	opPath, err := parseRecordPath(params.OpField)
+	if err != nil {
+		return changeInsert, err
+	}
+	opVal, found := lookupRecordPath(values, opPath)
+	if !found {
+		return changeInsert, errors.New("record has no " + params.OpField + " operation")
+	}
+	return parseChangeOp(typeToStr(toDBValue(opVal), false))
+}
+
+// build the statement for the change the record describes
+func buildChangeExpr(params *SqlParams, values RowDefinition) (string, []interface{}, error) {
+	op, err := recordChangeOp(params, values)
+	if err != nil {
+		return "", nil, err
+	}
+	opPath, err := parseRecordPath(params.OpField)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// the operation isn't a column, so if it is a top level attribute we leave it out of the values written
+	rowValues := values
+	if len(opPath) == 1 {
+		rowValues = make(RowDefinition, len(values))
+		for key, val := range values {
+			if keyToStr(key) != opPath.leafName() {
+				rowValues[key] = val
+			}
+		}
+	}
+
+	switch op {
+	case changeUpdate:
+		return buildUpdateExpr(params, rowValues)
+	case changeDelete:
+		return buildDeleteByPKExpr(params, rowValues)
+	}
+	return buildInsertExpr(params, rowValues)
+}
+
+// the where clause identifying the row by its primary key, with the key values added to the args
+func buildPKWhere(params *SqlParams, values RowDefinition, args []interface{}) (string, []interface{}, error) {
+	var conditions []string
+	for _, col := range pkColumns(params) {
+		val, found := lookupMapKey(values, col)
+		if !found || val == nil {
+			return "", nil, errors.New("record has no value for the " + Plugin_PK + " column " + col)
+		}
+		args = append(args, toDBValue(val))
+		conditions = append(conditions, columnIdent(params, col)+" = "+bindVar(params, len(args)))
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args, nil
+}
+
+// update the row with the record's values. When query_cols is set only those columns present in the record are
+// updated, so a change carrying just some of the columns doesn't clear the others. The key columns aren't updated
+func buildUpdateExpr(params *SqlParams, values RowDefinition) (string, []interface{}, error) {
+	isPK := make(map[string]bool)
+	for _, col := range pkColumns(params) {
+		isPK[col] = true
+	}
+
+	var colNames []string
+	if params.ColsCSV == "*" || len(params.ColsCSV) == 0 {
+		for key := range values {
+			colNames = append(colNames, keyToStr(key))
+		}
+	} else {
+		for _, colName := range strings.Split(params.ColsCSV, ",") {
+			colName = strings.TrimSpace(colName)
+			if _, found := lookupMapKey(values, colName); found {
+				colNames = append(colNames, colName)
+			}
+		}
+	}
+
+	var args []interface{}
+	var assignments []string
+	for _, colName := range colNames {
+		if isPK[colName] {
+			continue
+		}
+		val, _ := lookupMapKey(values, colName)
+		args = append(args, toDBValue(val))
+		assignments = append(assignments, columnIdent(params, colName)+" = "+bindVar(params, len(args)))
+	}
+	if len(assignments) == 0 {
+		return "", nil, errors.New("No data values provided for the update")
+	}
+
+	whereStmt, args, err := buildPKWhere(params, values, args)
+	if err != nil {
+		return "", nil, err
+	}
+	return "UPDATE " + params.TableName + " SET " + strings.Join(assignments, ", ") + whereStmt, args, nil
+}
+
+// delete the row identified by the record's primary key values
+func buildDeleteByPKExpr(params *SqlParams, values RowDefinition) (string, []interface{}, error) {
+	whereStmt, args, err := buildPKWhere(params, values, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return "DELETE FROM " + params.TableName + whereStmt, args, nil
+}
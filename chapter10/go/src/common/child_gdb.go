@@ -0,0 +1,192 @@
+package main
+
+// Records often carry arrays (spans, tags, errors) which don't fit in a single row. The child_tables option maps
+// array attributes to child tables, e.g. $spans=log_spans, $errors=log_errors. The parent row is inserted without
+// the arrays, and then a row is inserted into the child table for each element of the array, with the child_fk_column
+// holding the parent's id. The id is the record's parent_key value if it has one, otherwise the id generated by the
+// database for the parent row.
+// Elements that are maps provide a column for each key, anything else is written to a column called value.
+// The parent and its children are written together within the record's savepoint, so if any of them is rejected
+// none of them are written.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+)
+
+const defaultParentKey = "id"
+const defaultChildFKColumn = "parent_id"
+const childValueColumn = "value"
+
+// an array attribute and the table its elements are written to
+type childTableMapping struct {
+	path  recordPath
+	table string
+}
+
+// parse the child_tables setting - a comma separated list of record accessor=table pairs
+func parseChildTables(params *SqlParams) ([]childTableMapping, error) {
+	var mappings []childTableMapping
+	nameRegex := regexp.MustCompile(defaultTableRegex)
+	for _, mappingStr := range strings.Split(params.ChildTables, ",") {
+		mappingStr = strings.TrimSpace(mappingStr)
+		if len(mappingStr) == 0 {
+			continue
+		}
+		sepIdx := strings.LastIndex(mappingStr, "=")
+		if sepIdx < 0 {
+			return nil, errors.New(Plugin_ChildTables + " entry " + mappingStr + " needs to be in the form $array=table")
+		}
+		path, err := parseRecordPath(mappingStr[:sepIdx])
+		if err != nil {
+			return nil, errors.New(Plugin_ChildTables + " entry " + mappingStr + " - " + err.Error())
+		}
+		table := strings.TrimSpace(mappingStr[sepIdx+1:])
+		if !nameRegex.MatchString(table) {
+			return nil, errors.New(Plugin_ChildTables + " entry " + mappingStr + " has an invalid table name")
+		}
+		mappings = append(mappings, childTableMapping{path: path, table: table})
+	}
+	return mappings, nil
+}
+
+// check the child table settings, applying the defaults
+func validateChildTables(params *SqlParams) error {
+	params.ChildTables = strings.TrimSpace(params.ChildTables)
+	if len(params.ChildTables) == 0 {
+		return nil
+	}
+	if params.WriteMode != writeModeInsert {
+		return errors.New(Plugin_ChildTables + " can't be used with the " + params.WriteMode + " " + Plugin_WriteMode)
+	}
+	if _, err := parseChildTables(params); err != nil {
+		return err
+	}
+
+	params.ParentKey = strings.TrimSpace(params.ParentKey)
+	if len(params.ParentKey) == 0 {
+		params.ParentKey = defaultParentKey
+	}
+	params.ChildFKColumn = strings.TrimSpace(params.ChildFKColumn)
+	if len(params.ChildFKColumn) == 0 {
+		params.ChildFKColumn = defaultChildFKColumn
+	}
+	return nil
+}
+
+// insert the parent row, returning its id - either the value the record provides or the one the database generated
+func insertParent(ctx context.Context, tx *sql.Tx, params *SqlParams, values RowDefinition) (interface{}, error) {
+	sqlStmt, args, err := buildInsertExpr(params, values)
+	if err != nil {
+		return nil, recordContentError{err}
+	}
+
+	// when the hash column is in use the insert may be ignored, in which case the children have already been written
+	if parentId, found := lookupMapKey(values, params.ParentKey); found && parentId != nil {
+		log.Printf("[%s]%s write expression: %s", params.PluginName, params.InstanceName, sqlStmt)
+		result, err := tx.ExecContext(ctx, sqlStmt, args...)
+		if err == nil && len(params.HashColumn) > 0 {
+			if inserted, _ := result.RowsAffected(); inserted == 0 {
+				return nil, errDuplicateRecord
+			}
+		}
+		return toDBValue(parentId), err
+	}
+
+	log.Printf("[%s]%s write expression: %s", params.PluginName, params.InstanceName, sqlStmt)
+	parentId, err := getDialect(params).insertReturningId(ctx, tx, sqlStmt, args, params.ParentKey)
+	if err == nil && parentId == nil && len(params.HashColumn) > 0 {
+		return nil, errDuplicateRecord
+	}
+	return parentId, err
+}
+
+// the values for the parent row. The top level arrays are written to the child tables so we leave them out of the
+// parent, nested arrays are left where they are
+func parentRow(recd FlushRecord, mappings []childTableMapping) RowDefinition {
+	parentValues := make(RowDefinition, len(recd.Record))
+	for key, val := range recd.Record {
+		parentValues[key] = val
+	}
+	for _, mapping := range mappings {
+		if len(mapping.path) == 1 {
+			for key := range parentValues {
+				if keyToStr(key) == mapping.path.leafName() {
+					delete(parentValues, key)
+				}
+			}
+		}
+	}
+	return parentValues
+}
+
+// a row for each element of the array, linked to the parent by the fkColumn. A value that isn't an array is
+// treated as an array of one
+func childRows(array interface{}, fkColumn string, parentId interface{}) []RowDefinition {
+	elements, isArray := array.([]interface{})
+	if !isArray {
+		elements = []interface{}{array}
+	}
+
+	rows := make([]RowDefinition, 0, len(elements))
+	for _, element := range elements {
+		childValues := make(RowDefinition)
+		switch elementMap := element.(type) {
+		case map[interface{}]interface{}:
+			for key, val := range elementMap {
+				childValues[keyToStr(key)] = val
+			}
+		case map[string]interface{}:
+			for key, val := range elementMap {
+				childValues[key] = val
+			}
+		default:
+			childValues[childValueColumn] = element
+		}
+		childValues[fkColumn] = parentId
+		rows = append(rows, childValues)
+	}
+	return rows
+}
+
+// write the record as a parent row, followed by a row for each element of the mapped arrays
+func insertWithChildren(ctx context.Context, tx *sql.Tx, params *SqlParams, recd FlushRecord) error {
+	mappings, err := parseChildTables(params)
+	if err != nil {
+		return err
+	}
+
+	parentId, err := insertParent(ctx, tx, params, parentRow(recd, mappings))
+	if err == errDuplicateRecord {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, mapping := range mappings {
+		array, found := lookupRecordPath(recd.Record, mapping.path)
+		if !found || array == nil {
+			continue
+		}
+
+		childParams := *params
+		childParams.TableName = mapping.table
+		childParams.ColsCSV = "*"
+		childParams.HashColumn = ""
+		for _, childValues := range childRows(array, params.ChildFKColumn, parentId) {
+			sqlStmt, args, err := buildInsertExpr(&childParams, childValues)
+			if err != nil {
+				return recordContentError{err}
+			}
+			if _, err = tx.ExecContext(ctx, sqlStmt, args...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseChildTables(t *testing.T) {
+	tests := []struct {
+		childTables string
+		expected    []childTableMapping
+	}{
+		{"", nil},
+		{"$spans=log_spans", []childTableMapping{{recordPath{"spans"}, "log_spans"}}},
+		{" $spans = log_spans , $errors=log_errors,", []childTableMapping{{recordPath{"spans"}, "log_spans"}, {recordPath{"errors"}, "log_errors"}}},
+		{"$kubernetes['containers']=pod_containers", []childTableMapping{{recordPath{"kubernetes", "containers"}, "pod_containers"}}},
+		{"$http['a=b']=log_params", []childTableMapping{{recordPath{"http", "a=b"}, "log_params"}}},
+	}
+	for _, test := range tests {
+		mappings, err := parseChildTables(&SqlParams{ChildTables: test.childTables})
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.childTables, err)
+		} else if !reflect.DeepEqual(mappings, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.childTables, mappings, test.expected)
+		}
+	}
+
+	for _, childTables := range []string{"$spans", "$spans=", "$spans=log spans", "$spans=logs;drop", "=log_spans", "$spans['=log_spans"} {
+		if mappings, err := parseChildTables(&SqlParams{ChildTables: childTables}); err == nil {
+			t.Errorf("%s: got %v, expected an error", childTables, mappings)
+		}
+	}
+}
+
+func TestValidateChildTables(t *testing.T) {
+	params := &SqlParams{WriteMode: writeModeInsert, ChildTables: " $spans=log_spans "}
+	if err := validateChildTables(params); err != nil || params.ParentKey != defaultParentKey || params.ChildFKColumn != defaultChildFKColumn {
+		t.Errorf("got %v with %s and %s, expected the defaults", err, params.ParentKey, params.ChildFKColumn)
+	}
+	params = &SqlParams{WriteMode: writeModeInsert, ChildTables: "$spans=log_spans", ParentKey: "trace_id", ChildFKColumn: "trace"}
+	if err := validateChildTables(params); err != nil || params.ParentKey != "trace_id" || params.ChildFKColumn != "trace" {
+		t.Errorf("got %v with %s and %s, expected the settings kept", err, params.ParentKey, params.ChildFKColumn)
+	}
+	if err := validateChildTables(&SqlParams{WriteMode: writeModeCDC, ChildTables: "$spans=log_spans"}); err == nil {
+		t.Errorf("expected child tables to need the insert write mode")
+	}
+}
+
+func TestParentRow(t *testing.T) {
+	mappings, err := parseChildTables(&SqlParams{ChildTables: "$spans=log_spans, $kubernetes['containers']=pod_containers"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	kubernetes := map[interface{}]interface{}{"pod": "web-1", "containers": []interface{}{"app", "proxy"}}
+	recd := FlushRecord{Record: RowDefinition{"id": "r1", "log": "GET /", "spans": []interface{}{"s1"}, "kubernetes": kubernetes}}
+
+	// only the top level arrays are taken out, and the record itself is left as it is
+	expected := RowDefinition{"id": "r1", "log": "GET /", "kubernetes": kubernetes}
+	if row := parentRow(recd, mappings); !reflect.DeepEqual(row, expected) {
+		t.Errorf("got %v, expected %v", row, expected)
+	}
+	if _, found := recd.Record["spans"]; !found {
+		t.Errorf("the record was changed")
+	}
+}
+
+func TestChildRows(t *testing.T) {
+	tests := []struct {
+		array    interface{}
+		expected []RowDefinition
+	}{
+		{[]interface{}{
+			map[interface{}]interface{}{"name": "db", "duration": int64(12)},
+			map[string]interface{}{"name": "cache", "parent_id": "ignored"},
+		}, []RowDefinition{
+			{"name": "db", "duration": int64(12), "parent_id": int64(42)},
+			{"name": "cache", "parent_id": int64(42)},
+		}},
+		{[]interface{}{"timeout", int64(3), nil}, []RowDefinition{
+			{"value": "timeout", "parent_id": int64(42)},
+			{"value": int64(3), "parent_id": int64(42)},
+			{"value": nil, "parent_id": int64(42)},
+		}},
+		{"timeout", []RowDefinition{{"value": "timeout", "parent_id": int64(42)}}},
+		{map[interface{}]interface{}{"name": "db"}, []RowDefinition{{"name": "db", "parent_id": int64(42)}}},
+		{[]interface{}{}, []RowDefinition{}},
+	}
+	for _, test := range tests {
+		if rows := childRows(test.array, defaultChildFKColumn, int64(42)); !reflect.DeepEqual(rows, test.expected) {
+			t.Errorf("%v: got %v, expected %v", test.array, rows, test.expected)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+// ClickHouse as a destination for the output, using the ClickHouse/clickhouse-go driver over the native protocol.
+// ClickHouse works best with few, large inserts, so rather than writing record by record within a transaction,
+// each flush is sent as one block per table. The driver checks values strictly against the column types, so the
+// records are converted using the table's columns - timestamps into DateTime64, and nested maps into Map(String,
+// String) or JSON columns. As ClickHouse has no savepoints, upserts or generated keys, the features that depend
+// on them aren't available, and it can't be used by the input.
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+type clickhouseDialect struct{}
+
+// ClickHouse error codes - see https://github.com/ClickHouse/ClickHouse/blob/master/src/Common/ErrorCodes.cpp
+var clickhouseRetryErrors = map[int32]bool{
+	3:   true, // unexpected end of file
+	159: true, // timeout exceeded
+	202: true, // too many simultaneous queries
+	209: true, // socket timeout
+	210: true, // network error
+	241: true, // memory limit exceeded
+	242: true, // table is read only - e.g. it has lost its connection to Keeper
+	252: true, // too many parts - inserts are arriving faster than the merges
+	319: true, // unknown status of insert
+	999: true, // Keeper exception
+}
+var clickhouseRecordErrors = map[int32]bool{
+	6:   true, // cannot parse text
+	27:  true, // cannot parse input
+	41:  true, // cannot parse date time
+	53:  true, // type mismatch
+	70:  true, // cannot convert type
+	72:  true, // cannot parse number
+	117: true, // incorrect data
+	131: true, // string too large
+	469: true, // constraint violated
+}
+var clickhouseAuthErrors = map[int32]bool{
+	192: true, // UNKNOWN_USER
+	193: true, // WRONG_PASSWORD
+	516: true, // AUTHENTICATION_FAILED
+}
+
+func (clickhouseDialect) usesServer() bool {
+	return true
+}
+
+// with TLS the server's certificate is verified against the system's CA certificates
+func (clickhouseDialect) connectionStr(params *SqlParams) string {
+	connectURL := url.URL{
+		Scheme: clickhouseDBType,
+		User:   url.UserPassword(params.User, params.Password),
+		Host:   net.JoinHostPort(params.Host, params.Port),
+		Path:   "/" + params.DBName,
+	}
+	query := url.Values{}
+	if tlsEnabled(params) {
+		query.Set("secure", "true")
+		query.Set("skip_verify", strconv.FormatBool(!tlsVerify(params)))
+	}
+	connectURL.RawQuery = addDriverOptions(query, params).Encode()
+	return connectURL.String()
+}
+
+func (clickhouseDialect) quoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "\\`") + "`"
+}
+
+func (clickhouseDialect) bindVar(idx int) string {
+	return "?"
+}
+
+func (clickhouseDialect) limitQuery(sqlStmt string, limit int, offset int) string {
+	sqlStmt = sqlStmt + " LIMIT " + strconv.Itoa(limit)
+	if offset > 0 {
+		sqlStmt = sqlStmt + " OFFSET " + strconv.Itoa(offset)
+	}
+	return sqlStmt
+}
+
+func (dialect clickhouseDialect) insertExpr(table string, cols []string, rowCount int) string {
+	rows := make([]string, rowCount)
+	for idx := range rows {
+		rows[idx] = "(" + strings.Join(rowPlaceholders(dialect, idx*len(cols)+1, len(cols)), ",") + ")"
+	}
+	return "INSERT INTO " + table + " (" + strings.Join(cols, ",") + ") VALUES " + strings.Join(rows, ",")
+}
+
+// ClickHouse has no upsert - duplicates are removed by the table engine (e.g. ReplacingMergeTree) as it merges, so
+// the row is simply inserted
+func (dialect clickhouseDialect) upsertExpr(table string, cols []string, conflictCols []string, updates func(existing, incoming func(string) string) []string) string {
+	return dialect.insertExpr(table, cols, 1)
+}
+
+func (clickhouseDialect) insertReturningId(ctx context.Context, conn dbConn, sqlStmt string, args []interface{}, keyCol string) (interface{}, error) {
+	return nil, errors.New("ClickHouse doesn't generate keys")
+}
+
+// there are no savepoints, so these are never executed - see validateClickHouseParams
+func (clickhouseDialect) savepoint(name string) string {
+	return ""
+}
+
+func (clickhouseDialect) rollbackToSavepoint(name string) string {
+	return ""
+}
+
+func (clickhouseDialect) releaseSavepoint(name string) string {
+	return ""
+}
+
+// the driver gathers the rows of a prepared insert into a block, which it sends when the transaction commits
+func (clickhouseDialect) bulkLoad(ctx context.Context, tx *sql.Tx, table string, cols []string, rows [][]interface{}) error {
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO "+table+" ("+strings.Join(cols, ",")+")")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		if _, err = stmt.ExecContext(ctx, row...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (clickhouseDialect) classifyError(err error) (dbErrorClass, bool) {
+	var chErr *clickhouse.Exception
+	if !errors.As(err, &chErr) {
+		return errClassNone, false
+	}
+	if clickhouseRetryErrors[chErr.Code] {
+		return errClassRetry, true
+	}
+	if clickhouseRecordErrors[chErr.Code] {
+		return errClassRecord, true
+	}
+	return errClassFatal, true
+}
+
+func (clickhouseDialect) authFailed(err error) bool {
+	var chErr *clickhouse.Exception
+	return errors.As(err, &chErr) && clickhouseAuthErrors[chErr.Code]
+}
+
+// the output features that need SQL ClickHouse doesn't have are rejected at startup
+func validateClickHouseParams(params *SqlParams) error {
+	if params.DBType != clickhouseDBType {
+		return nil
+	}
+	var unsupported string
+	switch {
+	case params.WriteMode != writeModeInsert:
+		unsupported = Plugin_WriteMode + " " + params.WriteMode
+	case len(params.ChildTables) > 0:
+		unsupported = Plugin_ChildTables
+	case len(params.Dimensions) > 0:
+		unsupported = Plugin_Dimensions
+	case len(params.DeadLetterTable) > 0:
+		unsupported = Plugin_DeadLetterTable
+	case len(params.HashColumn) > 0 && params.HashDedup == hashDedupConflict:
+		unsupported = Plugin_HashDedup + " " + hashDedupConflict
+	default:
+		return nil
+	}
+	return errors.New(unsupported + " is not supported for " + clickhouseDBType + " in " + params.PluginName)
+}
+
+// a column of the destination table and its ClickHouse type
+type clickhouseColumn struct {
+	name    string
+	colType string
+}
+
+// the columns of the table we can insert into, in table order. Materialized and alias columns are computed
+// by ClickHouse, so they are left out
+func getClickHouseColumns(ctx context.Context, db *sql.DB, table string) ([]clickhouseColumn, error) {
+	schema, tableName := splitTableName(table)
+	sqlStmt := "SELECT name, type FROM system.columns WHERE database = currentDatabase() AND table = ?"
+	args := []interface{}{tableName}
+	if len(schema) > 0 {
+		sqlStmt = "SELECT name, type FROM system.columns WHERE database = ? AND table = ?"
+		args = []interface{}{strings.TrimSuffix(schema, "."), tableName}
+	}
+	rows, err := db.QueryContext(ctx, sqlStmt+" AND default_kind NOT IN ('MATERIALIZED', 'ALIAS') ORDER BY position", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []clickhouseColumn
+	for rows.Next() {
+		var column clickhouseColumn
+		if err = rows.Scan(&column.name, &column.colType); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, errors.New("table " + table + " not found")
+	}
+	return columns, nil
+}
+
+// ClickHouse has no transaction covering more than one table, so when a chunk's records go to several tables
+// and a later table fails, the blocks already written are remembered until the chunk is written completely.
+// When Fluent Bit retries the chunk, those tables are skipped rather than getting the records a second time
+const clickhouseBlockCacheSize = 10000
+
+var writtenBlockMutex sync.Mutex
+var writtenBlocks = newLRUCache(clickhouseBlockCacheSize)
+
+// identifies the block by the database, the table and the hashes of its records
+func clickHouseBlockKey(params *SqlParams, group *tableGroup) string {
+	hash := sha256.New()
+	for _, recd := range group.records {
+		hash.Write([]byte(recordHash(recd)))
+	}
+	return databaseKey(params) + "/" + group.tableName + "/" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// write each table's records as a single block, returning the number of records rejected. A record is
+// rejected if its values can't be converted to the column types - once the block has been sent, ClickHouse
+// accepts or rejects it as a whole
+func writeClickHouseBlocks(ctx context.Context, db *sql.DB, params *SqlParams, groups []*tableGroup) (int, error) {
+	var rejected int = 0
+	var written []string
+	for _, group := range groups {
+		blockKey := clickHouseBlockKey(params, group)
+		writtenBlockMutex.Lock()
+		_, alreadyWritten := writtenBlocks.get(blockKey)
+		writtenBlockMutex.Unlock()
+		if alreadyWritten {
+			log.Printf("[%s]%s block of %d records for %s was written before the chunk was retried, skipping", params.PluginName,
+				params.InstanceName, len(group.records), group.tableName)
+			written = append(written, blockKey)
+			continue
+		}
+
+		columns, err := getClickHouseColumns(ctx, db, group.tableName)
+		if err != nil {
+			return rejected, err
+		}
+		columns = clickHouseInsertColumns(params, columns, group.records)
+
+		var rows [][]interface{}
+		for _, recd := range group.records {
+			// if we've been told where the event time goes and the record doesn't have it, use the record timestamp
+			if len(params.TimeColumn) > 0 {
+				if _, found := recd.Record[params.TimeColumn]; !found {
+					recd.Record[params.TimeColumn] = recd.Timestamp
+				}
+			}
+			row, err := clickHouseRow(columns, recd)
+			if err != nil {
+				log.Printf("[%s]%s record tagged %s rejected, skipping - %v", params.PluginName, params.InstanceName, recd.Tag, err)
+				rejected++
+				continue
+			}
+			rows = append(rows, row)
+		}
+		if len(rows) == 0 {
+			continue
+		}
+
+		colNames := make([]string, len(columns))
+		for idx, column := range columns {
+			colNames[idx] = columnIdent(params, column.name)
+		}
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return rejected, err
+		}
+		if err = getDialect(params).bulkLoad(ctx, tx, group.tableName, colNames, rows); err != nil {
+			tx.Rollback()
+			return rejected, err
+		}
+		if err = tx.Commit(); err != nil {
+			return rejected, err
+		}
+		log.Printf("[%s]%s wrote a block of %d records to %s", params.PluginName, params.InstanceName, len(rows), group.tableName)
+		if len(groups) > 1 {
+			writtenBlockMutex.Lock()
+			writtenBlocks.put(blockKey, true)
+			writtenBlockMutex.Unlock()
+			written = append(written, blockKey)
+		}
+	}
+
+	// the whole chunk is written, so a later chunk holding the same records is written again
+	writtenBlockMutex.Lock()
+	defer writtenBlockMutex.Unlock()
+	for _, blockKey := range written {
+		writtenBlocks.remove(blockKey)
+	}
+	return rejected, nil
+}
+
+// the columns the block provides - those named by query_cols, otherwise the table's columns that appear in at least
+// one of the records (and the time column). Columns left out take their default values
+func clickHouseInsertColumns(params *SqlParams, columns []clickhouseColumn, records []FlushRecord) []clickhouseColumn {
+	wanted := make(map[string]bool)
+	if params.ColsCSV == "*" || len(params.ColsCSV) == 0 {
+		wanted[params.TimeColumn] = len(params.TimeColumn) > 0
+		for _, recd := range records {
+			for key := range recd.Record {
+				wanted[keyToStr(key)] = true
+			}
+		}
+	} else {
+		for _, colName := range strings.Split(params.ColsCSV, ",") {
+			wanted[strings.TrimSpace(colName)] = true
+		}
+	}
+
+	var insertCols []clickhouseColumn
+	for _, column := range columns {
+		if wanted[column.name] {
+			insertCols = append(insertCols, column)
+		}
+	}
+	return insertCols
+}
+
+// the record's values for the columns, converted to the types the driver expects for them
+func clickHouseRow(columns []clickhouseColumn, recd FlushRecord) ([]interface{}, error) {
+	row := make([]interface{}, len(columns))
+	for idx, column := range columns {
+		val, _ := lookupMapKey(recd.Record, column.name)
+		converted, err := clickHouseValue(column.colType, val)
+		if err != nil {
+			return nil, fmt.Errorf("column %s - %w", column.name, err)
+		}
+		row[idx] = converted
+	}
+	return row, nil
+}
+
+// convert a value from the record to suit the column type. Nullable and LowCardinality only change how the
+// value is stored, so we convert to the type they wrap
+func clickHouseValue(colType string, val interface{}) (interface{}, error) {
+	for _, wrapper := range []string{"LowCardinality(", "Nullable("} {
+		if strings.HasPrefix(colType, wrapper) {
+			colType = strings.TrimSuffix(strings.TrimPrefix(colType, wrapper), ")")
+		}
+	}
+	if val == nil {
+		return nil, nil
+	}
+
+	baseType := colType
+	if idx := strings.Index(baseType, "("); idx >= 0 {
+		baseType = baseType[:idx]
+	}
+	switch baseType {
+	case "Map":
+		return clickHouseMap(colType, val)
+	case "DateTime64", "DateTime", "Date", "Date32":
+		return clickHouseTime(val)
+	case "Int8", "Int16", "Int32", "Int64":
+		bits, _ := strconv.Atoi(strings.TrimPrefix(baseType, "Int"))
+		return clickHouseInt(val, bits)
+	case "UInt8", "UInt16", "UInt32", "UInt64":
+		bits, _ := strconv.Atoi(strings.TrimPrefix(baseType, "UInt"))
+		return clickHouseUint(val, bits)
+	case "Float32":
+		floatVal, err := strconv.ParseFloat(typeToStr(toDBValue(val), false), 32)
+		return float32(floatVal), err
+	case "Float64":
+		return strconv.ParseFloat(typeToStr(toDBValue(val), false), 64)
+	case "Bool":
+		if boolVal, isBool := val.(bool); isBool {
+			return boolVal, nil
+		}
+		return strconv.ParseBool(typeToStr(toDBValue(val), false))
+	case "String", "FixedString", "UUID", "Enum8", "Enum16":
+		return typeToStr(toDBValue(val), false), nil
+	default:
+		// JSON columns take the nested structures as JSON text, as they do strings holding JSON
+		return toDBValue(val), nil
+	}
+}
+
+// a Map(String, String) column takes the record's nested map, with any structure below it as JSON text
+func clickHouseMap(colType string, val interface{}) (interface{}, error) {
+	if strings.ReplaceAll(colType, " ", "") != "Map(String,String)" {
+		return nil, errors.New("only Map(String, String) columns are supported, not " + colType)
+	}
+	nested, isMap := val.(map[interface{}]interface{})
+	if !isMap {
+		return nil, fmt.Errorf("expected a map for %s, not %T", colType, val)
+	}
+	result := make(map[string]string, len(nested))
+	for key, nestedVal := range nested {
+		if nestedVal == nil {
+			result[keyToStr(key)] = ""
+			continue
+		}
+		result[keyToStr(key)] = typeToStr(toDBValue(nestedVal), false)
+	}
+	return result, nil
+}
+
+// the Fluent Bit timestamp is a time already, otherwise we accept RFC 3339 text or seconds since the epoch
+func clickHouseTime(val interface{}) (interface{}, error) {
+	switch typedVal := toDBValue(val).(type) {
+	case time.Time:
+		return typedVal, nil
+	case string:
+		return time.Parse(time.RFC3339Nano, typedVal)
+	case int64:
+		return time.Unix(typedVal, 0).UTC(), nil
+	case uint64:
+		return time.Unix(int64(typedVal), 0).UTC(), nil
+	case float64:
+		secs := int64(typedVal)
+		return time.Unix(secs, int64((typedVal-float64(secs))*float64(time.Second))).UTC(), nil
+	default:
+		return nil, fmt.Errorf("can't convert %T to a time", val)
+	}
+}
+
+func clickHouseInt(val interface{}, bits int) (interface{}, error) {
+	var intVal int64
+	var err error
+	if floatVal, isFloat := val.(float64); isFloat {
+		intVal = int64(floatVal)
+	} else if intVal, err = strconv.ParseInt(typeToStr(toDBValue(val), false), 10, bits); err != nil {
+		return nil, err
+	}
+	switch bits {
+	case 8:
+		return int8(intVal), nil
+	case 16:
+		return int16(intVal), nil
+	case 32:
+		return int32(intVal), nil
+	}
+	return intVal, nil
+}
+
+func clickHouseUint(val interface{}, bits int) (interface{}, error) {
+	var uintVal uint64
+	var err error
+	if floatVal, isFloat := val.(float64); isFloat {
+		uintVal = uint64(floatVal)
+	} else if uintVal, err = strconv.ParseUint(typeToStr(toDBValue(val), false), 10, bits); err != nil {
+		return nil, err
+	}
+	switch bits {
+	case 8:
+		return uint8(uintVal), nil
+	case 16:
+		return uint16(uintVal), nil
+	case 32:
+		return uint32(uintVal), nil
+	}
+	return uintVal, nil
+}
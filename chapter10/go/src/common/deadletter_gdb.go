@@ -0,0 +1,67 @@
+package main
+
+// the logic for writing records the database has rejected into a dead-letter table, so they aren't lost
+// and can be replayed once the schema or the data has been corrected
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strings"
+)
+
+// the columns the dead-letter table needs to provide - see the sql folder for example table definitions
+const deadLetterCols = "record, tag, event_time, error_text, target_table"
+
+// build the insert statement for the dead-letter table, the record is held as JSON so that it can be replayed
+func buildDeadLetterExpr(params *SqlParams, recd FlushRecord, recordErr error) (string, []interface{}) {
+	recordJSON, err := json.Marshal(normalizeForJSON(recd.Record))
+	if err != nil {
+		log.Printf("[%s]%s unable to convert rejected record to JSON - %v", params.PluginName, params.InstanceName, err)
+		recordJSON = []byte(typeToStr(recd.Record, false))
+	}
+
+	errText := ""
+	if recordErr != nil {
+		errText = recordErr.Error()
+	}
+
+	args := []interface{}{string(recordJSON), recd.Tag, recd.Timestamp, errText, params.TableName}
+	placeholders := make([]string, len(args))
+	for idx := range args {
+		placeholders[idx] = bindVar(params, idx+1)
+	}
+
+	sqlStmt := "INSERT INTO " + params.DeadLetterTable + " (" + deadLetterCols + ") VALUES (" + strings.Join(placeholders, ",") + ")"
+	return sqlStmt, args
+}
+
+// deal with a record that has been rejected. If we have a dead-letter table the record is written there as part of the
+// same transaction, otherwise we just log it. An error is only returned if the chunk as a whole can't continue
+func handleRejectedRecord(ctx context.Context, tx *sql.Tx, params *SqlParams, recd FlushRecord, recordErr error) error {
+	if len(params.DeadLetterTable) == 0 {
+		log.Printf("[%s]%s record tagged %s rejected, skipping - %v", params.PluginName, params.InstanceName, recd.Tag, recordErr)
+		return nil
+	}
+
+	sqlStmt, args := buildDeadLetterExpr(params, recd, recordErr)
+	if err := setSavepoint(ctx, tx, params, deadLetterSavepoint); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, sqlStmt, args...)
+	if err != nil {
+		if classifyDBError(err) != errClassRecord {
+			return err
+		}
+		// the dead-letter table can't take the record either - all we can do is log it
+		log.Printf("[%s]%s record tagged %s rejected with %v and could not be written to %s - %v\n%v",
+			params.PluginName, params.InstanceName, recd.Tag, recordErr, params.DeadLetterTable, err, redactRecord(params, recd.Record))
+		if err = rollbackToSavepoint(ctx, tx, params, deadLetterSavepoint); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("[%s]%s record tagged %s rejected and written to %s - %v", params.PluginName, params.InstanceName, recd.Tag, params.DeadLetterTable, recordErr)
+	}
+	return releaseSavepoint(ctx, tx, params, deadLetterSavepoint)
+}
@@ -0,0 +1,138 @@
+package main
+
+// The SQL the plugins generate differs from one database to the next - the bind variables, how a query is limited,
+// how an upsert is written and so on. Each database we support has a dialect which provides these pieces, so
+// supporting another database means adding a dialect (along with its driver) and registering it below, rather
+// than changing the plugin callbacks. Features built on SQL only some databases offer, such as partition
+// management, check the db_type themselves.
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"regexp"
+)
+
+type sqlDialect interface {
+	// whether we connect to a server, needing the host, port and user, rather than opening a local file
+	usesServer() bool
+	// the connection string the driver expects
+	connectionStr(params *SqlParams) string
+	// quote an identifier, such as a column name, so it can hold characters that would otherwise break the statement
+	quoteIdent(name string) string
+	// the bind variable for the value at idx, starting at 1
+	bindVar(idx int) string
+	// restrict a query to limit rows, skipping the first offset rows
+	limitQuery(sqlStmt string, limit int, offset int) string
+	// an insert of rowCount rows of values for the columns
+	insertExpr(table string, cols []string, rowCount int) string
+	// an insert of a row that, when it clashes with an existing row on the conflict columns, makes the updates to the
+	// existing row instead. The updates are built using the expressions for a column's existing and incoming values,
+	// if there aren't any updates the existing row is left as it is
+	upsertExpr(table string, cols []string, conflictCols []string, updates func(existing, incoming func(string) string) []string) string
+	// execute the insert, returning the value the database generated for the key column - or nil if the insert
+	// didn't add a row, as happens when an upsert leaves the existing row alone
+	insertReturningId(ctx context.Context, conn dbConn, sqlStmt string, args []interface{}, keyCol string) (interface{}, error)
+	// the statements to set a savepoint, roll back to it, and release it. The release is empty for databases where
+	// savepoints aren't released
+	savepoint(name string) string
+	rollbackToSavepoint(name string) string
+	releaseSavepoint(name string) string
+	// load the rows into the table using the fastest route the database offers
+	bulkLoad(ctx context.Context, tx *sql.Tx, table string, cols []string, rows [][]interface{}) error
+	// recognise the driver's errors, returning false for an error that didn't come from the driver
+	classifyError(err error) (dbErrorClass, bool)
+	// whether the driver's error is the database rejecting the user or password
+	authFailed(err error) bool
+}
+
+// implemented by the dialects whose driver returns column values that don't suit a record as they are. The
+// value is mapped into the type the record should hold, returning false when the value is left to the input's
+// usual conversion to text
+type recordValueMapper interface {
+	recordValue(colType *sql.ColumnType, val interface{}) (interface{}, bool)
+}
+
+// implemented by the dialects whose driver is given a TLS configuration rather than the certificate file names. The
+// configuration is registered with the driver when the pool is opened, under the name the connection string uses
+type tlsRegistrar interface {
+	registerTLS(name string, config *tls.Config) error
+}
+
+// the calls a statement can be executed with, so the same code can be used inside or outside of a transaction
+type dbConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// the dialects for each db_type
+var dialects = map[string]sqlDialect{
+	PostgresDBType:   postgresDialect{},
+	mysqlDBType:      mysqlDialect{},
+	sqliteDBType:     sqliteDialect{},
+	sqlserverDBType:  sqlserverDialect{},
+	oracleDBType:     oracleDialect{},
+	clickhouseDBType: clickhouseDialect{},
+}
+
+// the dialect for the configured db_type. The db_type is checked when the configuration is validated, so we
+// can rely on there being one
+func getDialect(params *SqlParams) sqlDialect {
+	return dialects[params.DBType]
+}
+
+var plainIdentRegex = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// column names are only quoted when they need to be, as quoting also makes the name case sensitive in some databases
+func columnIdent(params *SqlParams, name string) string {
+	if plainIdentRegex.MatchString(name) {
+		return name
+	}
+	return getDialect(params).quoteIdent(name)
+}
+
+// the placeholders for a row of count values, numbered on from those before it
+func rowPlaceholders(dialect sqlDialect, first int, count int) []string {
+	placeholders := make([]string, count)
+	for idx := range placeholders {
+		placeholders[idx] = dialect.bindVar(first + idx)
+	}
+	return placeholders
+}
+
+// the savepoint statements from the SQL standard, for the dialects that follow it
+type standardSavepoints struct{}
+
+func (standardSavepoints) savepoint(name string) string {
+	return "SAVEPOINT " + name
+}
+
+func (standardSavepoints) rollbackToSavepoint(name string) string {
+	return "ROLLBACK TO SAVEPOINT " + name
+}
+
+func (standardSavepoints) releaseSavepoint(name string) string {
+	return "RELEASE SAVEPOINT " + name
+}
+
+// set a savepoint within the transaction
+func setSavepoint(ctx context.Context, tx *sql.Tx, params *SqlParams, name string) error {
+	_, err := tx.ExecContext(ctx, getDialect(params).savepoint(name))
+	return err
+}
+
+// undo everything since the savepoint was set
+func rollbackToSavepoint(ctx context.Context, tx *sql.Tx, params *SqlParams, name string) error {
+	_, err := tx.ExecContext(ctx, getDialect(params).rollbackToSavepoint(name))
+	return err
+}
+
+// release the savepoint, for the databases that need it
+func releaseSavepoint(ctx context.Context, tx *sql.Tx, params *SqlParams, name string) error {
+	sqlStmt := getDialect(params).releaseSavepoint(name)
+	if len(sqlStmt) == 0 {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, sqlStmt)
+	return err
+}
@@ -0,0 +1,175 @@
+package main
+
+// Log records repeat the same host, service, pod and image names over and over. The dimensions option moves these
+// values into dimension tables, so the row written holds an integer id rather than the string. It is configured as a
+// comma separated list of $attribute=table pairs, optionally with the column to hold the id, e.g.
+//   $host=dim_host, $kubernetes['pod_name']=dim_pod:pod_id
+// If no column is given the id replaces the attribute's value, otherwise it is written to the named column.
+// Each dimension table needs an id column generated by the database and a unique value column.
+// The ids we know about are held in an LRU cache so we only go to the database for values we haven't seen recently.
+// The dimension rows are written outside of the transaction for the records, so a value is only ever added once and
+// stays valid even if the records end up being retried.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const defaultDimensionCacheSize = 10000
+
+// an attribute to be replaced by the id from a dimension table
+type dimensionMapping struct {
+	path   recordPath
+	table  string
+	column string
+}
+
+// parse the dimensions setting
+func parseDimensions(params *SqlParams) ([]dimensionMapping, error) {
+	var mappings []dimensionMapping
+	nameRegex := regexp.MustCompile(defaultTableRegex)
+	for _, mappingStr := range strings.Split(params.Dimensions, ",") {
+		mappingStr = strings.TrimSpace(mappingStr)
+		if len(mappingStr) == 0 {
+			continue
+		}
+		sepIdx := strings.LastIndex(mappingStr, "=")
+		if sepIdx < 0 {
+			return nil, errors.New(Plugin_Dimensions + " entry " + mappingStr + " needs to be in the form $attribute=table")
+		}
+		path, err := parseRecordPath(mappingStr[:sepIdx])
+		if err != nil {
+			return nil, errors.New(Plugin_Dimensions + " entry " + mappingStr + " - " + err.Error())
+		}
+
+		mapping := dimensionMapping{path: path, table: strings.TrimSpace(mappingStr[sepIdx+1:]), column: path.leafName()}
+		if colIdx := strings.Index(mapping.table, ":"); colIdx >= 0 {
+			mapping.column = strings.TrimSpace(mapping.table[colIdx+1:])
+			mapping.table = strings.TrimSpace(mapping.table[:colIdx])
+		}
+		if !nameRegex.MatchString(mapping.table) || !nameRegex.MatchString(mapping.column) {
+			return nil, errors.New(Plugin_Dimensions + " entry " + mappingStr + " has an invalid table or column name")
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+// check the dimension settings, applying the defaults
+func validateDimensions(params *SqlParams) error {
+	params.Dimensions = strings.TrimSpace(params.Dimensions)
+	if len(params.Dimensions) == 0 {
+		return nil
+	}
+	if _, err := parseDimensions(params); err != nil {
+		return err
+	}
+	if params.DimensionCache <= 0 {
+		params.DimensionCache = defaultDimensionCacheSize
+	}
+	return nil
+}
+
+// the ids are only valid for the database they came from, so the caches are shared by any instances
+// writing to the same database
+var dimensionMutex sync.Mutex
+var dimensionCaches = make(map[string]*lruCache)
+
+// the cache of the ids for a dimension table
+func getDimensionCache(params *SqlParams, table string) *lruCache {
+	key := databaseKey(params) + "/" + table
+	cache, found := dimensionCaches[key]
+	if !found {
+		cache = newLRUCache(params.DimensionCache)
+		dimensionCaches[key] = cache
+	}
+	return cache
+}
+
+// find the id for the value, adding the value to the dimension table if it isn't already there.
+// We look before inserting so we aren't writing to the table for values that already exist
+func lookupDimensionId(ctx context.Context, db *sql.DB, params *SqlParams, table string, value string) (interface{}, error) {
+	var id interface{}
+	err := db.QueryRowContext(ctx, "SELECT id FROM "+table+" WHERE value = "+bindVar(params, 1), value).Scan(&id)
+	if err == nil {
+		return toDBValue(id), nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// if another instance adds the same value in the meantime, the upsert leaves its row alone and we look again
+	dialect := getDialect(params)
+	id, err = dialect.insertReturningId(ctx, db, dialect.upsertExpr(table, []string{"value"}, []string{"value"}, nil), []interface{}{value}, "id")
+	if err != nil || id != nil {
+		return id, err
+	}
+	err = db.QueryRowContext(ctx, "SELECT id FROM "+table+" WHERE value = "+bindVar(params, 1), value).Scan(&id)
+	return toDBValue(id), err
+}
+
+// replace the dimension attributes of each record with their ids. The records are copied so the originals are
+// untouched. Records with a value the database won't take for a dimension are returned separately with the error
+func resolveDimensions(ctx context.Context, db *sql.DB, params *SqlParams, records []FlushRecord) ([]FlushRecord, []FlushRecord, []error, error) {
+	mappings, err := parseDimensions(params)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var resolved []FlushRecord
+	var rejected []FlushRecord
+	var rejectedErrs []error
+
+	for _, recd := range records {
+		values := make(RowDefinition, len(recd.Record))
+		for key, val := range recd.Record {
+			values[key] = val
+		}
+
+		var recordErr error = nil
+		for _, mapping := range mappings {
+			val, found := lookupRecordPath(recd.Record, mapping.path)
+			if !found || val == nil {
+				continue
+			}
+			valueStr := typeToStr(toDBValue(val), false)
+			dimensionMutex.Lock()
+			cache := getDimensionCache(params, mapping.table)
+			id, known := cache.get(valueStr)
+			dimensionMutex.Unlock()
+			if !known {
+				id, err = lookupDimensionId(ctx, db, params, mapping.table, valueStr)
+				if err != nil {
+					if classifyDBError(err) != errClassRecord {
+						return nil, nil, nil, err
+					}
+					recordErr = err
+					break
+				}
+				dimensionMutex.Lock()
+				cache.put(valueStr, id)
+				dimensionMutex.Unlock()
+			}
+
+			// replace the attribute itself, whatever form its key takes
+			for key := range values {
+				if keyToStr(key) == mapping.column {
+					delete(values, key)
+				}
+			}
+			values[mapping.column] = id
+		}
+
+		if recordErr != nil {
+			rejected = append(rejected, recd)
+			rejectedErrs = append(rejectedErrs, recordErr)
+			continue
+		}
+		resolved = append(resolved, FlushRecord{Tag: recd.Tag, Timestamp: recd.Timestamp, Record: values})
+	}
+	return resolved, rejected, rejectedErrs, nil
+}
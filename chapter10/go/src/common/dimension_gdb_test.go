@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// a database holding the dimension tables, answering the lookups and inserts resolveDimensions makes as
+// Postgres would
+type testDimensionStore struct {
+	mutex   sync.Mutex
+	ids     map[string]map[string]int64 // the id of each value, by table
+	nextId  int64
+	added   map[string]int64 // values another instance adds just before our insert
+	selects int
+	inserts int
+	down    error
+}
+
+type testDimensionConn struct {
+	store *testDimensionStore
+}
+
+type testIdRows struct {
+	ids []int64
+}
+
+var dimensionTableRegex = regexp.MustCompile(`(?:FROM|INTO) (\w+)`)
+
+func newTestDimensionStore() *testDimensionStore {
+	return &testDimensionStore{ids: map[string]map[string]int64{"dim_host": {}, "dim_pod": {}}, added: make(map[string]int64)}
+}
+
+func (store *testDimensionStore) Connect(ctx context.Context) (driver.Conn, error) {
+	return &testDimensionConn{store: store}, nil
+}
+
+func (store *testDimensionStore) Driver() driver.Driver {
+	return nil
+}
+
+func (conn *testDimensionConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	store := conn.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.down != nil {
+		return nil, store.down
+	}
+	table := dimensionTableRegex.FindStringSubmatch(query)[1]
+	value := args[0].Value.(string)
+
+	if strings.HasPrefix(query, "SELECT id FROM "+table+" WHERE value = $1") {
+		store.selects++
+		if id, found := store.ids[table][value]; found {
+			return &testIdRows{ids: []int64{id}}, nil
+		}
+		return &testIdRows{}, nil
+	}
+	if query != "INSERT INTO "+table+" AS existing (value) VALUES ($1) ON CONFLICT (value) DO NOTHING RETURNING id" {
+		return nil, errors.New("unexpected query " + query)
+	}
+	store.inserts++
+	if !utf8.ValidString(value) {
+		return nil, &pq.Error{Code: "22021", Message: "invalid byte sequence for encoding UTF8"}
+	}
+	if id, found := store.added[value]; found {
+		store.ids[table][value] = id
+	}
+	if _, found := store.ids[table][value]; found {
+		return &testIdRows{}, nil
+	}
+	store.nextId++
+	store.ids[table][value] = store.nextId
+	return &testIdRows{ids: []int64{store.nextId}}, nil
+}
+
+func (conn *testDimensionConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (conn *testDimensionConn) Close() error {
+	return nil
+}
+
+func (conn *testDimensionConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (rows *testIdRows) Columns() []string {
+	return []string{"id"}
+}
+
+func (rows *testIdRows) Close() error {
+	return nil
+}
+
+func (rows *testIdRows) Next(dest []driver.Value) error {
+	if len(rows.ids) == 0 {
+		return io.EOF
+	}
+	dest[0] = rows.ids[0]
+	rows.ids = rows.ids[1:]
+	return nil
+}
+
+// the params for a database of its own, so the test starts with empty caches
+func newTestDimensionParams(t *testing.T, dimensions string, cacheSize int) (*SqlParams, *sql.DB, *testDimensionStore) {
+	params := &SqlParams{PluginName: "gdb-test", DBType: PostgresDBType, Host: "db", Port: "5432", DBName: t.Name(),
+		Dimensions: dimensions, DimensionCache: cacheSize}
+	store := newTestDimensionStore()
+	db := sql.OpenDB(store)
+	t.Cleanup(func() {
+		db.Close()
+		dimensionMutex.Lock()
+		defer dimensionMutex.Unlock()
+		for key := range dimensionCaches {
+			if strings.HasPrefix(key, databaseKey(params)+"/") {
+				delete(dimensionCaches, key)
+			}
+		}
+	})
+	return params, db, store
+}
+
+func TestResolveDimensions(t *testing.T) {
+	params, db, store := newTestDimensionParams(t, "$host=dim_host, $kubernetes['pod_name']=dim_pod:pod_id", 10)
+	store.ids["dim_host"]["web-2"] = 7
+	pod := map[interface{}]interface{}{"pod_name": "web-1-abc", "namespace": "shop"}
+	records := []FlushRecord{
+		{Tag: "app", Record: RowDefinition{"host": "web-1", "kubernetes": pod, "log": "GET /"}},
+		{Tag: "app", Record: RowDefinition{"host": []byte("web-1"), "kubernetes": pod}},
+		{Tag: "app", Record: RowDefinition{"host": "web-2", "pod_id": "replaced"}},
+		{Tag: "app", Record: RowDefinition{"host": nil, "log": "no host"}},
+	}
+
+	resolved, rejected, _, err := resolveDimensions(context.Background(), db, params, records)
+	if err != nil || len(rejected) > 0 {
+		t.Fatalf("got %v and %d rejected, expected the records resolved", err, len(rejected))
+	}
+	// the attribute is replaced by the id unless a column is given for it, and the id of a value already in the
+	// table is used as it is
+	expected := []RowDefinition{
+		{"host": int64(1), "kubernetes": pod, "pod_id": int64(2), "log": "GET /"},
+		{"host": int64(1), "kubernetes": pod, "pod_id": int64(2)},
+		{"host": int64(7), "pod_id": "replaced"},
+		{"host": nil, "log": "no host"},
+	}
+	for idx := range expected {
+		if !reflect.DeepEqual(resolved[idx].Record, expected[idx]) || resolved[idx].Tag != "app" {
+			t.Errorf("record %d: got %v, expected %v", idx, resolved[idx].Record, expected[idx])
+		}
+	}
+	if records[0].Record["host"] != "web-1" || len(records[0].Record) != 3 {
+		t.Errorf("got %v, expected the original record untouched", records[0].Record)
+	}
+	// the second record's values come from the cache
+	if store.selects != 3 || store.inserts != 2 {
+		t.Errorf("got %d lookups and %d inserts, expected 3 and 2", store.selects, store.inserts)
+	}
+}
+
+func TestDimensionCacheEviction(t *testing.T) {
+	params, db, store := newTestDimensionParams(t, "$host=dim_host", 2)
+	var records []FlushRecord
+	for _, host := range []string{"a", "b", "a", "c", "a", "b"} {
+		records = append(records, FlushRecord{Record: RowDefinition{"host": host}})
+	}
+
+	resolved, _, _, err := resolveDimensions(context.Background(), db, params, records)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// a stays in the cache as it is used, so c evicts b, which is looked up again and keeps its id
+	var ids []interface{}
+	for _, recd := range resolved {
+		ids = append(ids, recd.Record["host"])
+	}
+	if expected := []interface{}{int64(1), int64(2), int64(1), int64(3), int64(1), int64(2)}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("got %v, expected %v", ids, expected)
+	}
+	if store.selects != 4 || store.inserts != 3 {
+		t.Errorf("got %d lookups and %d inserts, expected 4 and 3", store.selects, store.inserts)
+	}
+}
+
+func TestResolveDimensionsConcurrentInsert(t *testing.T) {
+	params, db, store := newTestDimensionParams(t, "$host=dim_host", 10)
+	store.added["web-1"] = 42
+
+	resolved, _, _, err := resolveDimensions(context.Background(), db, params, []FlushRecord{{Record: RowDefinition{"host": "web-1"}}})
+	if err != nil || resolved[0].Record["host"] != int64(42) || store.selects != 2 {
+		t.Errorf("got %v with %v after %d lookups, expected the other instance's id after looking again", err, resolved, store.selects)
+	}
+}
+
+func TestResolveDimensionsErrors(t *testing.T) {
+	params, db, store := newTestDimensionParams(t, "$host=dim_host", 10)
+	records := []FlushRecord{
+		{Record: RowDefinition{"host": "web-1"}},
+		{Record: RowDefinition{"host": "web-\xff"}},
+		{Record: RowDefinition{"host": "web-2"}},
+	}
+
+	// a value the database won't take only rejects its own record
+	resolved, rejected, rejectedErrs, err := resolveDimensions(context.Background(), db, params, records)
+	if err != nil || len(resolved) != 2 || len(rejected) != 1 || rejected[0].Record["host"] != "web-\xff" ||
+		classifyDBError(rejectedErrs[0]) != errClassRecord {
+		t.Errorf("got %v with %d resolved and %d rejected, expected the invalid value rejected", err, len(resolved), len(rejected))
+	}
+
+	// while the database is unavailable the whole chunk fails
+	store.down = &pq.Error{Code: "08006", Message: "connection failure"}
+	if _, _, _, err := resolveDimensions(context.Background(), db, params, []FlushRecord{{Record: RowDefinition{"host": "web-3"}}}); classifyDBError(err) != errClassRetry {
+		t.Errorf("got %v, expected an error to retry", err)
+	}
+}
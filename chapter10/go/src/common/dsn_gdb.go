@@ -0,0 +1,122 @@
+package main
+
+// Some connection settings can't be expressed with the db_host, db_port, db_user and db_name - e.g. a MySQL unix
+// socket, the driver's time handling or the application name the database reports. So a complete db_dsn can be
+// given instead, in the form the driver expects, or driver options can be set with db_option.<name> keys (and
+// db_options for any we don't know of) which the dialects merge into the connection string they build, escaping
+// the names and values as their connection strings need.
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Fluent Bit doesn't let a plugin list the keys it has been given, so we look for db_option.<name> with the names
+// of the options each driver offers that can't be set otherwise. Fluent Bit keys can't hold spaces, so an option
+// such as SQL Server's "app name" is given as db_option.app_name. As we can't see any other db_option.<name> keys,
+// db_options takes the options we don't know of, or whose names Fluent Bit can't take as a key
+var driverOptionNames = map[string][]string{
+	PostgresDBType: {"application_name", "connect_timeout", "statement_timeout", "search_path", "target_session_attrs",
+		"load_balance_hosts"},
+	mysqlDBType: {"parseTime", "loc", "charset", "collation", "timeout", "readTimeout", "writeTimeout", "time_zone",
+		"allowNativePasswords", "interpolateParams", "max_execution_time"},
+	sqlserverDBType: {"app name", "connection timeout", "dial timeout", "keepAlive", "packet size", "ApplicationIntent",
+		"MultiSubnetFailover", "failoverpartner", "failoverport", "log"},
+	oracleDBType:     {"TIMEOUT", "CONNECTION TIMEOUT", "PREFETCH_ROWS", "LOB FETCH", "LANGUAGE", "TERRITORY", "PROGRAM", "FAILOVER"},
+	clickhouseDBType: {"dial_timeout", "compress"},
+}
+
+// the option names Postgres accepts in a connection string, which can't be quoted
+var pgOptionNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// the key in the Fluent Bit configuration for a driver option
+func driverOptionKey(name string) string {
+	return Plugin_DBOptionPrefix + strings.ReplaceAll(name, " ", "_")
+}
+
+// gather the driver options for the db_type from the plugin's configuration, using the function the plugin
+// retrieves its keys with. db_options is in the form of a URL query (e.g. charset=utf8mb4&parseTime=true), and the
+// db_option.<name> keys take priority over it. A db_option.<name> that belongs to another database's driver is
+// rejected rather than quietly ignored. The options are returned in the same form for holding in the SqlParams
+func getDriverOptions(dbType string, configKey func(string) string) (string, error) {
+	options, err := url.ParseQuery(strings.TrimSpace(configKey(Plugin_DBOptions)))
+	if err != nil {
+		return "", errors.New(Plugin_DBOptions + " is invalid - " + err.Error())
+	}
+	dbType = strings.TrimSpace(dbType)
+	known := make(map[string]bool)
+	for _, name := range driverOptionNames[dbType] {
+		known[strings.ToLower(driverOptionKey(name))] = true
+		if value := strings.TrimSpace(configKey(driverOptionKey(name))); len(value) > 0 {
+			options.Set(name, value)
+		}
+	}
+	for otherType, names := range driverOptionNames {
+		for _, name := range names {
+			key := driverOptionKey(name)
+			if otherType != dbType && !known[strings.ToLower(key)] && len(strings.TrimSpace(configKey(key))) > 0 {
+				return "", errors.New(key + " is an option for " + otherType + " and can't be used with " + Plugin_Type + " " + dbType)
+			}
+		}
+	}
+	return options.Encode(), nil
+}
+
+// the driver options as name and value pairs, sorted by name so the connection string is always the same
+func driverOptions(params *SqlParams) [][2]string {
+	options, _ := url.ParseQuery(params.DBOptions)
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([][2]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, [2]string{name, options.Get(name)})
+	}
+	return pairs
+}
+
+// add the driver options to a connection string's URL query
+func addDriverOptions(query url.Values, params *SqlParams) url.Values {
+	for _, option := range driverOptions(params) {
+		query.Set(option[0], option[1])
+	}
+	return query
+}
+
+// check the DSN and options. With a complete DSN the connection settings, TLS and driver options all come from
+// it, so setting them as well is a mistake
+func validateDSNParams(params *SqlParams) error {
+	params.DSN = strings.TrimSpace(params.DSN)
+	if _, err := url.ParseQuery(params.DBOptions); err != nil {
+		return errors.New(Plugin_DBOptions + " is invalid - " + err.Error())
+	}
+	if params.DBType == PostgresDBType {
+		for _, option := range driverOptions(params) {
+			if !pgOptionNameRegex.MatchString(option[0]) {
+				return errors.New(Plugin_DBOptions + " has an invalid option name '" + option[0] + "' for " + params.PluginName)
+			}
+		}
+	}
+	if len(params.DSN) == 0 {
+		return nil
+	}
+	if len(params.DBOptions) > 0 {
+		return errors.New("driver options can't be combined with a " + Plugin_DSN + " for " + params.PluginName + " - add them to the " + Plugin_DSN)
+	}
+	if tls, _ := parseTLSFlag(Plugin_TLS, params.TLS, tlsOff); tls == tlsOn {
+		return errors.New(Plugin_TLS + " settings can't be combined with a " + Plugin_DSN + " for " + params.PluginName + " - add them to the " + Plugin_DSN)
+	}
+	for key, value := range map[string]string{Plugin_Host: params.Host, Plugin_Port: params.Port, Plugin_User: params.User, Plugin_Password: params.Password} {
+		if len(strings.TrimSpace(value)) > 0 {
+			log.Printf("[%s]%s %s is ignored as a %s is given", params.PluginName, params.InstanceName, key, Plugin_DSN)
+		}
+	}
+	return nil
+}
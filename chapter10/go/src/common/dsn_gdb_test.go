@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestConnectionStr(t *testing.T) {
+	tests := []struct {
+		params   SqlParams
+		expected string
+	}{
+		{SqlParams{DBType: PostgresDBType, Host: "db", Port: "5432", User: "fluent", Password: "p'w\\d", DBName: "logs"},
+			`host='db' port=5432 user='fluent' password='p\'w\\d' dbname='logs' sslmode=disable`},
+		{SqlParams{DBType: PostgresDBType, Host: "db", Port: "5432", User: "fluent", Password: "pw", DBName: "logs",
+			DBOptions: "connect_timeout=5&application_name=fluent bit"},
+			`host='db' port=5432 user='fluent' password='pw' dbname='logs' sslmode=disable application_name='fluent bit' connect_timeout='5'`},
+		{SqlParams{DBType: PostgresDBType, Host: "db", Port: "5432", User: "fluent", Password: "pw", DBName: "logs",
+			TLS: tlsOn, TLSCAFile: "/certs/ca.pem"},
+			`host='db' port=5432 user='fluent' password='pw' dbname='logs' sslmode=verify-full sslrootcert='/certs/ca.pem'`},
+		{SqlParams{DBType: PostgresDBType, Host: "db", Port: "5432", User: "fluent", Password: "pw", DBName: "logs",
+			TLS: tlsOn, TLSVerify: tlsOff, TLSCAFile: "/certs/ca.pem"},
+			`host='db' port=5432 user='fluent' password='pw' dbname='logs' sslmode=require`},
+		{SqlParams{DBType: mysqlDBType, Host: "db", Port: "3306", User: "fluent", Password: "pw", DBName: "logs"},
+			"fluent:pw@tcp(db:3306)/logs"},
+		{SqlParams{DBType: mysqlDBType, Host: "::1", Port: "3306", User: "fluent", Password: "pw", DBName: "logs",
+			DBOptions: "parseTime=true&loc=Europe/London"},
+			"fluent:pw@tcp([::1]:3306)/logs?loc=Europe%2FLondon&parseTime=true"},
+		{SqlParams{DBType: sqlserverDBType, Host: "db", Port: "1433", User: "fluent", Password: "p@ss", DBName: "logs",
+			DBOptions: "app name=fluent"},
+			"sqlserver://fluent:p%40ss@db:1433?app+name=fluent&database=logs"},
+		{SqlParams{DBType: sqlserverDBType, Host: "db", Port: "1433", User: "fluent", Password: "pw", DBName: "logs",
+			TLS: tlsOn, TLSVerify: tlsOff},
+			"sqlserver://fluent:pw@db:1433?TrustServerCertificate=true&database=logs&encrypt=true"},
+		{SqlParams{DBType: clickhouseDBType, Host: "db", Port: "9000", User: "fluent", Password: "pw", DBName: "logs",
+			DBOptions: "compress=lz4"},
+			"clickhouse://fluent:pw@db:9000/logs?compress=lz4"},
+		{SqlParams{DBType: clickhouseDBType, Host: "db", Port: "9440", User: "fluent", Password: "pw", DBName: "logs", TLS: tlsOn},
+			"clickhouse://fluent:pw@db:9440/logs?secure=true&skip_verify=false"},
+		{SqlParams{DBType: sqliteDBType, DBName: "/var/lib/logs.db", DBOptions: "_time_format=sqlite"},
+			"file:/var/lib/logs.db?_pragma=busy_timeout(5000)&_txlock=immediate&_time_format=sqlite"},
+		{SqlParams{DBType: PostgresDBType, Host: "db", DSN: "postgres://fluent:pw@db/logs?sslmode=verify-full"},
+			"postgres://fluent:pw@db/logs?sslmode=verify-full"},
+	}
+	for _, test := range tests {
+		if connStr := buildConnectionStr(&test.params); connStr != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.params.DBType, connStr, test.expected)
+		}
+	}
+}
+
+func TestOracleConnectionStr(t *testing.T) {
+	params := &SqlParams{DBType: oracleDBType, Host: "db", Port: "1521", User: "fluent", Password: "p@ss", DBName: "XEPDB1",
+		DBOptions: "PREFETCH_ROWS=500", TLS: tlsOn}
+	connURL, err := url.Parse(buildConnectionStr(params))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	password, _ := connURL.User.Password()
+	if connURL.Scheme != "oracle" || connURL.Host != "db:1521" || connURL.Path != "/XEPDB1" || connURL.User.Username() != "fluent" || password != "p@ss" {
+		t.Errorf("got %s, expected fluent and p@ss at db:1521/XEPDB1", connURL)
+	}
+	query := connURL.Query()
+	if query.Get("PREFETCH_ROWS") != "500" || query.Get("SSL") != "true" || query.Get("SSL VERIFY") != "true" {
+		t.Errorf("got options %v, expected PREFETCH_ROWS, SSL and SSL VERIFY", query)
+	}
+}
+
+// the plugin's keys, which Fluent Bit matches whatever their case
+func testConfigKey(config map[string]string) func(string) string {
+	return func(key string) string {
+		for name, value := range config {
+			if strings.EqualFold(name, key) {
+				return value
+			}
+		}
+		return ""
+	}
+}
+
+func TestGetDriverOptions(t *testing.T) {
+	tests := []struct {
+		dbType   string
+		config   map[string]string
+		expected string
+	}{
+		{PostgresDBType, map[string]string{}, ""},
+		{mysqlDBType, map[string]string{Plugin_DBOptions: "charset=latin1&x=1", "db_option.charset": "utf8mb4"}, "charset=utf8mb4&x=1"},
+		{sqlserverDBType, map[string]string{"db_option.app_name": "fluent", "db_option.ApplicationIntent": "ReadOnly"},
+			"ApplicationIntent=ReadOnly&app+name=fluent"},
+		{PostgresDBType, map[string]string{"db_option.application_name": " fluent "}, "application_name=fluent"},
+		// Oracle has a TIMEOUT option too, but as the keys aren't case sensitive this is MySQL's timeout
+		{mysqlDBType, map[string]string{"db_option.timeout": "5s"}, "timeout=5s"},
+	}
+	for _, test := range tests {
+		options, err := getDriverOptions(test.dbType, testConfigKey(test.config))
+		if err != nil {
+			t.Errorf("%s %v: unexpected error %v", test.dbType, test.config, err)
+		} else if options != test.expected {
+			t.Errorf("%s %v: got %s, expected %s", test.dbType, test.config, options, test.expected)
+		}
+	}
+}
+
+func TestGetDriverOptionsErrors(t *testing.T) {
+	tests := []struct {
+		dbType string
+		config map[string]string
+	}{
+		{PostgresDBType, map[string]string{"db_option.parseTime": "true"}},
+		{mysqlDBType, map[string]string{"db_option.app_name": "fluent"}},
+		{mysqlDBType, map[string]string{Plugin_DBOptions: "charset=%zz"}},
+	}
+	for _, test := range tests {
+		if options, err := getDriverOptions(test.dbType, testConfigKey(test.config)); err == nil {
+			t.Errorf("%s %v: got %s, expected an error", test.dbType, test.config, options)
+		}
+	}
+}
+
+func TestValidateDSNParams(t *testing.T) {
+	tests := []struct {
+		params SqlParams
+		valid  bool
+	}{
+		{SqlParams{DBType: PostgresDBType, DBOptions: "application_name=fluent"}, true},
+		{SqlParams{DBType: PostgresDBType, DBOptions: "application+name=fluent"}, false},
+		{SqlParams{DBType: sqlserverDBType, DBOptions: "app+name=fluent"}, true},
+		{SqlParams{DBType: mysqlDBType, DBOptions: "charset=%zz"}, false},
+		{SqlParams{DBType: PostgresDBType, DSN: " postgres://db/logs ", Host: "ignored"}, true},
+		{SqlParams{DBType: PostgresDBType, DSN: "postgres://db/logs", DBOptions: "application_name=fluent"}, false},
+		{SqlParams{DBType: PostgresDBType, DSN: "postgres://db/logs", TLS: "yes"}, false},
+	}
+	for _, test := range tests {
+		if err := validateDSNParams(&test.params); (err == nil) != test.valid {
+			t.Errorf("%s %s %s: got %v, expected valid %t", test.params.DBType, test.params.DSN, test.params.DBOptions, err, test.valid)
+		}
+	}
+	params := &SqlParams{DBType: PostgresDBType, DSN: " postgres://db/logs "}
+	if validateDSNParams(params); params.DSN != "postgres://db/logs" {
+		t.Errorf("got %q, expected the DSN to be trimmed", params.DSN)
+	}
+}
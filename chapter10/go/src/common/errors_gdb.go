@@ -0,0 +1,101 @@
+package main
+
+// this file holds the logic for working out what sort of failure the database drivers have given us
+// so the output plugin can decide between asking Fluent Bit to retry the chunk, dropping a single
+// bad record, or failing the chunk as we did originally
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"syscall"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+type dbErrorClass int
+
+const (
+	errClassNone   dbErrorClass = iota // no error at all
+	errClassRetry                      // transient - the DB is restarting, we hit a deadlock, or we timed out
+	errClassRecord                     // permanent but only for the record being written - e.g. a constraint violation
+	errClassFatal                      // anything we don't recognise - such as bad SQL or a missing table
+)
+
+// the outcome of writing a chunk of records. The output plugin maps these onto the Fluent Bit return codes
+// which keeps the common code free of any dependency on the output API. They are in order of severity
+// so when combining outcomes the highest value wins
+type writeOutcome int
+
+const (
+	writeOk writeOutcome = iota
+	writeRetry
+	writeFailed
+)
+
+// a problem with the content of a record that we find ourselves before the database sees it, such as a missing
+// key value, so it is handled in the same way as a record the database rejects
+type recordContentError struct {
+	err error
+}
+
+func (contentErr recordContentError) Error() string {
+	return contentErr.err.Error()
+}
+
+func (contentErr recordContentError) Unwrap() error {
+	return contentErr.err
+}
+
+// work out which class an error from the database belongs to. We let the dialects look at their driver's error
+// types first as they're the most precise, and then fall back to recognising network and timeout failures
+func classifyDBError(err error) dbErrorClass {
+	if err == nil {
+		return errClassNone
+	}
+
+	var contentErr recordContentError
+	if errors.As(err, &contentErr) {
+		return errClassRecord
+	}
+
+	for _, dialect := range dialects {
+		if class, known := dialect.classifyError(err); known {
+			return class
+		}
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, sql.ErrTxDone) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return errClassRetry
+	}
+
+	// covers connection refused, DNS failures and timeouts that haven't been wrapped as a syscall error
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return errClassRetry
+	}
+
+	return errClassFatal
+}
+
+// translate an error that has affected the whole chunk (e.g. we couldn't start or commit the transaction)
+// into the outcome to report back. Errors that would normally only affect a record fail the chunk here
+// as we can't tell which record caused the problem
+func chunkOutcome(params *SqlParams, err error) writeOutcome {
+	if err == nil {
+		return writeOk
+	}
+	if classifyDBError(err) == errClassRetry {
+		log.Printf("[%s]%s retryable database error - %v", params.PluginName, params.InstanceName, err)
+		return writeRetry
+	}
+	log.Printf("[%s]%s database error - %v", params.PluginName, params.InstanceName, err)
+	return writeFailed
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/sijms/go-ora/v2/network"
+)
+
+func TestClassifyDBError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected dbErrorClass
+	}{
+		{"nil", nil, errClassNone},
+		{"record content", recordContentError{errors.New("missing key")}, errClassRecord},
+		{"wrapped record content", fmt.Errorf("row 3: %w", recordContentError{errors.New("missing key")}), errClassRecord},
+
+		{"postgres connection", &pq.Error{Code: "08006"}, errClassRetry},
+		{"postgres deadlock", &pq.Error{Code: "40P01"}, errClassRetry},
+		{"postgres shutdown", &pq.Error{Code: "57P01"}, errClassRetry},
+		{"postgres value too long", &pq.Error{Code: "22001"}, errClassRecord},
+		{"postgres unique", &pq.Error{Code: "23505"}, errClassRecord},
+		{"postgres missing table", &pq.Error{Code: "42P01"}, errClassFatal},
+
+		{"mysql deadlock", &mysql.MySQLError{Number: 1213}, errClassRetry},
+		{"mysql too many connections", &mysql.MySQLError{Number: 1040}, errClassRetry},
+		{"mysql duplicate", &mysql.MySQLError{Number: 1062}, errClassRecord},
+		{"mysql null", &mysql.MySQLError{Number: 1048}, errClassRecord},
+		{"mysql syntax", &mysql.MySQLError{Number: 1064}, errClassFatal},
+
+		{"sqlserver deadlock", mssql.Error{Number: 1205}, errClassRetry},
+		{"sqlserver failover", mssql.Error{Number: 4060}, errClassRetry},
+		{"sqlserver duplicate", mssql.Error{Number: 2601}, errClassRecord},
+		{"sqlserver null", mssql.Error{Number: 515}, errClassRecord},
+		{"sqlserver missing object", mssql.Error{Number: 208}, errClassFatal},
+
+		{"oracle deadlock", &network.OracleError{ErrCode: 60}, errClassRetry},
+		{"oracle not available", &network.OracleError{ErrCode: 1034}, errClassRetry},
+		{"oracle unique", &network.OracleError{ErrCode: 1}, errClassRecord},
+		{"oracle invalid number", &network.OracleError{ErrCode: 1722}, errClassRecord},
+		{"oracle missing table", &network.OracleError{ErrCode: 942}, errClassFatal},
+
+		{"clickhouse timeout", &clickhouse.Exception{Code: 159}, errClassRetry},
+		{"clickhouse too many parts", &clickhouse.Exception{Code: 252}, errClassRetry},
+		{"clickhouse cannot parse", &clickhouse.Exception{Code: 27}, errClassRecord},
+		{"clickhouse unknown table", &clickhouse.Exception{Code: 60}, errClassFatal},
+
+		{"bad connection", driver.ErrBadConn, errClassRetry},
+		{"mysql invalid connection", mysql.ErrInvalidConn, errClassRetry},
+		{"connection done", sql.ErrConnDone, errClassRetry},
+		{"deadline", fmt.Errorf("insert: %w", context.DeadlineExceeded), errClassRetry},
+		{"eof", io.ErrUnexpectedEOF, errClassRetry},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, errClassRetry},
+		{"dns", &net.DNSError{Err: "no such host", Name: "db"}, errClassRetry},
+		{"unknown", errors.New("something else"), errClassFatal},
+	}
+	for _, test := range tests {
+		if class := classifyDBError(test.err); class != test.expected {
+			t.Errorf("%s: got class %d, expected %d", test.name, class, test.expected)
+		}
+	}
+}
+
+func TestAuthFailed(t *testing.T) {
+	tests := []struct {
+		dbType   string
+		err      error
+		expected bool
+	}{
+		{PostgresDBType, &pq.Error{Code: "28P01"}, true},
+		{PostgresDBType, &pq.Error{Code: "08006"}, false},
+		{mysqlDBType, &mysql.MySQLError{Number: 1045}, true},
+		{mysqlDBType, &mysql.MySQLError{Number: 1062}, false},
+		{sqlserverDBType, mssql.Error{Number: 18456}, true},
+		{oracleDBType, &network.OracleError{ErrCode: 1017}, true},
+		{clickhouseDBType, errors.New("authentication failed"), false},
+	}
+	for _, test := range tests {
+		if failed := dialects[test.dbType].authFailed(test.err); failed != test.expected {
+			t.Errorf("%s %v: got %t, expected %t", test.dbType, test.err, failed, test.expected)
+		}
+	}
+}
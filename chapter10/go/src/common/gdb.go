@@ -13,10 +13,6 @@ import (
 	"strconv"
 	"strings"
 	"time"
-
-	_ "github.com/go-sql-driver/mysql"
-	_ "github.com/lib/pq"
-	//_ "github.com/ziutek/mymysql"
 )
 
 const Plugin_InstanceId = "plugin_instance_id"
@@ -24,6 +20,12 @@ const Plugin_Host = "db_host"
 const Plugin_Port = "db_port"
 const Plugin_User = "db_user"
 const Plugin_Password = "db_password"
+const Plugin_PasswordFile = "db_password_file"
+const Plugin_PasswordEnv = "db_password_env"
+const Plugin_SecretProvider = "db_secret_provider"
+const Plugin_SecretURL = "db_secret_url"
+const Plugin_SecretField = "db_secret_field"
+const Plugin_SecretTokenFile = "db_secret_token_file"
 const Plugin_Ordering = "ordering_col"
 const Plugin_TableName = "table_name"
 const Plugin_DBName = "db_name"
@@ -34,6 +36,57 @@ const Plugin_Delete = "delete"
 const Plugin_WhereExpr = "where_expression"
 const Plugin_ColsCSV = "query_cols"
 const Plugin_QueryFrequency = "query_frequency"
+const Plugin_DeadLetterTable = "dead_letter_table"
+const Plugin_TableAllowlist = "table_allowlist"
+const Plugin_TableRegex = "table_regex"
+const Plugin_TimeColumn = "time_column"
+const Plugin_PartitionBy = "partition_by"
+const Plugin_PartitionPremake = "partition_premake"
+const Plugin_PartitionInterval = "partition_interval"
+const Plugin_Retention = "retention"
+const Plugin_RetentionInterval = "retention_interval"
+const Plugin_RetentionBatchSize = "retention_batch_size"
+const Plugin_RetentionRateLimit = "retention_rate_limit"
+const Plugin_MetricsListen = "metrics_listen"
+const Plugin_TenantKey = "tenant_key"
+const Plugin_TenantMapFile = "tenant_map_file"
+const Plugin_TenantDefault = "tenant_default"
+const Plugin_UnmatchedTable = "unmatched_table"
+const Plugin_WriteMode = "write_mode"
+const Plugin_OpField = "op_field"
+const Plugin_ChildTables = "child_tables"
+const Plugin_ParentKey = "parent_key"
+const Plugin_ChildFKColumn = "child_fk_column"
+const Plugin_Dimensions = "dimensions"
+const Plugin_DimensionCacheSize = "dimension_cache_size"
+const Plugin_AggregateWindow = "aggregate_window"
+const Plugin_AggregateKeys = "aggregate_keys"
+const Plugin_AggregateFields = "aggregate_fields"
+const Plugin_Statement = "statement"
+const Plugin_Procedure = "procedure"
+const Plugin_ProcedureArgs = "procedure_args"
+const Plugin_HashColumn = "hash_column"
+const Plugin_HashDedup = "hash_dedup"
+const Plugin_HashCacheSize = "hash_cache_size"
+const Plugin_SpoolDir = "spool_dir"
+const Plugin_SpoolMaxSize = "spool_max_size"
+const Plugin_SpoolSegmentSize = "spool_segment_size"
+const Plugin_SpoolReplayInterval = "spool_replay_interval"
+const Plugin_CircuitBreakerFailures = "circuit_breaker_failures"
+const Plugin_CircuitBreakerCooldown = "circuit_breaker_cooldown"
+const Plugin_PoolMaxOpen = "db_max_open_conns"
+const Plugin_PoolMaxIdle = "db_max_idle_conns"
+const Plugin_PoolMaxLifetime = "db_conn_max_lifetime"
+const Plugin_DSN = "db_dsn"
+const Plugin_DBOptions = "db_options"
+const Plugin_DBOptionPrefix = "db_option."
+const Plugin_RedactFields = "redact_fields"
+const Plugin_TLS = "tls"
+const Plugin_TLSVerify = "tls.verify"
+const Plugin_TLSCAFile = "tls.ca_file"
+const Plugin_TLSCertFile = "tls.crt_file"
+const Plugin_TLSKeyFile = "tls.key_file"
+const Plugin_TLSServerName = "tls.server_name"
 const Plugin_LatestSequencerId = "LstSeqId"
 
 // https://www.digitalocean.com/community/tutorials/how-to-use-struct-tags-in-go
@@ -45,6 +98,12 @@ type SqlParams struct {
 	Port             string `json:"port,omitempty"`    // The port to use to connect to the DB
 	User             string `json:"usr,omitempty"`     // uasername to connect to the DB with
 	Password         string `json:"pw,omitempty"`      // the password to use when connecting to the DB
+	PasswordFile     string `json:"pwfile,omitempty"`  // a file holding the password, such as a Docker or Kubernetes secret
+	PasswordEnv      string `json:"pwenv,omitempty"`   // an environment variable holding the password
+	SecretProvider   string `json:"secprov,omitempty"` // the provider the password is fetched from
+	SecretURL        string `json:"securl,omitempty"`  // the secret store URL for the http provider
+	SecretField      string `json:"secfld,omitempty"`  // the field in the secret holding the password
+	SecretTokenFile  string `json:"sectok,omitempty"`  // a file holding the token for the secret store
 	DBName           string `json:"dbnme,omitempty"`   // the database name
 	ColsCSV          string `json:"cols,omitempty"`    // comma separated list pf the columns we want put or get for the named table
 	SequencerCol     string `json:"seqr,omitempty"`    // the column which determines correct record sequence - so that we get the records in the right order
@@ -54,13 +113,68 @@ type SqlParams struct {
 	PK               string `json:"pk,omitempty"`      // The primary key of the table - necessary to drive the deletion
 	DBType           string `json:"dbtype,omitempty"`  // The database type mysql, postgres
 	QueryFrequency   int    `json:"freq,omitempty"`    // the number of seconds until the next query assuming all existing records have been retrieved
+	DeadLetterTable  string `json:"dlt,omitempty"`     // table to write records the database rejects into, rather than dropping them
+	TableAllowlist   string `json:"tbalw,omitempty"`   // comma separated list of the table names a table_name template may resolve to
+	TableRegex       string `json:"tblre,omitempty"`   // regular expression a resolved table_name template must match
+	TimeColumn       string `json:"tmcol,omitempty"`   // the column holding the event time, populated from the record timestamp if the record doesn't provide it
+	PartitionBy      string `json:"prtby,omitempty"`   // day, week or month - if set the output manages time based partitions on the time column
+	PartitionPremake int    `json:"prtmk,omitempty"`   // the number of upcoming partitions to create ahead of time
+	PartitionCheck   string `json:"prtint,omitempty"`  // how often partitions are checked, e.g. 1h
+	Retention        string `json:"ret,omitempty"`     // how long data is kept for, e.g. 30d - older partitions are dropped, or the rows purged
+	RetentionCheck   string `json:"retint,omitempty"`  // how often the expired rows are purged when not partitioning
+	RetentionBatch   int    `json:"retbtch,omitempty"` // the maximum number of rows deleted by each purge statement
+	RetentionRate    int    `json:"retrate,omitempty"` // the maximum number of purge statements per second
+	MetricsListen    string `json:"mtrcs,omitempty"`   // address to serve the plugin metrics on in the Prometheus format
+	TenantKey        string `json:"tnkey,omitempty"`   // template giving the tenant for each record e.g. ${tag[1]} or ${record['tenant']}
+	TenantMapFile    string `json:"tnmap,omitempty"`   // JSON file with the connection details for each tenant
+	TenantDefault    string `json:"tndflt,omitempty"`  // the tenant to use for records with an unknown tenant
+	UnmatchedTable   string `json:"unmtbl,omitempty"`  // where the output writes records that don't match the where_expression, rather than dropping them
+	WriteMode        string `json:"wrmode,omitempty"`  // insert, or cdc to insert, update or delete based on the operation in each record
+	OpField          string `json:"opfld,omitempty"`   // the record attribute holding the operation when the write mode is cdc
+	ChildTables      string `json:"cldtbl,omitempty"`  // comma separated list of $array=table, the array elements are written as rows of the child table
+	ParentKey        string `json:"prntkey,omitempty"` // the parent's id column, the value the child rows refer to
+	ChildFKColumn    string `json:"cldfk,omitempty"`   // the column in the child tables holding the parent's id
+	Dimensions       string `json:"dims,omitempty"`    // comma separated list of $attribute=table[:column], the values are replaced by ids from the dimension tables
+	DimensionCache   int    `json:"dimcch,omitempty"`  // the number of ids cached for each dimension table
+	AggregateWindow  string `json:"aggwin,omitempty"`  // if set the records are rolled up over a tumbling window of this duration e.g. 1m
+	AggregateKeys    string `json:"aggkeys,omitempty"` // comma separated record accessors to group the records by
+	AggregateFields  string `json:"aggflds,omitempty"` // comma separated record accessors for the numeric values to aggregate
+	Statement        string `json:"stmt,omitempty"`    // the statement executed for each record in the statement write mode, with :name placeholders
+	Procedure        string `json:"proc,omitempty"`    // the stored procedure called for each record in the procedure write mode
+	ProcedureArgs    string `json:"prcargs,omitempty"` // comma separated record accessors for the procedure's arguments, in order
+	HashColumn       string `json:"hshcol,omitempty"`  // the column to write a hash of each record into, so duplicates can be recognised
+	HashDedup        string `json:"hshdup,omitempty"`  // conflict to ignore inserts that clash on the hash column, or memory to remember the hashes written
+	HashCache        int    `json:"hshcch,omitempty"`  // the number of hashes remembered when deduplicating in memory
+	SpoolDir         string `json:"spldir,omitempty"`  // directory to spool chunks to when the database is unavailable
+	SpoolMaxSize     string `json:"splmax,omitempty"`  // the most the spool can hold e.g. 100M, beyond which the oldest segments are dropped
+	SpoolSegment     string `json:"splseg,omitempty"`  // the size of each spool segment file e.g. 8M
+	SpoolReplay      string `json:"splrpl,omitempty"`  // how often we try to replay the spool e.g. 30s
+	CircuitFailures  int    `json:"cbfail,omitempty"`  // the consecutive connection failures that open the circuit breaker, negative to disable it
+	CircuitCooldown  string `json:"cbcool,omitempty"`  // how long the circuit breaker stays open before probing the database e.g. 30s
+	PoolMaxOpen      int    `json:"plmxo,omitempty"`   // the most connections the instance holds open to the database
+	PoolMaxIdle      int    `json:"plmxi,omitempty"`   // the most idle connections kept in the pool
+	PoolLifetime     string `json:"pllife,omitempty"`  // how long a connection is used before being replaced e.g. 30m
+	DSN              string `json:"dsn,omitempty"`     // a complete connection string for the driver, used instead of the host, port, user and password
+	DBOptions        string `json:"dbopts,omitempty"`  // options merged into the connection string, held as a URL query
+	RedactFields     string `json:"redact,omitempty"`  // comma separated settings and record fields kept out of the logs, in addition to the credentials
+	TLS              string `json:"tls,omitempty"`     // on to connect to the database using TLS
+	TLSVerify        string `json:"tlsvfy,omitempty"`  // off to accept the server's certificate without verifying it
+	TLSCAFile        string `json:"tlsca,omitempty"`   // the CA certificate(s) used to verify the server, rather than the system's
+	TLSCertFile      string `json:"tlscrt,omitempty"`  // the client certificate, for databases that authenticate clients by certificate
+	TLSKeyFile       string `json:"tlskey,omitempty"`  // the private key for the client certificate
+	TLSServerName    string `json:"tlssni,omitempty"`  // the name the server's certificate is verified against, when it isn't the db_host
 
 	//the following attributes are for operational caching purposes and aren't reflected in the configuration
 	LatestSequencerId string `json:"seqrId,omitempty"`
+	ContextId         string `json:"ctxid,omitempty"` // unique id given to each instance at initialization, so we can find the resources held for it
 }
 
 const PostgresDBType = "postgres"
 const mysqlDBType = "mysql"
+const sqliteDBType = "sqlite"
+const sqlserverDBType = "sqlserver"
+const oracleDBType = "oracle"
+const clickhouseDBType = "clickhouse"
 const ParamCGFPostfix = "-cfg"
 const InsertTimeout = time.Second * 1
 
@@ -106,7 +220,7 @@ func typeToStr(data interface{}, quoteStrings bool) string {
 	case int64:
 		return strconv.FormatInt(data.(int64), 10)
 	case int32:
-		return strconv.FormatInt(data.(int64), 10)
+		return strconv.FormatInt(int64(data.(int32)), 10)
 	case uint64:
 		return strconv.FormatUint(data.(uint64), 10)
 	case bool:
@@ -114,14 +228,14 @@ func typeToStr(data interface{}, quoteStrings bool) string {
 	case float64:
 		return strconv.FormatFloat(data.(float64), 'E', -1, 64)
 	case float32:
-		return strconv.FormatFloat(data.(float64), 'E', -1, 32)
+		return strconv.FormatFloat(float64(data.(float32)), 'E', -1, 32)
 	case string:
 		if quoteStrings {
 			return "'" + data.(string) + "'"
 		}
 		return data.(string)
 	case uint:
-		return strconv.FormatUint(data.(uint64), 10)
+		return strconv.FormatUint(uint64(data.(uint)), 10)
 	default:
 		printType("data type is", data)
 		return fmt.Sprintf("%v", data)
@@ -131,20 +245,106 @@ func typeToStr(data interface{}, quoteStrings bool) string {
 	return ""
 }
 
+// the record keys from msgpack may arrive as strings or byte arrays, so make sure we have a string
+func keyToStr(key interface{}) string {
+	switch k := key.(type) {
+	case string:
+		return k
+	case []byte:
+		return string(k)
+	default:
+		return fmt.Sprintf("%v", k)
+	}
+}
+
+// msgpack hands us strings as byte arrays and nested structures as maps and arrays, which the DB drivers
+// can't bind as values. So convert strings and render any nested structure as JSON text
+func toDBValue(data interface{}) interface{} {
+	switch val := data.(type) {
+	case []byte:
+		return string(val)
+	case map[interface{}]interface{}, []interface{}:
+		jsonBytes, err := json.Marshal(normalizeForJSON(val))
+		if err != nil {
+			return fmt.Sprintf("%v", val)
+		}
+		return string(jsonBytes)
+	default:
+		return val
+	}
+}
+
+// walk the structure that msgpack has given us replacing the maps with interface keys (which the JSON encoder
+// can't handle) with string keyed maps, and byte arrays with strings
+func normalizeForJSON(data interface{}) interface{} {
+	switch val := data.(type) {
+	case []byte:
+		return string(val)
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(val))
+		for k, v := range val {
+			result[keyToStr(k)] = normalizeForJSON(v)
+		}
+		return result
+	case RowDefinition:
+		return normalizeForJSON(map[interface{}]interface{}(val))
+	case []interface{}:
+		result := make([]interface{}, len(val))
+		for i, v := range val {
+			result[i] = normalizeForJSON(v)
+		}
+		return result
+	default:
+		return val
+	}
+}
+
+// parse a duration from the configuration. As well as the Go duration units (e.g. 90m, 12h) we accept
+// days and weeks (e.g. 30d, 2w) as these are more natural for retention periods. An empty value is a zero duration
+func parseDurationStr(durationStr string) (time.Duration, error) {
+	durationStr = strings.TrimSpace(durationStr)
+	if len(durationStr) == 0 {
+		return 0, nil
+	}
+	unit := durationStr[len(durationStr)-1]
+	if unit == 'd' || unit == 'w' {
+		count, err := strconv.Atoi(durationStr[:len(durationStr)-1])
+		if err != nil {
+			return 0, errors.New("invalid duration " + durationStr)
+		}
+		if unit == 'w' {
+			count = count * 7
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+	// a plain number is taken as seconds
+	if seconds, err := strconv.Atoi(durationStr); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(durationStr)
+}
+
 // Put the internal configuration values into a printable format
 func SprintfParams(params *SqlParams, pluginName string) string {
 	if params == nil {
 		log.Printf("[%s] SprintfParams called with no params struct", pluginName)
 		return ""
 	}
-	var paramStr string = paramsToJSON(params)
-	paramStr = fmt.Sprintf("[%s]\"Connection\":{%s},\nQuery:%s\n", paramStr, buildConnectionStr(params), buildQueryExpr(params, false))
+	// the credentials are redacted, so the connection string is built from the redacted params as well
+	redacted := redactedParams(params)
+	paramJSON, err := json.Marshal(*redacted)
+	if err != nil {
+		log.Printf("[%s] SprintfParams error - %s", params.PluginName, err)
+	}
+	var paramStr string = string(paramJSON)
+	paramStr = fmt.Sprintf("[%s]\"Connection\":{%s},\nQuery:%s\n", paramStr, buildConnectionStr(redacted), buildQueryExpr(redacted, false))
 	return paramStr
 }
 
-// Build a JSON representation of our configuration and other values we'd like to hold in our context
+// Build a JSON representation of our configuration and other values we'd like to hold in our context. The
+// credentials are held in memory for the instance, with only their redacted values going into the JSON
 func paramsToJSON(params *SqlParams) string {
-	json, err := json.Marshal(*params)
+	json, err := json.Marshal(*holdSensitiveParams(instanceKey(params), params))
 	if err != nil {
 		log.Printf("[%s] paramsToJSON error - %s", params.PluginName, err)
 	}
@@ -159,6 +359,7 @@ func JSONToParams(paramsJSON string, pluginName string) *SqlParams {
 	if err != nil {
 		log.Printf("[%s] JSONToParams error - %s", pluginName, err)
 	}
+	restoreSensitiveParams(instanceKey(&params), &params)
 	return &params
 }
 
@@ -167,17 +368,31 @@ func clearEnvParams(pluginName string) {
 	blankParams := NewSqlParams()
 	log.Printf("[%s] Flushing environment params", pluginName)
 	paramsToEnv(blankParams, pluginName)
+	releaseSensitiveParams(envParamsKey(pluginName))
+}
+
+// the key the credentials are held under for the params stored in the environment variables
+func envParamsKey(pluginName string) string {
+	return "env/" + pluginName
 }
 
 // store the parameter values as envcironment veriables - this is part of a work around for the missing context on the input side of the plugin
 // NOTE: if any additional elements added into the SqlParams struct then they need to be factored into this and its opposite function
 // We do note perform any value validation here - as we assume this is done during the initialization phase, and the env vars are NOT tampered with
+// The credentials are held in memory, with only their redacted values going into the environment
 func paramsToEnv(params *SqlParams, pluginName string) error {
 	var err error = nil // use this if at some point we need to communicate an error
+	params = holdSensitiveParams(envParamsKey(pluginName), params)
 	os.Setenv(pluginName+"_"+Plugin_Host, params.Host)
 	os.Setenv(pluginName+"_"+Plugin_Port, params.Port)
 	os.Setenv(pluginName+"_"+Plugin_User, params.User)
 	os.Setenv(pluginName+"_"+Plugin_Password, params.Password)
+	os.Setenv(pluginName+"_"+Plugin_PasswordFile, params.PasswordFile)
+	os.Setenv(pluginName+"_"+Plugin_PasswordEnv, params.PasswordEnv)
+	os.Setenv(pluginName+"_"+Plugin_SecretProvider, params.SecretProvider)
+	os.Setenv(pluginName+"_"+Plugin_SecretURL, params.SecretURL)
+	os.Setenv(pluginName+"_"+Plugin_SecretField, params.SecretField)
+	os.Setenv(pluginName+"_"+Plugin_SecretTokenFile, params.SecretTokenFile)
 	os.Setenv(pluginName+"_"+Plugin_Ordering, params.SequencerCol)
 	os.Setenv(pluginName+"_"+Plugin_TableName, params.TableName)
 	os.Setenv(pluginName+"_"+Plugin_DBName, params.DBName)
@@ -187,6 +402,56 @@ func paramsToEnv(params *SqlParams, pluginName string) error {
 	os.Setenv(pluginName+"_"+Plugin_Delete, strconv.FormatBool(params.DeleteAfterQuery))
 	os.Setenv(pluginName+"_"+Plugin_ColsCSV, (params.ColsCSV))
 	os.Setenv(pluginName+"_"+Plugin_WhereExpr, (params.WhereExpr))
+	os.Setenv(pluginName+"_"+Plugin_DeadLetterTable, (params.DeadLetterTable))
+	os.Setenv(pluginName+"_"+Plugin_TableAllowlist, (params.TableAllowlist))
+	os.Setenv(pluginName+"_"+Plugin_TableRegex, (params.TableRegex))
+	os.Setenv(pluginName+"_"+Plugin_TimeColumn, (params.TimeColumn))
+	os.Setenv(pluginName+"_"+Plugin_PartitionBy, (params.PartitionBy))
+	os.Setenv(pluginName+"_"+Plugin_PartitionPremake, strconv.Itoa(params.PartitionPremake))
+	os.Setenv(pluginName+"_"+Plugin_PartitionInterval, (params.PartitionCheck))
+	os.Setenv(pluginName+"_"+Plugin_Retention, (params.Retention))
+	os.Setenv(pluginName+"_"+Plugin_RetentionInterval, (params.RetentionCheck))
+	os.Setenv(pluginName+"_"+Plugin_RetentionBatchSize, strconv.Itoa(params.RetentionBatch))
+	os.Setenv(pluginName+"_"+Plugin_RetentionRateLimit, strconv.Itoa(params.RetentionRate))
+	os.Setenv(pluginName+"_"+Plugin_MetricsListen, (params.MetricsListen))
+	os.Setenv(pluginName+"_"+Plugin_TenantKey, (params.TenantKey))
+	os.Setenv(pluginName+"_"+Plugin_TenantMapFile, (params.TenantMapFile))
+	os.Setenv(pluginName+"_"+Plugin_TenantDefault, (params.TenantDefault))
+	os.Setenv(pluginName+"_"+Plugin_UnmatchedTable, (params.UnmatchedTable))
+	os.Setenv(pluginName+"_"+Plugin_WriteMode, (params.WriteMode))
+	os.Setenv(pluginName+"_"+Plugin_OpField, (params.OpField))
+	os.Setenv(pluginName+"_"+Plugin_ChildTables, (params.ChildTables))
+	os.Setenv(pluginName+"_"+Plugin_ParentKey, (params.ParentKey))
+	os.Setenv(pluginName+"_"+Plugin_ChildFKColumn, (params.ChildFKColumn))
+	os.Setenv(pluginName+"_"+Plugin_Dimensions, (params.Dimensions))
+	os.Setenv(pluginName+"_"+Plugin_DimensionCacheSize, strconv.Itoa(params.DimensionCache))
+	os.Setenv(pluginName+"_"+Plugin_AggregateWindow, (params.AggregateWindow))
+	os.Setenv(pluginName+"_"+Plugin_AggregateKeys, (params.AggregateKeys))
+	os.Setenv(pluginName+"_"+Plugin_AggregateFields, (params.AggregateFields))
+	os.Setenv(pluginName+"_"+Plugin_Statement, (params.Statement))
+	os.Setenv(pluginName+"_"+Plugin_Procedure, (params.Procedure))
+	os.Setenv(pluginName+"_"+Plugin_ProcedureArgs, (params.ProcedureArgs))
+	os.Setenv(pluginName+"_"+Plugin_HashColumn, (params.HashColumn))
+	os.Setenv(pluginName+"_"+Plugin_HashDedup, (params.HashDedup))
+	os.Setenv(pluginName+"_"+Plugin_HashCacheSize, strconv.Itoa(params.HashCache))
+	os.Setenv(pluginName+"_"+Plugin_SpoolDir, (params.SpoolDir))
+	os.Setenv(pluginName+"_"+Plugin_SpoolMaxSize, (params.SpoolMaxSize))
+	os.Setenv(pluginName+"_"+Plugin_SpoolSegmentSize, (params.SpoolSegment))
+	os.Setenv(pluginName+"_"+Plugin_SpoolReplayInterval, (params.SpoolReplay))
+	os.Setenv(pluginName+"_"+Plugin_CircuitBreakerFailures, strconv.Itoa(params.CircuitFailures))
+	os.Setenv(pluginName+"_"+Plugin_CircuitBreakerCooldown, (params.CircuitCooldown))
+	os.Setenv(pluginName+"_"+Plugin_PoolMaxOpen, strconv.Itoa(params.PoolMaxOpen))
+	os.Setenv(pluginName+"_"+Plugin_PoolMaxIdle, strconv.Itoa(params.PoolMaxIdle))
+	os.Setenv(pluginName+"_"+Plugin_PoolMaxLifetime, (params.PoolLifetime))
+	os.Setenv(pluginName+"_"+Plugin_DSN, (params.DSN))
+	os.Setenv(pluginName+"_"+Plugin_DBOptions, (params.DBOptions))
+	os.Setenv(pluginName+"_"+Plugin_RedactFields, (params.RedactFields))
+	os.Setenv(pluginName+"_"+Plugin_TLS, (params.TLS))
+	os.Setenv(pluginName+"_"+Plugin_TLSVerify, (params.TLSVerify))
+	os.Setenv(pluginName+"_"+Plugin_TLSCAFile, (params.TLSCAFile))
+	os.Setenv(pluginName+"_"+Plugin_TLSCertFile, (params.TLSCertFile))
+	os.Setenv(pluginName+"_"+Plugin_TLSKeyFile, (params.TLSKeyFile))
+	os.Setenv(pluginName+"_"+Plugin_TLSServerName, (params.TLSServerName))
 	os.Setenv(pluginName+"_"+Plugin_LatestSequencerId, (params.LatestSequencerId))
 	return err
 }
@@ -200,6 +465,12 @@ func envToParams(pluginName string) *SqlParams {
 	params.Port = os.Getenv((pluginName + "_" + Plugin_Port))
 	params.User = os.Getenv((pluginName + "_" + Plugin_User))
 	params.Password = os.Getenv((pluginName + "_" + Plugin_Password))
+	params.PasswordFile = os.Getenv((pluginName + "_" + Plugin_PasswordFile))
+	params.PasswordEnv = os.Getenv((pluginName + "_" + Plugin_PasswordEnv))
+	params.SecretProvider = os.Getenv((pluginName + "_" + Plugin_SecretProvider))
+	params.SecretURL = os.Getenv((pluginName + "_" + Plugin_SecretURL))
+	params.SecretField = os.Getenv((pluginName + "_" + Plugin_SecretField))
+	params.SecretTokenFile = os.Getenv((pluginName + "_" + Plugin_SecretTokenFile))
 	params.SequencerCol = os.Getenv((pluginName + "_" + Plugin_Ordering))
 	params.TableName = os.Getenv((pluginName + "_" + Plugin_TableName))
 	params.DBName = os.Getenv((pluginName + "_" + Plugin_DBName))
@@ -207,6 +478,56 @@ func envToParams(pluginName string) *SqlParams {
 	params.PK = os.Getenv((pluginName + "_" + Plugin_PK))
 	params.ColsCSV = os.Getenv((pluginName + "_" + Plugin_ColsCSV))
 	params.WhereExpr = os.Getenv((pluginName + "_" + Plugin_WhereExpr))
+	params.DeadLetterTable = os.Getenv((pluginName + "_" + Plugin_DeadLetterTable))
+	params.TableAllowlist = os.Getenv((pluginName + "_" + Plugin_TableAllowlist))
+	params.TableRegex = os.Getenv((pluginName + "_" + Plugin_TableRegex))
+	params.TimeColumn = os.Getenv((pluginName + "_" + Plugin_TimeColumn))
+	params.PartitionBy = os.Getenv((pluginName + "_" + Plugin_PartitionBy))
+	params.PartitionPremake, _ = strconv.Atoi(os.Getenv((pluginName + "_" + Plugin_PartitionPremake)))
+	params.PartitionCheck = os.Getenv((pluginName + "_" + Plugin_PartitionInterval))
+	params.Retention = os.Getenv((pluginName + "_" + Plugin_Retention))
+	params.RetentionCheck = os.Getenv((pluginName + "_" + Plugin_RetentionInterval))
+	params.RetentionBatch, _ = strconv.Atoi(os.Getenv((pluginName + "_" + Plugin_RetentionBatchSize)))
+	params.RetentionRate, _ = strconv.Atoi(os.Getenv((pluginName + "_" + Plugin_RetentionRateLimit)))
+	params.MetricsListen = os.Getenv((pluginName + "_" + Plugin_MetricsListen))
+	params.TenantKey = os.Getenv((pluginName + "_" + Plugin_TenantKey))
+	params.TenantMapFile = os.Getenv((pluginName + "_" + Plugin_TenantMapFile))
+	params.TenantDefault = os.Getenv((pluginName + "_" + Plugin_TenantDefault))
+	params.UnmatchedTable = os.Getenv((pluginName + "_" + Plugin_UnmatchedTable))
+	params.WriteMode = os.Getenv((pluginName + "_" + Plugin_WriteMode))
+	params.OpField = os.Getenv((pluginName + "_" + Plugin_OpField))
+	params.ChildTables = os.Getenv((pluginName + "_" + Plugin_ChildTables))
+	params.ParentKey = os.Getenv((pluginName + "_" + Plugin_ParentKey))
+	params.ChildFKColumn = os.Getenv((pluginName + "_" + Plugin_ChildFKColumn))
+	params.Dimensions = os.Getenv((pluginName + "_" + Plugin_Dimensions))
+	params.DimensionCache, _ = strconv.Atoi(os.Getenv((pluginName + "_" + Plugin_DimensionCacheSize)))
+	params.AggregateWindow = os.Getenv((pluginName + "_" + Plugin_AggregateWindow))
+	params.AggregateKeys = os.Getenv((pluginName + "_" + Plugin_AggregateKeys))
+	params.AggregateFields = os.Getenv((pluginName + "_" + Plugin_AggregateFields))
+	params.Statement = os.Getenv((pluginName + "_" + Plugin_Statement))
+	params.Procedure = os.Getenv((pluginName + "_" + Plugin_Procedure))
+	params.ProcedureArgs = os.Getenv((pluginName + "_" + Plugin_ProcedureArgs))
+	params.HashColumn = os.Getenv((pluginName + "_" + Plugin_HashColumn))
+	params.HashDedup = os.Getenv((pluginName + "_" + Plugin_HashDedup))
+	params.HashCache, _ = strconv.Atoi(os.Getenv((pluginName + "_" + Plugin_HashCacheSize)))
+	params.SpoolDir = os.Getenv((pluginName + "_" + Plugin_SpoolDir))
+	params.SpoolMaxSize = os.Getenv((pluginName + "_" + Plugin_SpoolMaxSize))
+	params.SpoolSegment = os.Getenv((pluginName + "_" + Plugin_SpoolSegmentSize))
+	params.SpoolReplay = os.Getenv((pluginName + "_" + Plugin_SpoolReplayInterval))
+	params.CircuitFailures, _ = strconv.Atoi(os.Getenv((pluginName + "_" + Plugin_CircuitBreakerFailures)))
+	params.CircuitCooldown = os.Getenv((pluginName + "_" + Plugin_CircuitBreakerCooldown))
+	params.PoolMaxOpen, _ = strconv.Atoi(os.Getenv((pluginName + "_" + Plugin_PoolMaxOpen)))
+	params.PoolMaxIdle, _ = strconv.Atoi(os.Getenv((pluginName + "_" + Plugin_PoolMaxIdle)))
+	params.PoolLifetime = os.Getenv((pluginName + "_" + Plugin_PoolMaxLifetime))
+	params.DSN = os.Getenv((pluginName + "_" + Plugin_DSN))
+	params.DBOptions = os.Getenv((pluginName + "_" + Plugin_DBOptions))
+	params.RedactFields = os.Getenv((pluginName + "_" + Plugin_RedactFields))
+	params.TLS = os.Getenv((pluginName + "_" + Plugin_TLS))
+	params.TLSVerify = os.Getenv((pluginName + "_" + Plugin_TLSVerify))
+	params.TLSCAFile = os.Getenv((pluginName + "_" + Plugin_TLSCAFile))
+	params.TLSCertFile = os.Getenv((pluginName + "_" + Plugin_TLSCertFile))
+	params.TLSKeyFile = os.Getenv((pluginName + "_" + Plugin_TLSKeyFile))
+	params.TLSServerName = os.Getenv((pluginName + "_" + Plugin_TLSServerName))
 	params.LatestSequencerId = os.Getenv((pluginName + "_" + Plugin_LatestSequencerId))
 
 	freqStr := strings.TrimSpace(os.Getenv(pluginName + "_" + Plugin_QueryFrequency))
@@ -225,24 +546,21 @@ func envToParams(pluginName string) *SqlParams {
 		params.DeleteAfterQuery = strings.Contains(strings.ToLower(delStr), "true")
 	}
 
+	restoreSensitiveParams(envParamsKey(pluginName), params)
 	return params
 }
 
 // creates the correct conection string based on DB type
 func buildConnectionStr(params *SqlParams) string {
-	var connectStr string = ""
-
-	switch params.DBType {
-	case PostgresDBType:
-		connectStr = fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", params.Host, params.Port, params.User, params.Password, params.DBName)
-	case mysqlDBType:
-		connectStr = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", params.User, params.Password, params.Host, params.Port, params.DBName)
-	default:
-		log.Println("[%s] Unknown db type >", params.DBType, "<", params.PluginName)
-		connectStr = ""
+	dialect := getDialect(params)
+	if dialect == nil {
+		log.Printf("[%s] Unknown db type >%s<", params.PluginName, params.DBType)
+		return ""
 	}
-
-	return connectStr
+	if len(params.DSN) > 0 {
+		return params.DSN
+	}
+	return dialect.connectionStr(params)
 }
 
 // Once the values have been retrieved and loaded into the SqlParams struct we need to verify whether the mandatory
@@ -255,33 +573,51 @@ func validateSqlParams(params *SqlParams) error {
 		params.PluginName = "gdb"
 	}
 
-	// make sure the host has been set
-	params.Host = strings.TrimSpace(params.Host)
-	if len(params.Host) == 0 {
-		return errors.New("No " + Plugin_Host + " defined for " + params.PluginName)
+	params.DBType = strings.TrimSpace(params.DBType)
+	if len(params.DBType) == 0 {
+		return errors.New("No " + Plugin_Type + " defined for " + params.PluginName)
+	} else if _, known := dialects[params.DBType]; !known {
+		// we only know about the DB types we have a dialect for
+		return errors.New("Unknown " + Plugin_Type + " defined " + params.DBType + " for " + params.PluginName)
 	}
 
-	// remove any white space and confirm there is a value
-	params.Port = strings.TrimSpace(params.Port)
-	if len(params.Port) == 0 {
-		return errors.New("No " + Plugin_Port + " defined for " + params.PluginName)
+	if err := validateDSNParams(params); err != nil {
+		return err
 	}
-
-	// test port is numeric
-	_, err := strconv.Atoi(params.Port)
-	if err != nil {
-		return errors.New(Plugin_Port + " is not numeric for " + params.PluginName)
+	if err := validateSecretParams(params); err != nil {
+		return err
 	}
 
-	// remove any white space and confirm there is a value
-	params.User = strings.TrimSpace(params.User)
-	if len(params.User) == 0 {
-		return errors.New("No " + Plugin_User + " defined for " + params.PluginName)
+	// databases such as SQLite are a local file, so there is no server to connect to. A DSN provides the
+	// connection details itself
+	if getDialect(params).usesServer() && len(params.DSN) == 0 {
+		// make sure the host has been set
+		params.Host = strings.TrimSpace(params.Host)
+		if len(params.Host) == 0 {
+			return errors.New("No " + Plugin_Host + " defined for " + params.PluginName)
+		}
+
+		// remove any white space and confirm there is a value
+		params.Port = strings.TrimSpace(params.Port)
+		if len(params.Port) == 0 {
+			return errors.New("No " + Plugin_Port + " defined for " + params.PluginName)
+		}
+
+		// test port is numeric
+		if _, err := strconv.Atoi(params.Port); err != nil {
+			return errors.New(Plugin_Port + " is not numeric for " + params.PluginName)
+		}
+
+		// remove any white space and confirm there is a value
+		params.User = strings.TrimSpace(params.User)
+		if len(params.User) == 0 {
+			return errors.New("No " + Plugin_User + " defined for " + params.PluginName)
+		}
 	}
 
 	// remove any white space and confirm there is a value
 	params.DBName = strings.TrimSpace(params.DBName)
-	if len(params.DBName) == 0 {
+	if len(params.DBName) == 0 && len(params.DSN) == 0 {
 		return errors.New("No " + Plugin_DBName + " name defined for " + params.PluginName)
 	}
 
@@ -292,27 +628,18 @@ func validateSqlParams(params *SqlParams) error {
 		log.Printf("[%s]Defaulting query columns to %s\n", params.PluginName, params.ColsCSV)
 	}
 
-	params.DBType = strings.TrimSpace(params.DBType)
-	if len(params.DBType) == 0 {
-		return errors.New("No " + Plugin_Type + " defined for " + params.PluginName)
-	} else {
-		switch params.DBType {
-		case PostgresDBType:
-			// nothing to do we know about this DB type
-		case mysqlDBType:
-			// nothing to do we know about this DB type
-		default:
-			params.DBType = ""
-			return errors.New("Unknown " + Plugin_Type + " defined  " + params.DBType + " for " + params.PluginName)
-		}
-	}
-
 	// test query interval is numeric and default if not set
 	if params.QueryFrequency <= 0 {
 		params.QueryFrequency = 1
 	}
 
-	return nil
+	if err := validateTLSParams(params); err != nil {
+		return err
+	}
+	if err := validatePoolParams(params); err != nil {
+		return err
+	}
+	return validateBreakerParams(params)
 }
 
 // This builds the SQL expression. Uses standard ANSI SQL, but could be customized for optimization
@@ -347,7 +674,7 @@ func buildQueryExpr(params *SqlParams, countStmt bool) string {
 		if len(params.SequencerCol) > 0 {
 			sqlStmt = sqlStmt + " ORDER BY " + params.SequencerCol
 		}
-		sqlStmt = sqlStmt + " LIMIT 1" //+ strconv.Itoa(params.Limit)
+		sqlStmt = getDialect(params).limitQuery(sqlStmt, 1, 0)
 	}
 	log.Printf("[%s]%s Query constructed:%s", params.PluginName, params.InstanceName, sqlStmt)
 
@@ -362,11 +689,21 @@ func buildDeleteExpr(params *SqlParams, recdKey string) string {
 }
 
 // create a transaction with delete statements using the retrieved pk (primary key)
-func execDelete(params *SqlParams, keyList []interface{}) error {
+func execDelete(params *SqlParams, keyList []interface{}) (err error) {
+	breaker := getBreaker(params)
+	if err = breaker.allow(params); err != nil {
+		log.Printf("[%s]%s not deleting %d records - %v", params.PluginName, params.InstanceName, len(keyList), err)
+		return err
+	}
+	defer func() { breaker.record(params, err) }()
+
 	ctx, cancel := context.WithTimeout(context.Background(), InsertTimeout)
 	defer cancel()
 
-	db, err := sql.Open(params.DBType, buildConnectionStr(params))
+	db, err := getDB(params)
+	if err != nil {
+		return err
+	}
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
@@ -377,8 +714,8 @@ func execDelete(params *SqlParams, keyList []interface{}) error {
 	for rowValIdx := 0; rowValIdx < len(keyList); rowValIdx++ {
 		sqlStmt := buildDeleteExpr(params, typeToStr(keyList[rowValIdx], true))
 		if err == nil {
+			log.Printf("[%s]%s delete expression: %s", params.PluginName, params.InstanceName, sqlStmt)
 			_, err := tx.ExecContext(ctx, sqlStmt)
-			fmt.Println(sqlStmt)
 			if err != nil {
 				log.Println(err)
 				return err
@@ -399,96 +736,353 @@ func execDelete(params *SqlParams, keyList []interface{}) error {
 type RowDefinition map[interface{}]interface{}
 type ManyRowDefinition []RowDefinition
 
+// A single event handed to us by Fluent Bit along with its tag and timestamp, so the output
+// side has everything it needs to process and report on each record
+type FlushRecord struct {
+	Tag       string
+	Timestamp time.Time
+	Record    RowDefinition
+}
+
+// name of the savepoints used to isolate each record, and its dead-letter entry, within the insert transaction
+const recordSavepoint = "gdb_record"
+const deadLetterSavepoint = "gdb_dead_letter"
+
 // build up the SQL statement, as we don't know whether we're popukating the entire DB row
 // we need to use the column names.
-// We assume that the values provided are in the same order as the defined params to target
-// TODO: address the possibility that the values provided mismatch the column names
-// TODO: handle the possibility that the params is empty or a wildcard
-func buildInsertExpr(params *SqlParams, values RowDefinition) (string, error) {
+// When query_cols has been set we take the values for those columns from the record (missing values become NULL),
+// otherwise we use every attribute of the record.
+// The values are returned separately so they can be bound to the placeholders rather than
+// being embedded in the SQL - which means quotes and other special characters in the data can't break the statement
+func buildInsertExpr(params *SqlParams, values RowDefinition) (string, []interface{}, error) {
 	if values == nil || len(values) == 0 {
-		return "", errors.New("No data values provided")
-	}
-
-	var valLen int = len(values)
-	var orderedColNames []string = make([]string, valLen)
-	var colnames string = params.ColsCSV
-
-	if colnames == "*" {
-		colnames = ""
-		var ctr int = 0
-		for key, _ := range values {
-			orderedColNames[ctr] = key.(string)
-			ctr++
-			if len(colnames) == 0 {
-				colnames = key.(string)
-			} else {
-				colnames = colnames + "," + key.(string)
-			}
+		return "", nil, errors.New("No data values provided")
+	}
+
+	var orderedColNames []string
+
+	if params.ColsCSV == "*" || len(params.ColsCSV) == 0 {
+		orderedColNames = make([]string, 0, len(values))
+		for key := range values {
+			orderedColNames = append(orderedColNames, keyToStr(key))
 		}
 	} else {
-		fmt.Println(" ")
-		splitStr := strings.Split(params.ColsCSV, ",")
-		if len(splitStr) != len(orderedColNames) {
-			return "", errors.New("Number of data elements to no cols mismatched")
+		for _, colName := range strings.Split(params.ColsCSV, ",") {
+			orderedColNames = append(orderedColNames, strings.TrimSpace(colName))
 		}
 	}
 
-	var sqlStmt = "INSERT INTO " + params.TableName + " (" + colnames + ")"
+	var args []interface{} = make([]interface{}, len(orderedColNames))
+	var colIdents []string = make([]string, len(orderedColNames))
+	for valIdx, colName := range orderedColNames {
+		args[valIdx] = toDBValue(values[colName])
+		colIdents[valIdx] = columnIdent(params, colName)
+	}
 
-	var valueStr string = ""
-	//for _, val := range values {
-	for valIdx := 0; valIdx < valLen; valIdx++ {
-		if valIdx == 0 {
-			valueStr = typeToStr(values[orderedColNames[valIdx]], true)
-		} else {
-			// if it isnt the last element we need a comma to separate the values
-			valueStr = valueStr + "," + typeToStr(values[orderedColNames[valIdx]], true)
-		}
+	// with the hash column deduplicating, a record clashing with one already written is quietly left out
+	if len(params.HashColumn) > 0 && params.HashDedup == hashDedupConflict {
+		return getDialect(params).upsertExpr(params.TableName, colIdents, []string{params.HashColumn}, nil), args, nil
 	}
-	sqlStmt = sqlStmt + " VALUES (" + valueStr + ")"
-	return sqlStmt, nil
+	return getDialect(params).insertExpr(params.TableName, colIdents, 1), args, nil
 }
 
-// get the SQL generated and execute the statement
-// as we want to potentially execute multiple rows - let's wrap it
-// inside a transaction with a time out
-// the data needs to be presented as an array of string arrays
-func execInsert(params *SqlParams, value RowDefinition) error {
-	ctx, cancel := context.WithTimeout(context.Background(), InsertTimeout)
+// build the statement for the record - an insert, or in cdc mode whatever the record's operation asks for
+func buildRecordExpr(params *SqlParams, values RowDefinition) (string, []interface{}, error) {
+	if params.WriteMode == writeModeCDC {
+		return buildChangeExpr(params, values)
+	}
+	return buildInsertExpr(params, values)
+}
+
+// the bind variable syntax differs between the drivers - e.g. Postgres uses numbered variables
+// and MySQL uses question marks. The index starts at 1
+func bindVar(params *SqlParams, idx int) string {
+	return getDialect(params).bindVar(idx)
+}
+
+// get the SQL generated and execute the statements for all the records Fluent Bit has given us
+// inside a single transaction with a time out. If the table name is a template, the records are grouped by the
+// table they resolve to, and the statements executed table by table.
+// Each record is wrapped in a savepoint so that if the database rejects a record because of its content
+// (e.g. a constraint violation or a value that is too long) we can roll back just that record, log it and carry on
+// with the rest of the chunk - if a dead-letter table is configured the record is written there. If the error
+// is transient (the DB is restarting, deadlock, timeout) we abandon the transaction and tell the caller to retry the
+// whole chunk. Anything else fails the chunk.
+func execInsert(params *SqlParams, records []FlushRecord) (writeOutcome, error) {
+	if len(records) == 0 {
+		return writeOk, nil
+	}
+	if len(params.AggregateWindow) > 0 {
+		return aggregateRecords(params, records)
+	}
+	if len(params.TenantKey) > 0 {
+		return execTenantInsert(params, records)
+	}
+	return execInsertTo(params, records, nil)
+}
+
+// write the records to the database - if we're not given a connection pool to use then we use the instance's pool
+func execInsertTo(params *SqlParams, records []FlushRecord, pool *dbPool) (outcome writeOutcome, err error) {
+	tmpl, err := parseTableTemplate(params)
+	if err != nil {
+		log.Printf("[%s]%s table name error - %v", params.PluginName, params.InstanceName, err)
+		return writeFailed, err
+	}
+
+	records, unmatched, err := filterRecords(params, records)
+	if err != nil {
+		log.Printf("[%s]%s %s error - %v", params.PluginName, params.InstanceName, Plugin_WhereExpr, err)
+		return writeFailed, err
+	}
+
+	// records that didn't match the where_expression are dropped unless we have somewhere to put them
+	if len(unmatched) > 0 && len(params.UnmatchedTable) == 0 {
+		log.Printf("[%s]%s %d records did not match the %s and were dropped", params.PluginName, params.InstanceName, len(unmatched), Plugin_WhereExpr)
+		unmatched = nil
+	}
+	var hashes map[string][]string
+	if len(params.HashColumn) > 0 {
+		records, hashes = hashRecords(params, tmpl, records)
+	}
+	if len(records) == 0 && len(unmatched) == 0 {
+		return writeOk, nil
+	}
+
+	// while the database is unavailable we don't try it, the chunk is retried later
+	if pool == nil {
+		pool = getResources(params).pool
+	}
+	breaker := pool.circuitBreaker(params)
+	if err = breaker.allow(params); err != nil {
+		log.Printf("[%s]%s not writing %d records - %v", params.PluginName, params.InstanceName, len(records)+len(unmatched), err)
+		return writeRetry, err
+	}
+	defer func() { breaker.record(params, err) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), InsertTimeout*time.Duration(len(records)+len(unmatched)))
 	defer cancel()
 
-	db, err := sql.Open(params.DBType, buildConnectionStr(params))
+	db, err := pool.get(params)
+	if err != nil {
+		return chunkOutcome(params, err), err
+	}
+
+	var unrouted []FlushRecord
+	var unroutedErrs []error
+	if len(params.Dimensions) > 0 {
+		if records, unrouted, unroutedErrs, err = resolveDimensions(ctx, db, params, records); err != nil {
+			return chunkOutcome(params, err), err
+		}
+	}
+
+	groups, tableUnrouted, tableErrs := tmpl.groupRecords(params, records)
+	unrouted = append(unrouted, tableUnrouted...)
+	unroutedErrs = append(unroutedErrs, tableErrs...)
+
+	if len(unmatched) > 0 {
+		unmatchedParams := *params
+		unmatchedParams.TableName = params.UnmatchedTable
+		unmatchedTmpl, err := parseTableTemplate(&unmatchedParams)
+		if err != nil {
+			return writeFailed, err
+		}
+		unmatchedGroups, unmatchedUnrouted, unmatchedErrs := unmatchedTmpl.groupRecords(&unmatchedParams, unmatched)
+		// the unmatched records aren't hashed, so they are written without the hash column
+		for _, group := range unmatchedGroups {
+			group.unhashed = true
+		}
+		groups = append(groups, unmatchedGroups...)
+		unrouted = append(unrouted, unmatchedUnrouted...)
+		unroutedErrs = append(unroutedErrs, unmatchedErrs...)
+	}
+
+	// ClickHouse takes each table's records as a single block rather than a transaction of inserts
+	if params.DBType == clickhouseDBType {
+		for idx, recd := range unrouted {
+			handleRejectedRecord(ctx, nil, params, recd, unroutedErrs[idx])
+		}
+		rejected, err := writeClickHouseBlocks(ctx, db, params, groups)
+		if err != nil {
+			return chunkOutcome(params, err), err
+		}
+		rememberHashes(params, hashes)
+		if skipped := len(unrouted) + rejected; skipped > 0 {
+			log.Printf("[%s]%s %d of %d records rejected", params.PluginName, params.InstanceName, skipped, len(records)+len(unmatched))
+		}
+		return writeOk, nil
+	}
+
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return chunkOutcome(params, err), err
 	}
 	// Defer a rollback in case anything fails.
 	defer tx.Rollback()
+	stmts := newStatementCache(tx)
 
-	sqlStmt, err := buildInsertExpr(params, value)
-	if err == nil {
-		_, err := tx.ExecContext(ctx, sqlStmt)
-		fmt.Printf("[%s]%s insert expression: %s", params.PluginName, params.InstanceName, sqlStmt)
-		if err != nil {
-			log.Println("[%s]%s Error with insert %v", params.PluginName, params.InstanceName, err)
-			return err
+	if params.WriteMode == writeModeCDC && len(unrouted) > 0 {
+		err = recordContentError{unroutedErrs[0]}
+		return chunkOutcome(params, err), err
+	}
+	var skipped int = len(unrouted)
+	for idx, recd := range unrouted {
+		if err = handleRejectedRecord(ctx, tx, params, recd, unroutedErrs[idx]); err != nil {
+			return chunkOutcome(params, err), err
+		}
+	}
+
+	for _, group := range groups {
+		tableParams := *params
+		tableParams.TableName = group.tableName
+		if group.unhashed {
+			tableParams.HashColumn = ""
+		}
+		for _, recd := range group.records {
+			rejected, err := insertRecord(ctx, tx, stmts, &tableParams, recd)
+			if err != nil {
+				return chunkOutcome(params, err), err
+			}
+			if rejected {
+				skipped++
+			}
 		}
-	} else {
-		log.Println("[%s]%s SQL context error %v", params.PluginName, params.InstanceName, err)
 	}
-	//}
 
 	// Commit the transaction.
 	if err = tx.Commit(); err != nil {
+		return chunkOutcome(params, err), err
+	}
+	rememberHashes(params, hashes)
+
+	if skipped > 0 {
+		log.Printf("[%s]%s %d of %d records rejected", params.PluginName, params.InstanceName, skipped, len(records)+len(unmatched))
+	}
+	return writeOk, nil
+}
+
+// insert a single record within the transaction, isolated by a savepoint. If the database rejects the record
+// it is handed off to be dead-lettered and we report it as rejected. An error means the transaction can't continue
+func insertRecord(ctx context.Context, tx *sql.Tx, stmts *statementCache, params *SqlParams, recd FlushRecord) (bool, error) {
+	// if we've been told where the event time goes and the record doesn't have it, use the record timestamp
+	if len(params.TimeColumn) > 0 {
+		if _, found := recd.Record[params.TimeColumn]; !found {
+			recd.Record[params.TimeColumn] = recd.Timestamp
+		}
+	}
+
+	// the changes depend on those before them, so a rejected change isn't isolated and fails the chunk
+	if params.WriteMode == writeModeCDC {
+		return false, execChange(ctx, tx, params, recd.Record)
+	}
+
+	if err := setSavepoint(ctx, tx, params, recordSavepoint); err != nil {
+		return false, err
+	}
+
+	err := writeRecord(ctx, tx, stmts, params, recd)
+	if err != nil {
+		if classifyDBError(err) != errClassRecord {
+			return false, err
+		}
+
+		recordErr := err
+		if err = rollbackToSavepoint(ctx, tx, params, recordSavepoint); err != nil {
+			return false, err
+		}
+		if err = handleRejectedRecord(ctx, tx, params, recd, recordErr); err != nil {
+			return false, err
+		}
+		return true, releaseSavepoint(ctx, tx, params, recordSavepoint)
+	}
+
+	return false, releaseSavepoint(ctx, tx, params, recordSavepoint)
+}
+
+// execute the statements needed to write a single record
+func writeRecord(ctx context.Context, tx *sql.Tx, stmts *statementCache, params *SqlParams, recd FlushRecord) error {
+	if len(params.ChildTables) > 0 {
+		return insertWithChildren(ctx, tx, params, recd)
+	}
+	if params.WriteMode == writeModeStatement || params.WriteMode == writeModeProcedure {
+		stmt, err := stmts.boundStatement(params)
+		if err != nil {
+			return err
+		}
+		return stmts.exec(ctx, stmt.sql, stmt.args(recd.Record)...)
+	}
+
+	sqlStmt, args, err := buildRecordExpr(params, recd.Record)
+	if err != nil {
+		return recordContentError{err}
+	}
+	log.Printf("[%s]%s write expression: %s", params.PluginName, params.InstanceName, sqlStmt)
+	_, err = tx.ExecContext(ctx, sqlStmt, args...)
+	return err
+}
+
+// checks that only make sense for the output plugin, called after validateSqlParams
+func validateOutputParams(params *SqlParams) error {
+	if err := validateWriteMode(params); err != nil {
+		return err
+	}
+	if err := validateChildTables(params); err != nil {
+		return err
+	}
+	if err := validateDimensions(params); err != nil {
+		return err
+	}
+	if err := validateAggregateParams(params); err != nil {
+		return err
+	}
+	if err := validateHashParams(params); err != nil {
+		return err
+	}
+	if err := validateSpoolParams(params); err != nil {
+		return err
+	}
+	if err := validateClickHouseParams(params); err != nil {
 		return err
 	}
 
-	return nil
+	// make sure any table name template can be parsed, and the regex compiled, so we fail at startup rather than on each flush
+	if _, err := parseTableTemplate(params); err != nil {
+		return err
+	}
+	if len(params.UnmatchedTable) > 0 {
+		unmatchedParams := *params
+		unmatchedParams.TableName = params.UnmatchedTable
+		if _, err := parseTableTemplate(&unmatchedParams); err != nil {
+			return errors.New(Plugin_UnmatchedTable + " - " + err.Error())
+		}
+	}
+
+	// for the output the where_expression is a filter on the records rather than SQL
+	if len(strings.TrimSpace(params.WhereExpr)) > 0 {
+		if _, err := parsePredicate(params.WhereExpr); err != nil {
+			return err
+		}
+	} else if len(params.UnmatchedTable) > 0 {
+		log.Printf("[%s]%s %s has no effect without a %s", params.PluginName, params.InstanceName, Plugin_UnmatchedTable, Plugin_WhereExpr)
+	}
+
+	params.TimeColumn = strings.TrimSpace(params.TimeColumn)
+	for _, durationStr := range []string{params.Retention, params.PartitionCheck, params.RetentionCheck} {
+		if _, err := parseDurationStr(durationStr); err != nil {
+			return err
+		}
+	}
+	if err := validatePartitionParams(params); err != nil {
+		return err
+	}
+	if err := validateRetentionParams(params); err != nil {
+		return err
+	}
+	return validateTenantParams(params)
 }
 
 // without resorting to a full query validate that the conection details will work.
 func testConnectionOk(params *SqlParams) bool {
-	db, err := sql.Open(params.DBType, buildConnectionStr(params))
+	db, err := getDB(params)
 
 	if db == nil {
 		log.Printf("[%s]%s connection test failed for\n%s\n%v", params.PluginName, params.InstanceName, SprintfParams(params, params.PluginName), err)
@@ -496,7 +1090,6 @@ func testConnectionOk(params *SqlParams) bool {
 	}
 
 	if err = db.Ping(); err != nil {
-		db.Close()
 		log.Printf("[%s]%s connection test ping failed for\n%s\n%v", params.PluginName, params.InstanceName, SprintfParams(params, params.PluginName), err)
 		return false
 	}
@@ -515,7 +1108,7 @@ func checkForData(db *sql.DB, sqlExpr string) (bool, error) {
 		if err == sql.ErrNoRows {
 			return false, fmt.Errorf("Unexpected no rows response on execDataCheck")
 		}
-		return false, fmt.Errorf("Unexpected err in execDataCheck %v", err)
+		return false, fmt.Errorf("Unexpected err in execDataCheck %w", err)
 	}
 	return count > 0, nil
 }
@@ -523,7 +1116,7 @@ func checkForData(db *sql.DB, sqlExpr string) (bool, error) {
 // Executes the SQL statement and dynamically resolves the number of columns that maybe retrieved
 // based on https://kylewbanks.com/blog/query-result-to-map-in-golang
 // func execQuery(sqlExpr string, sequencerCol string, db *sql.DB) (map[string]interface{}, string, error) {
-func execQuery(sqlExpr string, sequencerCol string, pk string, db *sql.DB) ([]interface{}, []interface{}, string, error) {
+func execQuery(sqlExpr string, sequencerCol string, pk string, dialect sqlDialect, db *sql.DB) ([]interface{}, []interface{}, string, error) {
 
 	dbRows, err := db.Query(sqlExpr)
 	if err != nil {
@@ -542,6 +1135,15 @@ func execQuery(sqlExpr string, sequencerCol string, pk string, db *sql.DB) ([]in
 		log.Printf("execQuery - error during retrieval of columns: %s", err)
 		return nil, nil, "", err
 	}
+	// some drivers give values that the dialect maps into the record's types, using the column's database type
+	mapper, mapsValues := dialect.(recordValueMapper)
+	var colTypes []*sql.ColumnType
+	if mapsValues {
+		if colTypes, err = dbRows.ColumnTypes(); err != nil {
+			log.Printf("execQuery - error during retrieval of column types: %s", err)
+			return nil, nil, "", err
+		}
+	}
 
 	var myData []interface{} = nil
 	var myKeys []interface{} = nil
@@ -583,7 +1185,13 @@ func execQuery(sqlExpr string, sequencerCol string, pk string, db *sql.DB) ([]in
 		// storing it in the map with the name of the column as the key.
 		for i, colName := range colNames {
 			val := columnPointers[i].(*interface{})
-			*val = typeToStr(*val, false)
+			mapped := false
+			if mapsValues && *val != nil {
+				*val, mapped = mapper.recordValue(colTypes[i], *val)
+			}
+			if !mapped {
+				*val = typeToStr(*val, false)
+			}
 			if colName == sequencerCol {
 				lastSequenceValue = val
 			}
@@ -626,17 +1234,24 @@ func execQuery(sqlExpr string, sequencerCol string, pk string, db *sql.DB) ([]in
 // builds the relevant connections and executes the query
 // it then translates the resultant structure to a JSON output
 func dynamicQuery(params *SqlParams) ([]interface{}, string) {
-	db, err := sql.Open(params.DBType, buildConnectionStr(params))
+	breaker := getBreaker(params)
+	if err := breaker.allow(params); err != nil {
+		log.Printf("[%s]%s skipping query - %v", params.PluginName, params.InstanceName, err)
+		return nil, params.LatestSequencerId
+	}
+
+	db, err := getDB(params)
 	if err != nil {
 		log.Printf("gdb - dynamicQuery - received an error during open, about to panic\n%v", err)
 		panic(err.Error())
 	}
-	defer db.Close()
 
 	hasData, err := checkForData(db, buildQueryExpr(params, true))
+	breaker.record(params, err)
 	if err == nil && hasData {
 
-		result, keyList, lastSeqId, err := execQuery(buildQueryExpr(params, false), params.SequencerCol, params.PK, db)
+		result, keyList, lastSeqId, err := execQuery(buildQueryExpr(params, false), params.SequencerCol, params.PK, getDialect(params), db)
+		breaker.record(params, err)
 		if err != nil {
 			log.Printf("dynamicQuery - received an error from execQuery about to panic")
 			panic(err)
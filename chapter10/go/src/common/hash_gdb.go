@@ -0,0 +1,140 @@
+package main
+
+// Fluent Bit retries a chunk if we report a retryable failure, which can mean records that were written the first
+// time are written again. Setting hash_column writes a hash of each record's tag, timestamp and content into that
+// column so the duplicates can be recognised. How they are recognised depends on hash_dedup:
+//   conflict - the default, the column has a unique index and the insert ignores a conflict on it
+//   memory   - for tables without a unique index, we remember the last hash_cache_size hashes written and skip
+//              any record we've already seen. This only protects against retries within the life of the process
+// The hash is calculated on the record as Fluent Bit gives it to us, so dimensions and the time_column don't change it.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const hashDedupConflict = "conflict"
+const hashDedupMemory = "memory"
+const defaultHashCacheSize = 100000
+
+// returned when the insert was ignored because the record has already been written
+var errDuplicateRecord = errors.New("record already written")
+
+// check the hash settings, applying the defaults
+func validateHashParams(params *SqlParams) error {
+	params.HashColumn = strings.TrimSpace(params.HashColumn)
+	if len(params.HashColumn) == 0 {
+		return nil
+	}
+	if !regexp.MustCompile(defaultTableRegex).MatchString(params.HashColumn) {
+		return errors.New(Plugin_HashColumn + " " + params.HashColumn + " isn't a valid column name")
+	}
+	if params.WriteMode != writeModeInsert {
+		return errors.New(Plugin_HashColumn + " can't be used with the " + params.WriteMode + " " + Plugin_WriteMode)
+	}
+
+	params.HashDedup = strings.ToLower(strings.TrimSpace(params.HashDedup))
+	switch params.HashDedup {
+	case "":
+		params.HashDedup = hashDedupConflict
+	case hashDedupConflict, hashDedupMemory:
+	default:
+		return errors.New("Unknown " + Plugin_HashDedup + " " + params.HashDedup + " for " + params.PluginName)
+	}
+	if params.HashCache <= 0 {
+		params.HashCache = defaultHashCacheSize
+	}
+	return nil
+}
+
+// a stable hash of the record - the JSON encoder sorts the map keys, so the same content always gives the same text
+func recordHash(recd FlushRecord) string {
+	recordJSON, err := json.Marshal(normalizeForJSON(recd.Record))
+	if err != nil {
+		recordJSON = []byte(typeToStr(recd.Record, false))
+	}
+	hash := sha256.New()
+	hash.Write([]byte(recd.Tag))
+	hash.Write([]byte{0})
+	hash.Write([]byte(recd.Timestamp.UTC().Format(time.RFC3339Nano)))
+	hash.Write([]byte{0})
+	hash.Write(recordJSON)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// the hashes already written to each table, shared by the instances writing to the same table
+var seenHashMutex sync.Mutex
+var seenHashes = make(map[string]*lruCache)
+
+func getSeenHashes(params *SqlParams, tableName string) *lruCache {
+	key := databaseKey(params) + "/" + tableName
+	cache, found := seenHashes[key]
+	if !found {
+		cache = newLRUCache(params.HashCache)
+		seenHashes[key] = cache
+	}
+	return cache
+}
+
+// add the hash column to copies of the records. When deduplicating in memory, the records we've already written
+// to the table they resolve to (or that appear earlier in the same chunk) are left out. The hashes of the records
+// returned, by table, need to be remembered once they have been committed
+func hashRecords(params *SqlParams, tmpl *tableTemplate, records []FlushRecord) ([]FlushRecord, map[string][]string) {
+	var hashed []FlushRecord
+	hashes := make(map[string][]string)
+	inChunk := make(map[string]bool)
+	duplicates := 0
+
+	seenHashMutex.Lock()
+	defer seenHashMutex.Unlock()
+	for _, recd := range records {
+		hash := recordHash(recd)
+		// a record we can't resolve a table for is rejected when the records are grouped
+		tableName, err := tmpl.resolve(params, recd)
+		if err != nil {
+			tableName = params.TableName
+		}
+		if params.HashDedup == hashDedupMemory {
+			if _, seen := getSeenHashes(params, tableName).get(hash); seen || inChunk[tableName+"/"+hash] {
+				duplicates++
+				continue
+			}
+			inChunk[tableName+"/"+hash] = true
+		}
+
+		values := make(RowDefinition, len(recd.Record)+1)
+		for key, val := range recd.Record {
+			values[key] = val
+		}
+		values[params.HashColumn] = hash
+		hashed = append(hashed, FlushRecord{Tag: recd.Tag, Timestamp: recd.Timestamp, Record: values})
+		hashes[tableName] = append(hashes[tableName], hash)
+	}
+
+	if duplicates > 0 {
+		log.Printf("[%s]%s skipped %d records that have already been written", params.PluginName, params.InstanceName, duplicates)
+	}
+	return hashed, hashes
+}
+
+// remember the hashes of the records that have been committed to each table
+func rememberHashes(params *SqlParams, hashes map[string][]string) {
+	if params.HashDedup != hashDedupMemory {
+		return
+	}
+	seenHashMutex.Lock()
+	defer seenHashMutex.Unlock()
+	for tableName, tableHashes := range hashes {
+		cache := getSeenHashes(params, tableName)
+		for _, hash := range tableHashes {
+			cache.put(hash, true)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordHashStable(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 500, time.UTC)
+	base := FlushRecord{Tag: "app.web", Timestamp: at, Record: RowDefinition{
+		"level": "error",
+		"n":     int64(3),
+		"k8s":   map[interface{}]interface{}{"pod": "web-1", "labels": []interface{}{"a", "b"}},
+	}}
+	hash := recordHash(base)
+
+	// the hashes are written to the database, so they must not change between releases. This is the SHA-256 of
+	// app.web, the RFC 3339 time and {"k8s":{"labels":["a","b"],"pod":"web-1"},"level":"error","n":3}, separated by NULs
+	const expected = "545ccc121ab33af2b3274aba36004f9470935b7da25c2a53051999dfce2817f2"
+	if hash != expected {
+		t.Errorf("got %s, expected %s", hash, expected)
+	}
+
+	same := []FlushRecord{
+		// the same content built in a different order, with the strings as Fluent Bit's byte slices
+		{Tag: "app.web", Timestamp: at, Record: RowDefinition{
+			"k8s":   map[interface{}]interface{}{"labels": []interface{}{[]byte("a"), "b"}, "pod": []byte("web-1")},
+			"n":     int64(3),
+			"level": []byte("error"),
+		}},
+		// the same instant in another time zone
+		{Tag: "app.web", Timestamp: at.In(time.FixedZone("EST", -5*3600)), Record: base.Record},
+	}
+	for idx, recd := range same {
+		if got := recordHash(recd); got != hash {
+			t.Errorf("record %d: got %s, expected the same hash %s", idx, got, hash)
+		}
+	}
+
+	different := []FlushRecord{
+		{Tag: "app.db", Timestamp: at, Record: base.Record},
+		{Tag: "app.web", Timestamp: at.Add(time.Nanosecond), Record: base.Record},
+		{Tag: "app.web", Timestamp: at, Record: RowDefinition{"level": "error", "n": int64(4),
+			"k8s": map[interface{}]interface{}{"pod": "web-1", "labels": []interface{}{"a", "b"}}}},
+		{Tag: "app.web", Timestamp: at, Record: RowDefinition{"level": "error", "n": int64(3),
+			"k8s": map[interface{}]interface{}{"pod": "web-1", "labels": []interface{}{"b", "a"}}}},
+	}
+	for idx, recd := range different {
+		if got := recordHash(recd); got == hash {
+			t.Errorf("record %d: got the same hash as the base record", idx)
+		}
+	}
+}
+
+func TestHashRecordsMemoryDedup(t *testing.T) {
+	params := &SqlParams{DBType: PostgresDBType, Host: "hash-test", TableName: "logs_${tag[1]}", HashColumn: "record_hash",
+		HashDedup: hashDedupMemory, HashCache: 10}
+	tmpl, err := parseTableTemplate(params)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	web := FlushRecord{Tag: "app.web", Timestamp: at, Record: RowDefinition{"msg": "x"}}
+	db := FlushRecord{Tag: "app.db", Timestamp: at, Record: RowDefinition{"msg": "x"}}
+
+	hashed, hashes := hashRecords(params, tmpl, []FlushRecord{web, web, db})
+	if len(hashed) != 2 || len(hashes["logs_web"]) != 1 || len(hashes["logs_db"]) != 1 {
+		t.Fatalf("got %d records and hashes %v, expected the duplicate within the chunk left out", len(hashed), hashes)
+	}
+	if hashed[0].Record["record_hash"] != recordHash(web) {
+		t.Errorf("got hash column %v, expected %s", hashed[0].Record["record_hash"], recordHash(web))
+	}
+	if _, found := web.Record["record_hash"]; found {
+		t.Errorf("the hash column was added to the original record")
+	}
+
+	// once committed, the records are skipped - but only for the table they were written to
+	rememberHashes(params, map[string][]string{"logs_web": hashes["logs_web"]})
+	hashed, _ = hashRecords(params, tmpl, []FlushRecord{web, db})
+	if len(hashed) != 1 || hashed[0].Tag != "app.db" {
+		t.Errorf("got %v, expected only the record for logs_db", hashed)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	cache := newLRUCache(2)
+	cache.put("a", 1)
+	cache.put("b", 2)
+	cache.get("a")
+	cache.put("c", 3)
+	if _, found := cache.get("b"); found {
+		t.Errorf("b should have been evicted as the least recently used")
+	}
+	for key, expected := range map[string]int{"a": 1, "c": 3} {
+		if val, found := cache.get(key); !found || val != expected {
+			t.Errorf("%s: got %v %t, expected %d", key, val, found, expected)
+		}
+	}
+	cache.remove("a")
+	cache.remove("missing")
+	if _, found := cache.get("a"); found || cache.order.Len() != 1 {
+		t.Errorf("a should have been removed, leaving one entry not %d", cache.order.Len())
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+// A simple least recently used cache, used where we need to remember things about the database (such as the ids of
+// dimension values, or the records already written) without the memory growing forever
+
+import (
+	"container/list"
+)
+
+type lruCache struct {
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{capacity: capacity, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (cache *lruCache) get(key string) (interface{}, bool) {
+	element, found := cache.entries[key]
+	if !found {
+		return nil, false
+	}
+	cache.order.MoveToFront(element)
+	return element.Value.(*lruEntry).value, true
+}
+
+// add or update the entry, removing the least recently used entries if we're over capacity
+func (cache *lruCache) put(key string, value interface{}) {
+	if element, found := cache.entries[key]; found {
+		element.Value.(*lruEntry).value = value
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[key] = cache.order.PushFront(&lruEntry{key: key, value: value})
+	for cache.order.Len() > cache.capacity {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (cache *lruCache) remove(key string) {
+	if element, found := cache.entries[key]; found {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+	}
+}
+
+// the key for caches that hold details of a database, so the instances writing to the same database share them
+func databaseKey(params *SqlParams) string {
+	if len(params.DSN) > 0 {
+		return params.DBType + "/" + params.DSN
+	}
+	return params.DBType + "/" + params.Host + ":" + params.Port + "/" + params.DBName
+}
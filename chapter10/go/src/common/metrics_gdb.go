@@ -0,0 +1,113 @@
+package main
+
+// Simple counters so we can report on what the plugin is doing. The Go plugin API doesn't give us access to
+// Fluent Bit's own metrics, so the counters are logged and can optionally be served in the Prometheus text
+// format on the address given by metrics_listen (e.g. 0.0.0.0:2021). As the in and out plugins are separate
+// libraries, they each need their own address.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricPrefix = "gdb_"
+const metricsShutdownTimeout = 5 * time.Second
+
+var metricsMutex sync.Mutex
+var metricsCounters = make(map[string]int64)
+var metricsServerAddr string = ""
+
+// build the key for a counter - which is the metric name with the labels in the Prometheus form
+func metricKey(params *SqlParams, name string, labels map[string]string) string {
+	labelStrs := []string{"plugin=\"" + params.PluginName + "\"", "instance=\"" + params.InstanceName + "\""}
+	var labelNames []string
+	for labelName := range labels {
+		labelNames = append(labelNames, labelName)
+	}
+	sort.Strings(labelNames)
+	for _, labelName := range labelNames {
+		labelStrs = append(labelStrs, labelName+"=\""+strings.ReplaceAll(labels[labelName], "\"", "'")+"\"")
+	}
+	return metricPrefix + name + "{" + strings.Join(labelStrs, ",") + "}"
+}
+
+// add to a counter, returning the new total
+func incrementMetric(params *SqlParams, name string, labels map[string]string, delta int64) int64 {
+	key := metricKey(params, name, labels)
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	metricsCounters[key] = metricsCounters[key] + delta
+	return metricsCounters[key]
+}
+
+// write all the counters in the Prometheus text format
+func metricsHandler(writer http.ResponseWriter, request *http.Request) {
+	metricsMutex.Lock()
+	var keys []string
+	for key := range metricsCounters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var body strings.Builder
+	for _, key := range keys {
+		body.WriteString(fmt.Sprintf("%s %d\n", key, metricsCounters[key]))
+	}
+	metricsMutex.Unlock()
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writer.Write([]byte(body.String()))
+}
+
+// start serving the metrics if an address has been configured. There is only one server per plugin library
+// so if several instances ask for it, the first address is used. The server is held with the resources of the
+// instance that started it, so it is shut down when that instance exits, freeing the address for a reload
+func startMetricsServer(params *SqlParams) {
+	if len(params.MetricsListen) == 0 {
+		return
+	}
+
+	metricsMutex.Lock()
+	if len(metricsServerAddr) > 0 {
+		if metricsServerAddr != params.MetricsListen {
+			log.Printf("[%s]%s metrics are already being served on %s, ignoring %s", params.PluginName, params.InstanceName, metricsServerAddr, params.MetricsListen)
+		}
+		metricsMutex.Unlock()
+		return
+	}
+	metricsServerAddr = params.MetricsListen
+	metricsMutex.Unlock()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	server := &http.Server{Addr: params.MetricsListen, Handler: mux}
+	go func() {
+		log.Printf("[%s]%s serving metrics on %s/metrics", params.PluginName, params.InstanceName, server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("[%s]%s metrics server stopped - %v", params.PluginName, params.InstanceName, err)
+		}
+	}()
+
+	resources := getResources(params)
+	resourcesMutex.Lock()
+	resources.metrics = server
+	resourcesMutex.Unlock()
+}
+
+// shut down the metrics server, waiting a short while for any scrape in progress
+func stopMetricsServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("error shutting down metrics server on %s - %v", server.Addr, err)
+	}
+
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	metricsServerAddr = ""
+}
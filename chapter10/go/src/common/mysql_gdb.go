@@ -0,0 +1,194 @@
+package main
+
+// the dialect for MySQL (and MariaDB), using the go-sql-driver/mysql driver
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+type mysqlDialect struct {
+	standardSavepoints
+}
+
+// MySQL server error numbers - see https://dev.mysql.com/doc/mysql-errors/8.0/en/server-error-reference.html
+var mysqlRetryErrors = map[uint16]bool{
+	1040: true, // too many connections
+	1053: true, // server shutdown in progress
+	1205: true, // lock wait timeout
+	1213: true, // deadlock
+	1927: true, // connection killed
+	3024: true, // query execution interrupted, maximum statement execution time exceeded
+}
+var mysqlRecordErrors = map[uint16]bool{
+	1048: true, // column cannot be null
+	1062: true, // duplicate entry
+	1264: true, // out of range value
+	1265: true, // data truncated
+	1292: true, // incorrect date/time value
+	1364: true, // field doesn't have a default value
+	1366: true, // incorrect value for column
+	1406: true, // data too long
+	1451: true, // foreign key constraint - parent row
+	1452: true, // foreign key constraint - child row
+	1526: true, // no partition for the value
+	3819: true, // check constraint violated
+	4025: true, // MariaDB constraint failed
+}
+var mysqlAuthErrors = map[uint16]bool{
+	1045: true, // access denied for the user
+	1698: true, // access denied, no password given
+	1862: true, // password expired
+}
+
+// each bulk load registers its rows with the driver under a unique name
+var bulkLoadCounter int64 = 0
+
+func (mysqlDialect) usesServer() bool {
+	return true
+}
+
+// the driver finds the password using the last @, so it can hold any character. The options are escaped as the
+// driver expects. With TLS on, the connection string names the TLS configuration registered when the pool is opened
+func (mysqlDialect) connectionStr(params *SqlParams) string {
+	connStr := fmt.Sprintf("%s:%s@tcp(%s)/%s", params.User, params.Password, net.JoinHostPort(params.Host, params.Port), params.DBName)
+	var options []string
+	if tlsEnabled(params) {
+		options = append(options, "tls="+tlsConfigName(params))
+	}
+	for _, option := range driverOptions(params) {
+		options = append(options, url.QueryEscape(option[0])+"="+url.QueryEscape(option[1]))
+	}
+	if len(options) == 0 {
+		return connStr
+	}
+	return connStr + "?" + strings.Join(options, "&")
+}
+
+func (mysqlDialect) registerTLS(name string, config *tls.Config) error {
+	return mysql.RegisterTLSConfig(name, config)
+}
+
+func (mysqlDialect) quoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// MySQL uses question marks for every bind variable
+func (mysqlDialect) bindVar(idx int) string {
+	return "?"
+}
+
+func (mysqlDialect) limitQuery(sqlStmt string, limit int, offset int) string {
+	sqlStmt = sqlStmt + " LIMIT " + strconv.Itoa(limit)
+	if offset > 0 {
+		sqlStmt = sqlStmt + " OFFSET " + strconv.Itoa(offset)
+	}
+	return sqlStmt
+}
+
+func (dialect mysqlDialect) insertExpr(table string, cols []string, rowCount int) string {
+	rows := make([]string, rowCount)
+	for idx := range rows {
+		rows[idx] = "(" + strings.Join(rowPlaceholders(dialect, idx*len(cols)+1, len(cols)), ",") + ")"
+	}
+	return "INSERT INTO " + table + " (" + strings.Join(cols, ",") + ") VALUES " + strings.Join(rows, ",")
+}
+
+// MySQL works out the conflict from the table's unique keys, so the conflict columns are only needed to give a
+// no-op update when we want the existing row left alone
+func (dialect mysqlDialect) upsertExpr(table string, cols []string, conflictCols []string, updates func(existing, incoming func(string) string) []string) string {
+	var assignments []string
+	if updates != nil {
+		assignments = updates(func(col string) string { return col }, func(col string) string { return "VALUES(" + col + ")" })
+	}
+	if len(assignments) == 0 {
+		assignments = []string{conflictCols[0] + " = " + conflictCols[0]}
+	}
+	return dialect.insertExpr(table, cols, 1) + " ON DUPLICATE KEY UPDATE " + strings.Join(assignments, ", ")
+}
+
+// an upsert that leaves the existing row alone reports no rows affected
+func (mysqlDialect) insertReturningId(ctx context.Context, conn dbConn, sqlStmt string, args []interface{}, keyCol string) (interface{}, error) {
+	result, err := conn.ExecContext(ctx, sqlStmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		return nil, nil
+	}
+	return result.LastInsertId()
+}
+
+// use LOAD DATA, streaming the rows to the server as tab separated text. The server needs local_infile enabled
+func (mysqlDialect) bulkLoad(ctx context.Context, tx *sql.Tx, table string, cols []string, rows [][]interface{}) error {
+	var content strings.Builder
+	for _, row := range rows {
+		for idx, val := range row {
+			if idx > 0 {
+				content.WriteByte('\t')
+			}
+			content.WriteString(mysqlLoadValue(val))
+		}
+		content.WriteByte('\n')
+	}
+
+	readerName := "gdb_bulk_" + strconv.FormatInt(atomic.AddInt64(&bulkLoadCounter, 1), 10)
+	mysql.RegisterReaderHandler(readerName, func() io.Reader { return strings.NewReader(content.String()) })
+	defer mysql.DeregisterReaderHandler(readerName)
+
+	_, err := tx.ExecContext(ctx, "LOAD DATA LOCAL INFILE 'Reader::"+readerName+"' INTO TABLE "+table+
+		" FIELDS TERMINATED BY '\\t' ESCAPED BY '\\\\' LINES TERMINATED BY '\\n' ("+strings.Join(cols, ",")+")")
+	return err
+}
+
+// the text for a value in the LOAD DATA format, with NULL as \N and the separators escaped
+func mysqlLoadValue(val interface{}) string {
+	var text string
+	switch typedVal := val.(type) {
+	case nil:
+		return "\\N"
+	case time.Time:
+		text = typedVal.UTC().Format("2006-01-02 15:04:05.999999")
+	case []byte:
+		text = string(typedVal)
+	case bool:
+		text = "0"
+		if typedVal {
+			text = "1"
+		}
+	default:
+		text = typeToStr(typedVal, false)
+	}
+	return strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r").Replace(text)
+}
+
+func (mysqlDialect) classifyError(err error) (dbErrorClass, bool) {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return errClassNone, false
+	}
+	if mysqlRetryErrors[mysqlErr.Number] {
+		return errClassRetry, true
+	}
+	if mysqlRecordErrors[mysqlErr.Number] {
+		return errClassRecord, true
+	}
+	return errClassFatal, true
+}
+
+func (mysqlDialect) authFailed(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlAuthErrors[mysqlErr.Number]
+}
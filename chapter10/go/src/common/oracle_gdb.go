@@ -0,0 +1,258 @@
+package main
+
+// the dialect for Oracle, using the sijms/go-ora driver which is pure Go, so no Instant Client is needed. The
+// db_name is the service name. Oracle numbers its bind variables :1, :2 and so on, limits queries with
+// FETCH FIRST, writes upserts as a MERGE, and has no statement to release a savepoint. The driver returns
+// NUMBER columns as text, so the input maps them (and the dates and timestamps) into record types.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	go_ora "github.com/sijms/go-ora/v2"
+	"github.com/sijms/go-ora/v2/network"
+)
+
+type oracleDialect struct{}
+
+// Oracle error numbers (ORA-nnnnn) - see https://docs.oracle.com/en/error-help/db/
+var oracleRetryErrors = map[int]bool{
+	51:    true, // timeout waiting for a resource
+	54:    true, // resource busy
+	60:    true, // deadlock detected
+	1033:  true, // initialization or shutdown in progress
+	1034:  true, // Oracle not available
+	1089:  true, // immediate shutdown in progress
+	3113:  true, // end-of-file on communication channel
+	3114:  true, // not connected to Oracle
+	3135:  true, // connection lost contact
+	8177:  true, // can't serialize access for this transaction
+	12170: true, // connect timeout
+	12514: true, // listener doesn't know of the service - e.g. the database is still starting
+	12516: true, // listener could not find an available handler
+	12519: true, // no appropriate service handler found
+	12520: true, // listener could not find an available handler for the server type
+	12528: true, // all instances are blocking new connections
+	12537: true, // connection closed
+	12541: true, // no listener
+	25408: true, // can't safely replay the call
+}
+var oracleRecordErrors = map[int]bool{
+	1:     true, // unique constraint violated
+	1400:  true, // cannot insert NULL
+	1407:  true, // cannot update to NULL
+	1438:  true, // value larger than the column's precision
+	1722:  true, // invalid number
+	1830:  true, // date format picture ends before converting the entire input
+	1840:  true, // input value not long enough for the date format
+	1841:  true, // year out of range
+	1843:  true, // not a valid month
+	1847:  true, // day of month out of range
+	1858:  true, // a non-numeric character found where a numeric was expected
+	1861:  true, // literal does not match the format string
+	2290:  true, // check constraint violated
+	2291:  true, // parent key not found
+	12899: true, // value too large for the column
+}
+var oracleAuthErrors = map[int]bool{
+	1005:  true, // null password given
+	1017:  true, // invalid username or password
+	28001: true, // password expired
+}
+
+func (oracleDialect) usesServer() bool {
+	return true
+}
+
+// the driver builds the URL, escaping the user, password and service name. With TLS the server's certificate
+// is verified against the system's CA certificates, as the driver otherwise expects an Oracle wallet
+func (oracleDialect) connectionStr(params *SqlParams) string {
+	port, _ := strconv.Atoi(params.Port)
+	options := make(map[string]string)
+	if tlsEnabled(params) {
+		options["SSL"] = "true"
+		options["SSL VERIFY"] = strconv.FormatBool(tlsVerify(params))
+	}
+	for _, option := range driverOptions(params) {
+		options[option[0]] = option[1]
+	}
+	if len(options) == 0 {
+		options = nil
+	}
+	return go_ora.BuildUrl(params.Host, port, params.DBName, params.User, params.Password, options)
+}
+
+func (oracleDialect) quoteIdent(name string) string {
+	return "\"" + strings.ReplaceAll(name, "\"", "\"\"") + "\""
+}
+
+func (oracleDialect) bindVar(idx int) string {
+	return ":" + strconv.Itoa(idx)
+}
+
+func (oracleDialect) limitQuery(sqlStmt string, limit int, offset int) string {
+	if offset > 0 {
+		return sqlStmt + " OFFSET " + strconv.Itoa(offset) + " ROWS FETCH NEXT " + strconv.Itoa(limit) + " ROWS ONLY"
+	}
+	return sqlStmt + " FETCH FIRST " + strconv.Itoa(limit) + " ROWS ONLY"
+}
+
+// Oracle doesn't accept several rows in the VALUES, so more than one row uses INSERT ALL
+func (dialect oracleDialect) insertExpr(table string, cols []string, rowCount int) string {
+	colList := " (" + strings.Join(cols, ",") + ") VALUES "
+	if rowCount == 1 {
+		return "INSERT INTO " + table + colList + "(" + strings.Join(rowPlaceholders(dialect, 1, len(cols)), ",") + ")"
+	}
+	var sqlStmt strings.Builder
+	sqlStmt.WriteString("INSERT ALL")
+	for idx := 0; idx < rowCount; idx++ {
+		sqlStmt.WriteString(" INTO " + table + colList + "(" + strings.Join(rowPlaceholders(dialect, idx*len(cols)+1, len(cols)), ",") + ")")
+	}
+	sqlStmt.WriteString(" SELECT 1 FROM DUAL")
+	return sqlStmt.String()
+}
+
+// a MERGE of the incoming row, selected from DUAL, into the table matching rows on the conflict columns
+func (dialect oracleDialect) upsertExpr(table string, cols []string, conflictCols []string, updates func(existing, incoming func(string) string) []string) string {
+	existing := func(col string) string { return "existing." + col }
+	incoming := func(col string) string { return "incoming." + col }
+
+	selected := make([]string, len(cols))
+	incomingCols := make([]string, len(cols))
+	for idx, col := range cols {
+		selected[idx] = dialect.bindVar(idx+1) + " AS " + col
+		incomingCols[idx] = incoming(col)
+	}
+	matches := make([]string, len(conflictCols))
+	for idx, col := range conflictCols {
+		matches[idx] = existing(col) + " = " + incoming(col)
+	}
+
+	sqlStmt := "MERGE INTO " + table + " existing USING (SELECT " + strings.Join(selected, ", ") + " FROM DUAL) incoming ON (" +
+		strings.Join(matches, " AND ") + ")"
+	if updates != nil {
+		if assignments := updates(existing, incoming); len(assignments) > 0 {
+			sqlStmt = sqlStmt + " WHEN MATCHED THEN UPDATE SET " + strings.Join(assignments, ", ")
+		}
+	}
+	return sqlStmt + " WHEN NOT MATCHED THEN INSERT (" + strings.Join(cols, ",") + ") VALUES (" + strings.Join(incomingCols, ",") + ")"
+}
+
+// an insert returns the generated key into an out bind variable. A MERGE can't return anything, so when it
+// adds a row we select the key of the row matching the incoming values, using the MERGE's own ON condition
+func (dialect oracleDialect) insertReturningId(ctx context.Context, conn dbConn, sqlStmt string, args []interface{}, keyCol string) (interface{}, error) {
+	if !strings.HasPrefix(sqlStmt, "MERGE ") {
+		var id int64
+		returningArgs := append(append([]interface{}{}, args...), sql.Out{Dest: &id})
+		_, err := conn.ExecContext(ctx, sqlStmt+" RETURNING "+keyCol+" INTO "+dialect.bindVar(len(returningArgs)), returningArgs...)
+		if err != nil {
+			return nil, err
+		}
+		return id, nil
+	}
+
+	result, err := conn.ExecContext(ctx, sqlStmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		return nil, nil
+	}
+	var id interface{}
+	err = conn.QueryRowContext(ctx, oracleMergedRowQuery(sqlStmt, keyCol), args...).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return oracleNumber(id), nil
+}
+
+// turn the MERGE built by upsertExpr into a query for the key of the row it matches
+func oracleMergedRowQuery(mergeStmt string, keyCol string) string {
+	target := strings.TrimPrefix(mergeStmt[:strings.Index(mergeStmt, " USING (")], "MERGE INTO ")
+	source := mergeStmt[strings.Index(mergeStmt, " USING (")+len(" USING ("):]
+	source = source[:strings.Index(source, ") incoming ON (")]
+	condition := mergeStmt[strings.Index(mergeStmt, ") incoming ON (")+len(") incoming ON ("):]
+	condition = condition[:strings.Index(condition, ") WHEN ")]
+	return "SELECT existing." + keyCol + " FROM " + target + ", (" + source + ") incoming WHERE " + condition
+}
+
+func (oracleDialect) savepoint(name string) string {
+	return "SAVEPOINT " + name
+}
+
+func (oracleDialect) rollbackToSavepoint(name string) string {
+	return "ROLLBACK TO SAVEPOINT " + name
+}
+
+func (oracleDialect) releaseSavepoint(name string) string {
+	return ""
+}
+
+// a prepared insert within the transaction, as the driver's array binding needs the values typed by column
+func (dialect oracleDialect) bulkLoad(ctx context.Context, tx *sql.Tx, table string, cols []string, rows [][]interface{}) error {
+	stmt, err := tx.PrepareContext(ctx, dialect.insertExpr(table, cols, 1))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		if _, err = stmt.ExecContext(ctx, row...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (oracleDialect) classifyError(err error) (dbErrorClass, bool) {
+	var oraErr *network.OracleError
+	if !errors.As(err, &oraErr) {
+		return errClassNone, false
+	}
+	if oracleRetryErrors[oraErr.ErrCode] {
+		return errClassRetry, true
+	}
+	if oracleRecordErrors[oraErr.ErrCode] {
+		return errClassRecord, true
+	}
+	return errClassFatal, true
+}
+
+func (oracleDialect) authFailed(err error) bool {
+	var oraErr *network.OracleError
+	return errors.As(err, &oraErr) && oracleAuthErrors[oraErr.ErrCode]
+}
+
+// NUMBER columns become integers or floats, and the dates and timestamps RFC 3339 text that keeps the time zone
+func (oracleDialect) recordValue(colType *sql.ColumnType, val interface{}) (interface{}, bool) {
+	switch typedVal := val.(type) {
+	case time.Time:
+		return typedVal.Format(time.RFC3339Nano), true
+	case string:
+		if colType.DatabaseTypeName() == "NUMBER" {
+			return oracleNumber(typedVal), true
+		}
+	}
+	return val, false
+}
+
+// the driver's text for a number as an integer where it is whole and fits, otherwise a float
+func oracleNumber(val interface{}) interface{} {
+	numStr, isStr := val.(string)
+	if !isStr {
+		return val
+	}
+	if intVal, err := strconv.ParseInt(numStr, 10, 64); err == nil {
+		return intVal
+	}
+	if floatVal, err := strconv.ParseFloat(numStr, 64); err == nil {
+		return floatVal
+	}
+	return numStr
+}
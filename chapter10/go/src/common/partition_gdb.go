@@ -0,0 +1,283 @@
+package main
+
+// Management of time based partitions for the output table. The table needs to have been created as partitioned on
+// the time_column (see the README for example DDL), the plugin then creates the partitions for the current and upcoming
+// periods ahead of time, and drops the partitions that are older than the retention period.
+// Postgres partitions are tables named <table>_pYYYYMMDD, MySQL partitions are named pYYYYMMDD, where the date is the
+// start of the period the partition holds.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+const partitionByDay = "day"
+const partitionByWeek = "week"
+const partitionByMonth = "month"
+
+const defaultPartitionPremake = 2
+const defaultPartitionInterval = time.Hour
+const maintenanceTimeout = time.Minute
+
+const partitionPrefix = "p"
+const partitionDateLayout = "20060102"
+
+// the bounds are calculated in UTC, so Postgres is given the offset rather than reading them in the session's time zone
+const pgPartitionBoundLayout = "2006-01-02 15:04:05+00"
+
+// the start of the partition period the time falls into. Weeks start on a Monday
+func partitionStart(t time.Time, partitionBy string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch partitionBy {
+	case partitionByWeek:
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	case partitionByMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day
+	}
+}
+
+// the start of the partition that follows the one starting at start
+func nextPartitionStart(start time.Time, partitionBy string) time.Time {
+	switch partitionBy {
+	case partitionByWeek:
+		return start.AddDate(0, 0, 7)
+	case partitionByMonth:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+func partitionName(start time.Time) string {
+	return partitionPrefix + start.Format(partitionDateLayout)
+}
+
+// Postgres partitions are tables in the same schema as the parent
+func pgPartitionTable(tableName string, start time.Time) string {
+	return tableName + "_" + partitionName(start)
+}
+
+// check the partition settings make sense
+func validatePartitionParams(params *SqlParams) error {
+	if len(params.PartitionBy) == 0 {
+		return nil
+	}
+
+	params.PartitionBy = strings.ToLower(params.PartitionBy)
+	switch params.PartitionBy {
+	case partitionByDay, partitionByWeek, partitionByMonth:
+	default:
+		return errors.New("Unknown " + Plugin_PartitionBy + " " + params.PartitionBy + " for " + params.PluginName + ", expected day, week or month")
+	}
+	if len(params.TimeColumn) == 0 {
+		return errors.New(Plugin_PartitionBy + " needs a " + Plugin_TimeColumn + " for " + params.PluginName)
+	}
+	if isTableTemplate(params.TableName) {
+		return errors.New(Plugin_PartitionBy + " can't be used with a " + Plugin_TableName + " template for " + params.PluginName)
+	}
+	if params.DBType != PostgresDBType && params.DBType != mysqlDBType {
+		return errors.New(Plugin_PartitionBy + " is not supported for " + params.DBType)
+	}
+	if params.PartitionPremake <= 0 {
+		params.PartitionPremake = defaultPartitionPremake
+	}
+	return nil
+}
+
+// list the partitions we manage, returning the start of the period each holds keyed by the partition name
+func listPartitions(ctx context.Context, db *sql.DB, params *SqlParams) (map[string]time.Time, error) {
+	var rows *sql.Rows
+	var err error
+	var namePrefix string = partitionPrefix
+
+	switch params.DBType {
+	case PostgresDBType:
+		schema, table := splitTableName(params.TableName)
+		namePrefix = table + "_" + partitionPrefix
+		rows, err = db.QueryContext(ctx, "SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = $1::regclass", schema+table)
+	case mysqlDBType:
+		rows, err = db.QueryContext(ctx, "SELECT PARTITION_NAME FROM information_schema.PARTITIONS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND PARTITION_NAME IS NOT NULL", params.TableName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	partitions := make(map[string]time.Time)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		// ignore anything that doesn't follow our naming, such as a default partition
+		if !strings.HasPrefix(name, namePrefix) {
+			continue
+		}
+		start, err := time.Parse(partitionDateLayout, name[len(namePrefix):])
+		if err != nil {
+			continue
+		}
+		partitions[name] = start
+	}
+	return partitions, rows.Err()
+}
+
+// separate any schema from the table name, the schema retains the trailing '.' so it can be prefixed to other names
+func splitTableName(tableName string) (string, string) {
+	idx := strings.LastIndex(tableName, ".")
+	if idx < 0 {
+		return "", tableName
+	}
+	return tableName[:idx+1], tableName[idx+1:]
+}
+
+// the name of a MySQL partition holding everything above the other partitions (VALUES LESS THAN MAXVALUE), if the
+// table has one
+func mysqlMaxValuePartition(ctx context.Context, db *sql.DB, params *SqlParams) (string, error) {
+	var name string
+	err := db.QueryRowContext(ctx, "SELECT PARTITION_NAME FROM information_schema.PARTITIONS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? "+
+		"AND PARTITION_DESCRIPTION = 'MAXVALUE'", params.TableName).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return name, err
+}
+
+// create the partition for the period starting at start. MySQL can't add a partition when the table has a MAXVALUE
+// partition, so the new partition is split from it instead
+func createPartition(ctx context.Context, db *sql.DB, params *SqlParams, start time.Time, maxValuePartition string) error {
+	end := nextPartitionStart(start, params.PartitionBy)
+	var sqlStmt string
+	switch params.DBType {
+	case PostgresDBType:
+		sqlStmt = "CREATE TABLE IF NOT EXISTS " + pgPartitionTable(params.TableName, start) + " PARTITION OF " + params.TableName +
+			" FOR VALUES FROM ('" + start.Format(pgPartitionBoundLayout) + "') TO ('" + end.Format(pgPartitionBoundLayout) + "')"
+	case mysqlDBType:
+		partition := "PARTITION " + partitionName(start) + " VALUES LESS THAN ('" + end.Format("2006-01-02") + "')"
+		sqlStmt = "ALTER TABLE " + params.TableName + " ADD PARTITION (" + partition + ")"
+		if len(maxValuePartition) > 0 {
+			sqlStmt = "ALTER TABLE " + params.TableName + " REORGANIZE PARTITION " + maxValuePartition + " INTO (" + partition +
+				", PARTITION " + maxValuePartition + " VALUES LESS THAN MAXVALUE)"
+		}
+	}
+	log.Printf("[%s]%s creating partition: %s", params.PluginName, params.InstanceName, sqlStmt)
+	_, err := db.ExecContext(ctx, sqlStmt)
+	if err == nil {
+		incrementMetric(params, "partitions_created_total", map[string]string{"table": params.TableName}, 1)
+	}
+	return err
+}
+
+func dropPartition(ctx context.Context, db *sql.DB, params *SqlParams, name string) error {
+	var sqlStmt string
+	switch params.DBType {
+	case PostgresDBType:
+		schema, _ := splitTableName(params.TableName)
+		sqlStmt = "DROP TABLE IF EXISTS " + schema + name
+	case mysqlDBType:
+		sqlStmt = "ALTER TABLE " + params.TableName + " DROP PARTITION " + name
+	}
+	log.Printf("[%s]%s dropping partition: %s", params.PluginName, params.InstanceName, sqlStmt)
+	_, err := db.ExecContext(ctx, sqlStmt)
+	if err == nil {
+		incrementMetric(params, "partitions_dropped_total", map[string]string{"table": params.TableName}, 1)
+	}
+	return err
+}
+
+// make sure the partitions for the current period and the configured number of upcoming periods exist, and remove
+// partitions where all the data is older than the retention period
+func managePartitions(params *SqlParams) error {
+	ctx, cancel := context.WithTimeout(context.Background(), maintenanceTimeout)
+	defer cancel()
+
+	db, err := getDB(params)
+	if err != nil {
+		return err
+	}
+
+	existing, err := listPartitions(ctx, db, params)
+	if err != nil {
+		return err
+	}
+
+	// MySQL range partitions can only be added above the highest existing partition
+	var highest time.Time
+	for _, start := range existing {
+		if start.After(highest) {
+			highest = start
+		}
+	}
+	var maxValuePartition string
+	if params.DBType == mysqlDBType {
+		if maxValuePartition, err = mysqlMaxValuePartition(ctx, db, params); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	start := partitionStart(now, params.PartitionBy)
+	for ctr := 0; ctr <= params.PartitionPremake; ctr++ {
+		_, found := existing[managedPartitionName(params, start)]
+		if !found && (params.DBType != mysqlDBType || start.After(highest)) {
+			if err = createPartition(ctx, db, params, start, maxValuePartition); err != nil {
+				return err
+			}
+		}
+		start = nextPartitionStart(start, params.PartitionBy)
+	}
+
+	retention, err := parseDurationStr(params.Retention)
+	if err != nil || retention <= 0 {
+		return err
+	}
+	cutoff := now.Add(-retention)
+	for name, start := range existing {
+		if !nextPartitionStart(start, params.PartitionBy).After(cutoff) {
+			if err = dropPartition(ctx, db, params, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// the partition name as reported by the database - Postgres reports the partition table name without any schema
+func managedPartitionName(params *SqlParams, start time.Time) string {
+	if params.DBType == PostgresDBType {
+		_, table := splitTableName(params.TableName)
+		return pgPartitionTable(table, start)
+	}
+	return partitionName(start)
+}
+
+// run the partition management now, so we know the configuration works and the partition for the current
+// period is there before the first flush, then start a worker to keep things maintained
+func startPartitionManagement(params *SqlParams) error {
+	if len(params.PartitionBy) == 0 {
+		return nil
+	}
+	if err := managePartitions(params); err != nil {
+		return err
+	}
+
+	interval, err := parseDurationStr(params.PartitionCheck)
+	if err != nil || interval <= 0 {
+		interval = defaultPartitionInterval
+	}
+	workerParams := *params
+	startWorker(params, "partition", interval, func() {
+		if err := managePartitions(&workerParams); err != nil {
+			log.Printf("[%s]%s partition maintenance failed - %v", workerParams.PluginName, workerParams.InstanceName, err)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPartitionStart(t *testing.T) {
+	// a Sunday evening in New York, which is already Monday in UTC
+	at := time.Date(2024, 3, 3, 21, 30, 0, 0, time.FixedZone("EST", -5*3600))
+	tests := []struct {
+		at          time.Time
+		partitionBy string
+		start       string
+		next        string
+	}{
+		{at, partitionByDay, "2024-03-04", "2024-03-05"},
+		{at, partitionByWeek, "2024-03-04", "2024-03-11"},
+		{at, partitionByMonth, "2024-03-01", "2024-04-01"},
+		{time.Date(2024, 3, 3, 12, 0, 0, 0, time.UTC), partitionByWeek, "2024-02-26", "2024-03-04"},
+		{time.Date(2024, 1, 31, 23, 59, 59, 0, time.UTC), partitionByMonth, "2024-01-01", "2024-02-01"},
+		{time.Date(2024, 2, 29, 8, 0, 0, 0, time.UTC), partitionByDay, "2024-02-29", "2024-03-01"},
+		{time.Date(2024, 12, 31, 8, 0, 0, 0, time.UTC), partitionByWeek, "2024-12-30", "2025-01-06"},
+		{time.Date(2024, 12, 31, 8, 0, 0, 0, time.UTC), partitionByMonth, "2024-12-01", "2025-01-01"},
+	}
+	for _, test := range tests {
+		start := partitionStart(test.at, test.partitionBy)
+		next := nextPartitionStart(start, test.partitionBy)
+		if start.Format("2006-01-02") != test.start || next.Format("2006-01-02") != test.next {
+			t.Errorf("%v by %s: got %v to %v, expected %s to %s", test.at, test.partitionBy, start, next, test.start, test.next)
+		}
+		if start.Location() != time.UTC || start.Hour() != 0 || start.Minute() != 0 {
+			t.Errorf("%v by %s: got %v, expected midnight UTC", test.at, test.partitionBy, start)
+		}
+	}
+}
+
+func TestPartitionNames(t *testing.T) {
+	start := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	if name := partitionName(start); name != "p20240304" {
+		t.Errorf("got %s, expected p20240304", name)
+	}
+	if bound := start.Format(pgPartitionBoundLayout); bound != "2024-03-04 00:00:00+00" {
+		t.Errorf("got %s, expected the bound with a UTC offset", bound)
+	}
+
+	tests := []struct {
+		dbType    string
+		tableName string
+		expected  string
+	}{
+		{PostgresDBType, "logs", "logs_p20240304"},
+		{PostgresDBType, "audit.logs", "logs_p20240304"},
+		{mysqlDBType, "logs", "p20240304"},
+	}
+	for _, test := range tests {
+		if name := managedPartitionName(&SqlParams{DBType: test.dbType, TableName: test.tableName}, start); name != test.expected {
+			t.Errorf("%s %s: got %s, expected %s", test.dbType, test.tableName, name, test.expected)
+		}
+	}
+	if table := pgPartitionTable("audit.logs", start); table != "audit.logs_p20240304" {
+		t.Errorf("got %s, expected the partition in the parent's schema", table)
+	}
+}
+
+func TestSplitTableName(t *testing.T) {
+	tests := []struct {
+		tableName string
+		schema    string
+		table     string
+	}{
+		{"logs", "", "logs"},
+		{"audit.logs", "audit.", "logs"},
+		{"db.audit.logs", "db.audit.", "logs"},
+	}
+	for _, test := range tests {
+		if schema, table := splitTableName(test.tableName); schema != test.schema || table != test.table {
+			t.Errorf("%s: got %q and %q, expected %q and %q", test.tableName, schema, table, test.schema, test.table)
+		}
+	}
+}
+
+func TestValidatePartitionParams(t *testing.T) {
+	tests := []struct {
+		params SqlParams
+		valid  bool
+	}{
+		{SqlParams{}, true},
+		{SqlParams{DBType: PostgresDBType, PartitionBy: "Week", TimeColumn: "ts", TableName: "logs"}, true},
+		{SqlParams{DBType: mysqlDBType, PartitionBy: "month", TimeColumn: "ts", TableName: "logs"}, true},
+		{SqlParams{DBType: PostgresDBType, PartitionBy: "hour", TimeColumn: "ts", TableName: "logs"}, false},
+		{SqlParams{DBType: PostgresDBType, PartitionBy: "day", TableName: "logs"}, false},
+		{SqlParams{DBType: PostgresDBType, PartitionBy: "day", TimeColumn: "ts", TableName: "logs_${tag[1]}"}, false},
+		{SqlParams{DBType: sqlserverDBType, PartitionBy: "day", TimeColumn: "ts", TableName: "logs"}, false},
+	}
+	for _, test := range tests {
+		if err := validatePartitionParams(&test.params); (err == nil) != test.valid {
+			t.Errorf("%s %s: got %v, expected valid %t", test.params.DBType, test.params.PartitionBy, err, test.valid)
+		}
+	}
+	params := &SqlParams{DBType: PostgresDBType, PartitionBy: "DAY", TimeColumn: "ts", TableName: "logs"}
+	if validatePartitionParams(params); params.PartitionBy != partitionByDay || params.PartitionPremake != defaultPartitionPremake {
+		t.Errorf("got %s with %d premade, expected day with the default", params.PartitionBy, params.PartitionPremake)
+	}
+}
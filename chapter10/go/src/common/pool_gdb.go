@@ -0,0 +1,180 @@
+package main
+
+// Each plugin instance keeps a single connection pool for its lifetime, rather than opening the database for every
+// call and paying for the connection (and any TLS or authentication handshake) each time. The pool size is set by
+// db_max_open_conns and db_max_idle_conns, and connections are replaced once they reach db_conn_max_lifetime.
+// The pool is shared by the flushes and the background workers, so it is only closed when the instance exits -
+// database/sql discards connections a restarted database has dropped, and opens new ones as they are needed. As
+// connections left idle may have been dropped without us knowing, a pool that hasn't been used for a while, or
+// whose last check failed, is pinged before it is handed out, which replaces any stale connections.
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultPoolMaxOpen = 10
+const defaultPoolMaxIdle = 2
+const defaultPoolMaxLifetime = 30 * time.Minute
+const poolMaxIdleTime = 5 * time.Minute
+
+// how long the pool can go unused before it is checked, and how long we wait for the check
+const poolCheckIdle = time.Minute
+const poolPingTimeout = 2 * time.Second
+
+// a connection pool that is opened when first needed
+type dbPool struct {
+	mutex    sync.Mutex
+	db       *sql.DB
+	lastUsed time.Time
+	suspect  bool // the last check or call failed, so the pool is checked again before it is used
+	breaker  *circuitBreaker
+}
+
+// check the pool settings
+func validatePoolParams(params *SqlParams) error {
+	if params.PoolMaxOpen < 0 {
+		return errors.New(Plugin_PoolMaxOpen + " can't be negative for " + params.PluginName)
+	}
+	if params.PoolMaxIdle < 0 {
+		return errors.New(Plugin_PoolMaxIdle + " can't be negative for " + params.PluginName)
+	}
+	params.PoolLifetime = strings.TrimSpace(params.PoolLifetime)
+	if _, err := parseDurationStr(params.PoolLifetime); err != nil {
+		return errors.New(Plugin_PoolMaxLifetime + " - " + err.Error())
+	}
+	return nil
+}
+
+// open a connection pool sized by the configuration
+func openPool(params *SqlParams) (*sql.DB, error) {
+	if err := registerTLSConfig(params); err != nil {
+		return nil, err
+	}
+	db, err := openDB(params)
+	if err != nil {
+		return nil, err
+	}
+
+	maxOpen := params.PoolMaxOpen
+	if maxOpen == 0 {
+		maxOpen = defaultPoolMaxOpen
+	}
+	maxIdle := params.PoolMaxIdle
+	if maxIdle == 0 {
+		maxIdle = defaultPoolMaxIdle
+	}
+	if maxIdle > maxOpen {
+		maxIdle = maxOpen
+	}
+	lifetime, _ := parseDurationStr(params.PoolLifetime)
+	if lifetime <= 0 {
+		lifetime = defaultPoolMaxLifetime
+	}
+
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxLifetime(lifetime)
+	db.SetConnMaxIdleTime(poolMaxIdleTime)
+	return db, nil
+}
+
+// get the pool, opening it the first time. Other calls may be using the pool, so it is never closed here - a
+// connection that fails is discarded by database/sql, and replaced by a new one the next time it is needed
+func (pool *dbPool) get(params *SqlParams) (*sql.DB, error) {
+	db, check, err := pool.open(params)
+	if err != nil {
+		return nil, err
+	}
+	if check {
+		if err = pool.ping(db); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// the pool, opened the first time, and whether it needs checking before it is used. Opening the pool doesn't
+// connect to the database
+func (pool *dbPool) open(params *SqlParams) (*sql.DB, bool, error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	now := time.Now()
+	if pool.db == nil {
+		db, err := openPool(params)
+		if err != nil {
+			return nil, false, err
+		}
+		pool.db = db
+		pool.lastUsed = now
+	}
+	check := pool.suspect || now.Sub(pool.lastUsed) > poolCheckIdle
+	pool.lastUsed = now
+	return pool.db, check, nil
+}
+
+// check the database can be reached through the pool, whenever it was last used
+func (pool *dbPool) check(params *SqlParams) error {
+	db, _, err := pool.open(params)
+	if err != nil {
+		return err
+	}
+	return pool.ping(db)
+}
+
+// check the pool can reach the database. A ping that finds an idle connection the database has dropped discards
+// it, so we ping again until we get a working connection, which replaces the stale connections without closing the
+// pool others may be using
+func (pool *dbPool) ping(db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), poolPingTimeout)
+	defer cancel()
+	err := db.PingContext(ctx)
+	for tries := 0; errors.Is(err, driver.ErrBadConn) && tries <= db.Stats().Idle; tries++ {
+		err = db.PingContext(ctx)
+	}
+
+	pool.mutex.Lock()
+	pool.suspect = err != nil
+	pool.mutex.Unlock()
+	return err
+}
+
+// have the pool checked before it is next used, after a call failed in a way that suggests the database is unavailable
+func (pool *dbPool) markSuspect() {
+	pool.mutex.Lock()
+	pool.suspect = true
+	pool.mutex.Unlock()
+}
+
+// the circuit breaker for the database the pool connects to, set up the first time with the settings in the params
+func (pool *dbPool) circuitBreaker(params *SqlParams) *circuitBreaker {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.breaker == nil {
+		pool.breaker = newCircuitBreaker(params, pool)
+	}
+	return pool.breaker
+}
+
+// close the pool's connections
+func (pool *dbPool) close() error {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.db == nil {
+		return nil
+	}
+	err := pool.db.Close()
+	pool.db = nil
+	return err
+}
+
+// the connection pool for the plugin instance
+func getDB(params *SqlParams) (*sql.DB, error) {
+	return getResources(params).pool.get(params)
+}
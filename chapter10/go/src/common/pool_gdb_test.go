@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a driver whose connections only answer pings, so the pool's checks can be tested without a database
+type testConnector struct {
+	mutex      sync.Mutex
+	opened     int
+	pings      int
+	down       error         // returned when connecting or pinging, as if the database is unavailable
+	staleUntil int           // connections up to this one have been dropped by the database
+	block      chan struct{} // when set, pings wait until it is closed
+}
+
+type testConn struct {
+	connector *testConnector
+	id        int
+}
+
+func (connector *testConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	connector.mutex.Lock()
+	defer connector.mutex.Unlock()
+	if connector.down != nil {
+		return nil, connector.down
+	}
+	connector.opened++
+	return &testConn{connector: connector, id: connector.opened}, nil
+}
+
+func (connector *testConnector) Driver() driver.Driver {
+	return nil
+}
+
+func (connector *testConnector) set(change func(connector *testConnector)) {
+	connector.mutex.Lock()
+	defer connector.mutex.Unlock()
+	change(connector)
+}
+
+func (conn *testConn) Ping(ctx context.Context) error {
+	connector := conn.connector
+	connector.mutex.Lock()
+	block := connector.block
+	connector.mutex.Unlock()
+	if block != nil {
+		<-block
+	}
+
+	connector.mutex.Lock()
+	defer connector.mutex.Unlock()
+	connector.pings++
+	if conn.id <= connector.staleUntil {
+		return driver.ErrBadConn
+	}
+	return connector.down
+}
+
+func (conn *testConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (conn *testConn) Close() error {
+	return nil
+}
+
+func (conn *testConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+// a pool using the test driver, as if it had been opened and used just now
+func newTestPool(t *testing.T) (*dbPool, *testConnector) {
+	connector := &testConnector{}
+	pool := &dbPool{db: sql.OpenDB(connector), lastUsed: time.Now()}
+	t.Cleanup(func() { pool.close() })
+	return pool, connector
+}
+
+func TestPoolCheck(t *testing.T) {
+	params := &SqlParams{PluginName: "gdb-test"}
+	pool, connector := newTestPool(t)
+	db := pool.db
+
+	// a pool in use isn't checked
+	if got, err := pool.get(params); err != nil || got != db || connector.pings != 0 {
+		t.Fatalf("got %v with %d pings, expected the pool without a check", err, connector.pings)
+	}
+
+	// once idle it is, and a connection the database has dropped is replaced
+	pool.lastUsed = time.Now().Add(-2 * poolCheckIdle)
+	if _, err := pool.get(params); err != nil || connector.opened != 1 {
+		t.Fatalf("got %v with %d connections, expected one connection", err, connector.opened)
+	}
+	connector.set(func(connector *testConnector) { connector.staleUntil = 1 })
+	pool.lastUsed = time.Now().Add(-2 * poolCheckIdle)
+	if _, err := pool.get(params); err != nil || connector.opened != 2 {
+		t.Errorf("got %v with %d connections, expected the stale connection replaced", err, connector.opened)
+	}
+
+	// while the database is down the pool stays open, and is checked each time until the database is back
+	down := errors.New("connection refused")
+	connector.set(func(connector *testConnector) { connector.down = down; connector.staleUntil = 2 })
+	pool.lastUsed = time.Now().Add(-2 * poolCheckIdle)
+	if _, err := pool.get(params); !errors.Is(err, down) || pool.db != db || !pool.suspect {
+		t.Errorf("got %v, expected the ping to fail and the pool to be kept", err)
+	}
+	connector.set(func(connector *testConnector) { connector.down = nil })
+	pings := connector.pings
+	if got, err := pool.get(params); err != nil || got != db || connector.pings == pings || pool.suspect {
+		t.Errorf("got %v, expected the pool to be checked again and work", err)
+	}
+	pings = connector.pings
+	if _, err := pool.get(params); err != nil || connector.pings != pings {
+		t.Errorf("got %v with %d more pings, expected no check", err, connector.pings-pings)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+// the dialect for Postgres, using the lib/pq driver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+type postgresDialect struct {
+	standardSavepoints
+}
+
+// Postgres SQLSTATE classes - see https://www.postgresql.org/docs/current/errcodes-appendix.html
+var pgRetryClasses = map[pq.ErrorClass]bool{
+	"08": true, // connection exception
+	"40": true, // transaction rollback - covers serialization_failure and deadlock_detected
+	"53": true, // insufficient resources
+	"57": true, // operator intervention - e.g. admin shutdown, the DB is restarting
+	"58": true, // system error
+}
+var pgRecordClasses = map[pq.ErrorClass]bool{
+	"22": true, // data exception - e.g. value too long, invalid text representation
+	"23": true, // integrity constraint violation
+}
+
+// the SQLSTATE codes for a rejected user or password
+var pgAuthCodes = map[pq.ErrorCode]bool{
+	"28000": true, // invalid authorization specification
+	"28P01": true, // invalid password
+}
+
+func (postgresDialect) usesServer() bool {
+	return true
+}
+
+// the values are quoted, so a password can contain spaces, quotes and backslashes
+func (postgresDialect) connectionStr(params *SqlParams) string {
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s", pgConnValue(params.Host), params.Port,
+		pgConnValue(params.User), pgConnValue(params.Password), pgConnValue(params.DBName)) + pgTLSSettings(params)
+	for _, option := range driverOptions(params) {
+		connStr = connStr + " " + option[0] + "=" + pgConnValue(option[1])
+	}
+	return connStr
+}
+
+// the driver reads the certificate files itself. It can only verify the server's certificate against the host
+// we connect to, so a tls.server_name is rejected when verifying
+func pgTLSSettings(params *SqlParams) string {
+	if !tlsEnabled(params) {
+		return " sslmode=disable"
+	}
+	// the driver verifies the CA when given a root certificate, so it is only passed when we are verifying
+	settings := " sslmode=require"
+	if tlsVerify(params) {
+		settings = " sslmode=verify-full"
+		if len(params.TLSCAFile) > 0 {
+			settings = settings + " sslrootcert=" + pgConnValue(params.TLSCAFile)
+		}
+	}
+	if len(params.TLSCertFile) > 0 {
+		settings = settings + " sslcert=" + pgConnValue(params.TLSCertFile) + " sslkey=" + pgConnValue(params.TLSKeyFile)
+	}
+	return settings
+}
+
+// quote a value in the connection string, escaping any quotes and backslashes within it
+func pgConnValue(value string) string {
+	return "'" + strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace(value) + "'"
+}
+
+func (postgresDialect) quoteIdent(name string) string {
+	return pq.QuoteIdentifier(name)
+}
+
+// Postgres uses numbered bind variables
+func (postgresDialect) bindVar(idx int) string {
+	return "$" + strconv.Itoa(idx)
+}
+
+func (postgresDialect) limitQuery(sqlStmt string, limit int, offset int) string {
+	sqlStmt = sqlStmt + " LIMIT " + strconv.Itoa(limit)
+	if offset > 0 {
+		sqlStmt = sqlStmt + " OFFSET " + strconv.Itoa(offset)
+	}
+	return sqlStmt
+}
+
+func (dialect postgresDialect) insertExpr(table string, cols []string, rowCount int) string {
+	rows := make([]string, rowCount)
+	for idx := range rows {
+		rows[idx] = "(" + strings.Join(rowPlaceholders(dialect, idx*len(cols)+1, len(cols)), ",") + ")"
+	}
+	return "INSERT INTO " + table + " (" + strings.Join(cols, ",") + ") VALUES " + strings.Join(rows, ",")
+}
+
+// the table is given an alias so the updates can refer to the existing row
+func (dialect postgresDialect) upsertExpr(table string, cols []string, conflictCols []string, updates func(existing, incoming func(string) string) []string) string {
+	sqlStmt := "INSERT INTO " + table + " AS existing (" + strings.Join(cols, ",") + ") VALUES (" +
+		strings.Join(rowPlaceholders(dialect, 1, len(cols)), ",") + ") ON CONFLICT (" + strings.Join(conflictCols, ", ") + ")"
+
+	var assignments []string
+	if updates != nil {
+		assignments = updates(func(col string) string { return "existing." + col }, func(col string) string { return "EXCLUDED." + col })
+	}
+	if len(assignments) == 0 {
+		return sqlStmt + " DO NOTHING"
+	}
+	return sqlStmt + " DO UPDATE SET " + strings.Join(assignments, ", ")
+}
+
+// the driver doesn't support LastInsertId, so we ask for the generated key to be returned
+func (postgresDialect) insertReturningId(ctx context.Context, conn dbConn, sqlStmt string, args []interface{}, keyCol string) (interface{}, error) {
+	var id interface{}
+	err := conn.QueryRowContext(ctx, sqlStmt+" RETURNING "+keyCol, args...).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return toDBValue(id), nil
+}
+
+// use COPY, which streams the rows to the server rather than executing a statement for each
+func (postgresDialect) bulkLoad(ctx context.Context, tx *sql.Tx, table string, cols []string, rows [][]interface{}) error {
+	schema, tableName := splitTableName(table)
+	copyStmt := pq.CopyIn(tableName, cols...)
+	if len(schema) > 0 {
+		copyStmt = pq.CopyInSchema(strings.TrimSuffix(schema, "."), tableName, cols...)
+	}
+	stmt, err := tx.PrepareContext(ctx, copyStmt)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		if _, err = stmt.ExecContext(ctx, row...); err != nil {
+			return err
+		}
+	}
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
+
+func (postgresDialect) classifyError(err error) (dbErrorClass, bool) {
+	var pgErr *pq.Error
+	if !errors.As(err, &pgErr) {
+		return errClassNone, false
+	}
+	if pgRetryClasses[pgErr.Code.Class()] {
+		return errClassRetry, true
+	}
+	if pgRecordClasses[pgErr.Code.Class()] {
+		return errClassRecord, true
+	}
+	return errClassFatal, true
+}
+
+func (postgresDialect) authFailed(err error) bool {
+	var pgErr *pq.Error
+	return errors.As(err, &pgErr) && pgAuthCodes[pgErr.Code]
+}
@@ -0,0 +1,482 @@
+package main
+
+// For the output plugin the where_expression is a filter applied to each record, deciding whether the record is written.
+// Records that don't match are dropped, or written to the unmatched_table if one is configured.
+// The expression supports:
+//   record accessors  - $level, $log['level'], $kubernetes['labels']['app']
+//   literals          - 'text' or "text", numbers, true, false and null
+//   comparisons       - ==, !=, <, <=, >, >=
+//   regex matching    - =~ and !~ with the regular expression as a quoted string on the right
+//   logic             - and, or, not (or &&, ||, !) and parentheses
+// A record accessor on its own is true if the value exists and isn't false, 0 or empty.
+// e.g. $level == 'error' and not ($log =~ '^health check')
+// For the input plugin the where_expression remains part of the SQL query.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type predicateTokenKind int
+
+const (
+	tokenEnd predicateTokenKind = iota
+	tokenPath
+	tokenString
+	tokenNumber
+	tokenIdent
+	tokenOp
+	tokenOpen
+	tokenClose
+)
+
+type predicateToken struct {
+	kind predicateTokenKind
+	text string
+}
+
+// break the expression up into tokens
+func tokenizePredicate(expr string) ([]predicateToken, error) {
+	var tokens []predicateToken
+	pos := 0
+	for pos < len(expr) {
+		ch := expr[pos]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			pos++
+
+		case ch == '(':
+			tokens = append(tokens, predicateToken{kind: tokenOpen, text: "("})
+			pos++
+
+		case ch == ')':
+			tokens = append(tokens, predicateToken{kind: tokenClose, text: ")"})
+			pos++
+
+		case ch == '\'' || ch == '"':
+			end := pos + 1
+			var text strings.Builder
+			for end < len(expr) && expr[end] != ch {
+				if expr[end] == '\\' && end+1 < len(expr) && expr[end+1] == ch {
+					end++
+				}
+				text.WriteByte(expr[end])
+				end++
+			}
+			if end >= len(expr) {
+				return nil, errors.New("unterminated string in " + Plugin_WhereExpr)
+			}
+			tokens = append(tokens, predicateToken{kind: tokenString, text: text.String()})
+			pos = end + 1
+
+		case ch == '$':
+			// a record accessor runs until whitespace, an operator or a parenthesis outside of the brackets
+			end := pos + 1
+			depth := 0
+			for end < len(expr) {
+				c := expr[end]
+				if c == '[' {
+					depth++
+				} else if c == ']' {
+					depth--
+				} else if depth == 0 && strings.IndexByte(" \t\r\n()=!<>&|", c) >= 0 {
+					break
+				}
+				end++
+			}
+			tokens = append(tokens, predicateToken{kind: tokenPath, text: expr[pos:end]})
+			pos = end
+
+		case (ch >= '0' && ch <= '9') || ch == '-' || ch == '.':
+			end := pos + 1
+			for end < len(expr) && strings.IndexByte("0123456789.eE+-", expr[end]) >= 0 {
+				end++
+			}
+			tokens = append(tokens, predicateToken{kind: tokenNumber, text: expr[pos:end]})
+			pos = end
+
+		case strings.IndexByte("=!<>&|", ch) >= 0:
+			op := expr[pos : pos+1]
+			if pos+1 < len(expr) {
+				two := expr[pos : pos+2]
+				switch two {
+				case "==", "!=", "<=", ">=", "=~", "!~", "&&", "||":
+					op = two
+				}
+			}
+			if op == "=" || op == "&" || op == "|" {
+				return nil, errors.New("unknown operator " + op + " in " + Plugin_WhereExpr)
+			}
+			tokens = append(tokens, predicateToken{kind: tokenOp, text: op})
+			pos = pos + len(op)
+
+		case (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z'):
+			end := pos + 1
+			for end < len(expr) && ((expr[end] >= 'a' && expr[end] <= 'z') || (expr[end] >= 'A' && expr[end] <= 'Z')) {
+				end++
+			}
+			tokens = append(tokens, predicateToken{kind: tokenIdent, text: strings.ToLower(expr[pos:end])})
+			pos = end
+
+		default:
+			return nil, fmt.Errorf("unexpected character %c in %s", ch, Plugin_WhereExpr)
+		}
+	}
+	return append(tokens, predicateToken{kind: tokenEnd}), nil
+}
+
+// a node of the parsed expression
+type predicateNode interface {
+	eval(recd FlushRecord) interface{}
+}
+
+type andNode struct{ left, right predicateNode }
+type orNode struct{ left, right predicateNode }
+type notNode struct{ operand predicateNode }
+type pathNode struct{ path recordPath }
+type literalNode struct{ value interface{} }
+type compareNode struct {
+	op          string
+	left, right predicateNode
+}
+type regexNode struct {
+	negate  bool
+	operand predicateNode
+	regex   *regexp.Regexp
+}
+
+func (node andNode) eval(recd FlushRecord) interface{} {
+	return isTruthy(node.left.eval(recd)) && isTruthy(node.right.eval(recd))
+}
+
+func (node orNode) eval(recd FlushRecord) interface{} {
+	return isTruthy(node.left.eval(recd)) || isTruthy(node.right.eval(recd))
+}
+
+func (node notNode) eval(recd FlushRecord) interface{} {
+	return !isTruthy(node.operand.eval(recd))
+}
+
+func (node pathNode) eval(recd FlushRecord) interface{} {
+	val, found := lookupRecordPath(recd.Record, node.path)
+	if !found {
+		return nil
+	}
+	return toDBValue(val)
+}
+
+func (node literalNode) eval(recd FlushRecord) interface{} {
+	return node.value
+}
+
+func (node regexNode) eval(recd FlushRecord) interface{} {
+	val := node.operand.eval(recd)
+	if val == nil {
+		return node.negate
+	}
+	return node.regex.MatchString(typeToStr(val, false)) != node.negate
+}
+
+// comparisons are numeric if both sides can be treated as numbers, otherwise they're done on the string values.
+// null is only equal to null
+func (node compareNode) eval(recd FlushRecord) interface{} {
+	left := node.left.eval(recd)
+	right := node.right.eval(recd)
+
+	if left == nil || right == nil {
+		switch node.op {
+		case "==":
+			return left == nil && right == nil
+		case "!=":
+			return (left == nil) != (right == nil)
+		default:
+			return false
+		}
+	}
+
+	var cmp int
+	leftNum, leftIsNum := toNumber(left)
+	rightNum, rightIsNum := toNumber(right)
+	if leftIsNum && rightIsNum {
+		switch {
+		case leftNum < rightNum:
+			cmp = -1
+		case leftNum > rightNum:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(predicateStr(left), predicateStr(right))
+	}
+
+	switch node.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// the string form of a value for comparison - typeToStr uses exponent notation for floats which isn't what we want here
+func predicateStr(val interface{}) string {
+	switch v := val.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	}
+	return typeToStr(val, false)
+}
+
+// convert the value to a number if we can
+func toNumber(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		num, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return num, err == nil
+	}
+	return 0, false
+}
+
+// does the value count as true
+func isTruthy(val interface{}) bool {
+	switch v := val.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return len(v) > 0 && v != "false"
+	}
+	if num, isNum := toNumber(val); isNum {
+		return num != 0
+	}
+	return true
+}
+
+// a recursive descent parser over the tokens
+type predicateParser struct {
+	tokens []predicateToken
+	pos    int
+}
+
+func (parser *predicateParser) peek() predicateToken {
+	return parser.tokens[parser.pos]
+}
+
+func (parser *predicateParser) next() predicateToken {
+	token := parser.tokens[parser.pos]
+	if token.kind != tokenEnd {
+		parser.pos++
+	}
+	return token
+}
+
+func (parser *predicateParser) parseOr() (predicateNode, error) {
+	left, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		token := parser.peek()
+		if !(token.kind == tokenIdent && token.text == "or") && !(token.kind == tokenOp && token.text == "||") {
+			return left, nil
+		}
+		parser.next()
+		right, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left: left, right: right}
+	}
+}
+
+func (parser *predicateParser) parseAnd() (predicateNode, error) {
+	left, err := parser.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		token := parser.peek()
+		if !(token.kind == tokenIdent && token.text == "and") && !(token.kind == tokenOp && token.text == "&&") {
+			return left, nil
+		}
+		parser.next()
+		right, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left: left, right: right}
+	}
+}
+
+func (parser *predicateParser) parseNot() (predicateNode, error) {
+	token := parser.peek()
+	if (token.kind == tokenIdent && token.text == "not") || (token.kind == tokenOp && token.text == "!") {
+		parser.next()
+		operand, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	}
+	return parser.parseComparison()
+}
+
+func (parser *predicateParser) parseComparison() (predicateNode, error) {
+	if parser.peek().kind == tokenOpen {
+		parser.next()
+		node, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if parser.next().kind != tokenClose {
+			return nil, errors.New("missing ) in " + Plugin_WhereExpr)
+		}
+		return node, nil
+	}
+
+	left, err := parser.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	token := parser.peek()
+	if token.kind != tokenOp || token.text == "&&" || token.text == "||" || token.text == "!" {
+		return left, nil
+	}
+	parser.next()
+
+	if token.text == "=~" || token.text == "!~" {
+		patternToken := parser.next()
+		if patternToken.kind != tokenString {
+			return nil, errors.New("the regular expression after " + token.text + " needs to be quoted")
+		}
+		regex, err := regexp.Compile(patternToken.text)
+		if err != nil {
+			return nil, err
+		}
+		return regexNode{negate: token.text == "!~", operand: left, regex: regex}, nil
+	}
+
+	right, err := parser.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return compareNode{op: token.text, left: left, right: right}, nil
+}
+
+func (parser *predicateParser) parseOperand() (predicateNode, error) {
+	token := parser.next()
+	switch token.kind {
+	case tokenPath:
+		path, err := parseRecordPath(token.text)
+		if err != nil {
+			return nil, err
+		}
+		return pathNode{path: path}, nil
+	case tokenString:
+		return literalNode{value: token.text}, nil
+	case tokenNumber:
+		num, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, errors.New("invalid number " + token.text + " in " + Plugin_WhereExpr)
+		}
+		return literalNode{value: num}, nil
+	case tokenIdent:
+		switch token.text {
+		case "true":
+			return literalNode{value: true}, nil
+		case "false":
+			return literalNode{value: false}, nil
+		case "null", "nil":
+			return literalNode{value: nil}, nil
+		}
+		return nil, errors.New("unexpected " + token.text + " in " + Plugin_WhereExpr + ", record accessors start with $")
+	case tokenEnd:
+		return nil, errors.New("unexpected end of " + Plugin_WhereExpr)
+	}
+	return nil, errors.New("unexpected " + token.text + " in " + Plugin_WhereExpr)
+}
+
+// parsing the expression on each flush is wasteful, so we keep the parsed expressions
+var predicateCache sync.Map
+
+// parse the expression into something we can evaluate against each record
+func parsePredicate(expr string) (predicateNode, error) {
+	if cached, found := predicateCache.Load(expr); found {
+		return cached.(predicateNode), nil
+	}
+
+	tokens, err := tokenizePredicate(expr)
+	if err != nil {
+		return nil, err
+	}
+	parser := &predicateParser{tokens: tokens}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.peek().kind != tokenEnd {
+		return nil, errors.New("unexpected " + parser.peek().text + " in " + Plugin_WhereExpr)
+	}
+	predicateCache.Store(expr, node)
+	return node, nil
+}
+
+// separate the records that match the where_expression from those that don't
+func filterRecords(params *SqlParams, records []FlushRecord) ([]FlushRecord, []FlushRecord, error) {
+	if len(strings.TrimSpace(params.WhereExpr)) == 0 {
+		return records, nil, nil
+	}
+	predicate, err := parsePredicate(params.WhereExpr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var matched []FlushRecord
+	var unmatched []FlushRecord
+	for _, recd := range records {
+		if isTruthy(predicate.eval(recd)) {
+			matched = append(matched, recd)
+		} else {
+			unmatched = append(unmatched, recd)
+		}
+	}
+	return matched, unmatched, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenizePredicate(t *testing.T) {
+	tests := []struct {
+		expr  string
+		kinds []predicateTokenKind
+		texts []string
+	}{
+		{"$level == 'error'", []predicateTokenKind{tokenPath, tokenOp, tokenString, tokenEnd}, []string{"$level", "==", "error", ""}},
+		{"$log['a b']['c']!=\"x\"", []predicateTokenKind{tokenPath, tokenOp, tokenString, tokenEnd}, []string{"$log['a b']['c']", "!=", "x", ""}},
+		{"($n>=-1.5e3)", []predicateTokenKind{tokenOpen, tokenPath, tokenOp, tokenNumber, tokenClose, tokenEnd}, []string{"(", "$n", ">=", "-1.5e3", ")", ""}},
+		{"NOT $a && $b || !$c", []predicateTokenKind{tokenIdent, tokenPath, tokenOp, tokenPath, tokenOp, tokenOp, tokenPath, tokenEnd},
+			[]string{"not", "$a", "&&", "$b", "||", "!", "$c", ""}},
+		{"$msg =~ 'it\\'s'", []predicateTokenKind{tokenPath, tokenOp, tokenString, tokenEnd}, []string{"$msg", "=~", "it's", ""}},
+	}
+	for _, test := range tests {
+		tokens, err := tokenizePredicate(test.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.expr, err)
+			continue
+		}
+		if len(tokens) != len(test.kinds) {
+			t.Errorf("%s: got %d tokens %v, expected %d", test.expr, len(tokens), tokens, len(test.kinds))
+			continue
+		}
+		for idx, token := range tokens {
+			if token.kind != test.kinds[idx] || token.text != test.texts[idx] {
+				t.Errorf("%s: token %d is %v %q, expected %v %q", test.expr, idx, token.kind, token.text, test.kinds[idx], test.texts[idx])
+			}
+		}
+	}
+}
+
+func TestTokenizePredicateErrors(t *testing.T) {
+	for _, expr := range []string{"$a = 'b'", "$a & $b", "$a | $b", "$a == 'open", "$a == #"} {
+		if _, err := tokenizePredicate(expr); err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
+
+func TestParsePredicate(t *testing.T) {
+	recd := FlushRecord{
+		Tag:       "app.web",
+		Timestamp: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Record: RowDefinition{
+			"level":  []byte("error"),
+			"status": int64(503),
+			"ratio":  0.25,
+			"empty":  "",
+			"flag":   false,
+			"log":    "health check ok",
+			"kubernetes": map[interface{}]interface{}{
+				"labels": map[interface{}]interface{}{"app": "web"},
+			},
+		},
+	}
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		{"$level == 'error'", true},
+		{"$level != 'error'", false},
+		{"$status >= 500", true},
+		{"$status < 500", false},
+		{"$status == '503'", true},
+		{"$ratio == 0.25", true},
+		{"$ratio > 0.3", false},
+		{"$kubernetes['labels']['app'] == 'web'", true},
+		{"$log =~ '^health'", true},
+		{"$log !~ '^health'", false},
+		{"$missing =~ 'x'", false},
+		{"$missing !~ 'x'", true},
+		{"$missing == null", true},
+		{"$level == null", false},
+		{"$missing != null", false},
+		{"$missing > 1", false},
+		{"$level", true},
+		{"$empty", false},
+		{"$flag", false},
+		{"$missing", false},
+		{"not $missing", true},
+		{"!$flag", true},
+		{"$level == 'error' and $status == 503", true},
+		{"$level == 'info' or $status == 503", true},
+		{"$level == 'info' || ($status == 503 && not $flag)", true},
+		{"not ($level == 'error' and $log =~ 'health')", false},
+		{"$level == 'info' or $level == 'warn' and $status == 503", false},
+		{"true and not false", true},
+	}
+	for _, test := range tests {
+		predicate, err := parsePredicate(test.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.expr, err)
+			continue
+		}
+		if result := isTruthy(predicate.eval(recd)); result != test.expected {
+			t.Errorf("%s: got %t, expected %t", test.expr, result, test.expected)
+		}
+	}
+}
+
+func TestParsePredicateErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"level == 'error'",
+		"$level ==",
+		"($level == 'error'",
+		"$level == 'error')",
+		"$log =~ ^health",
+		"$log =~ '['",
+		"$a == 1..2",
+		"$a $b",
+	} {
+		if _, err := parsePredicate(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
+
+func TestFilterRecords(t *testing.T) {
+	records := []FlushRecord{
+		{Record: RowDefinition{"level": "error"}},
+		{Record: RowDefinition{"level": "info"}},
+		{Record: RowDefinition{"other": "value"}},
+	}
+	params := &SqlParams{WhereExpr: "$level == 'error'"}
+	matched, unmatched, err := filterRecords(params, records)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(matched) != 1 || len(unmatched) != 2 {
+		t.Errorf("got %d matched and %d unmatched, expected 1 and 2", len(matched), len(unmatched))
+	}
+
+	params.WhereExpr = " "
+	matched, unmatched, err = filterRecords(params, records)
+	if err != nil || len(matched) != len(records) || unmatched != nil {
+		t.Errorf("without an expression got %d matched, %d unmatched and %v, expected all matched", len(matched), len(unmatched), err)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+// Keeping credentials out of the logs, the context we give Fluent Bit and the environment variables the input
+// keeps its settings in. The password, the DSN (which may hold a password) and the secret store URL are always
+// treated as sensitive, and redact_fields can name further settings, such as db_user, along with any record
+// fields that shouldn't be logged. The context and environment variables are given redacted values, with the real
+// values held in memory for the plugin instance and put back when the params are retrieved.
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redactedValue = "*****"
+
+// a setting that is kept out of the context, environment variables and logs, and how its value is redacted
+type sensitiveSetting struct {
+	field  func(params *SqlParams) *string
+	redact func(value string) string
+}
+
+// the settings that are always sensitive
+var sensitiveSettings = map[string]sensitiveSetting{
+	Plugin_Password:  {field: func(params *SqlParams) *string { return &params.Password }, redact: maskValue},
+	Plugin_DSN:       {field: func(params *SqlParams) *string { return &params.DSN }, redact: redactConnectionStr},
+	Plugin_SecretURL: {field: func(params *SqlParams) *string { return &params.SecretURL }, redact: redactConnectionStr},
+}
+
+// the settings redact_fields can name - any other name is taken to be a record field
+var redactableSettings = map[string]func(params *SqlParams) *string{
+	Plugin_Host:            func(params *SqlParams) *string { return &params.Host },
+	Plugin_Port:            func(params *SqlParams) *string { return &params.Port },
+	Plugin_User:            func(params *SqlParams) *string { return &params.User },
+	Plugin_DBName:          func(params *SqlParams) *string { return &params.DBName },
+	Plugin_DBOptions:       func(params *SqlParams) *string { return &params.DBOptions },
+	Plugin_PasswordFile:    func(params *SqlParams) *string { return &params.PasswordFile },
+	Plugin_PasswordEnv:     func(params *SqlParams) *string { return &params.PasswordEnv },
+	Plugin_SecretField:     func(params *SqlParams) *string { return &params.SecretField },
+	Plugin_SecretTokenFile: func(params *SqlParams) *string { return &params.SecretTokenFile },
+	Plugin_TableName:       func(params *SqlParams) *string { return &params.TableName },
+	Plugin_WhereExpr:       func(params *SqlParams) *string { return &params.WhereExpr },
+	Plugin_Statement:       func(params *SqlParams) *string { return &params.Statement },
+	Plugin_TenantMapFile:   func(params *SqlParams) *string { return &params.TenantMapFile },
+	Plugin_TLSKeyFile:      func(params *SqlParams) *string { return &params.TLSKeyFile },
+}
+
+// a password or token given as a key value pair, as used by Postgres and SQL Server connection strings and URL queries
+var passwordPairRegex = regexp.MustCompile(`(?i)\b(password|passwd|pwd|token|access_token|secret|api_key)(\s*=\s*)('(?:[^'\\]|\\.)*'|[^;&\s]+)`)
+
+// the user and password at the start of a MySQL DSN, up to the last @
+var mysqlCredentialRegex = regexp.MustCompile(`^([^:/@]*):.*@`)
+
+var sensitiveMutex sync.Mutex
+
+// the real values of the redacted settings, by the key the params are stored under and then the setting
+var sensitiveValues = make(map[string]map[string]string)
+
+func maskValue(value string) string {
+	return redactedValue
+}
+
+// redact the password in a connection string, whether it is a URL, a set of key value pairs or a MySQL DSN
+func redactConnectionStr(connStr string) string {
+	if strings.Contains(connStr, "://") {
+		if connURL, err := url.Parse(connStr); err == nil {
+			_, hasPassword := connURL.User.Password()
+			if hasPassword {
+				// the URL would escape the redacted value, so it is added once the URL is built
+				connURL.User = url.User(connURL.User.Username())
+			}
+			connStr = connURL.String()
+			if hasPassword {
+				userInfo := connURL.User.String() + "@"
+				connStr = strings.Replace(connStr, userInfo, strings.TrimSuffix(userInfo, "@")+":"+redactedValue+"@", 1)
+			}
+		}
+	} else if !passwordPairRegex.MatchString(connStr) {
+		connStr = mysqlCredentialRegex.ReplaceAllString(connStr, "${1}:"+redactedValue+"@")
+	}
+	return passwordPairRegex.ReplaceAllString(connStr, "${1}${2}"+redactedValue)
+}
+
+// parse the redact_fields, splitting the names into the settings and the record fields
+func redactFieldNames(params *SqlParams) (map[string]sensitiveSetting, map[string]bool) {
+	settings := make(map[string]sensitiveSetting, len(sensitiveSettings))
+	for key, setting := range sensitiveSettings {
+		settings[key] = setting
+	}
+	recordFields := make(map[string]bool)
+	for _, name := range strings.Split(params.RedactFields, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		if field, isSetting := redactableSettings[name]; isSetting {
+			settings[name] = sensitiveSetting{field: field, redact: maskValue}
+		} else {
+			recordFields[name] = true
+		}
+	}
+	return settings, recordFields
+}
+
+// a copy of the params with the sensitive settings redacted, for logging
+func redactedParams(params *SqlParams) *SqlParams {
+	redacted := *params
+	settings, _ := redactFieldNames(params)
+	for _, setting := range settings {
+		if value := setting.field(&redacted); len(*value) > 0 {
+			*value = setting.redact(*value)
+		}
+	}
+	return &redacted
+}
+
+// hold the real values of the sensitive settings under the key, returning the redacted params to be stored
+func holdSensitiveParams(key string, params *SqlParams) *SqlParams {
+	settings, _ := redactFieldNames(params)
+	values := make(map[string]string)
+	for name, setting := range settings {
+		if value := *setting.field(params); len(value) > 0 {
+			values[name] = value
+		}
+	}
+
+	sensitiveMutex.Lock()
+	defer sensitiveMutex.Unlock()
+	if len(values) == 0 {
+		delete(sensitiveValues, key)
+	} else {
+		sensitiveValues[key] = values
+	}
+	return redactedParams(params)
+}
+
+// put the real values back into params retrieved from where they were stored under the key
+func restoreSensitiveParams(key string, params *SqlParams) {
+	sensitiveMutex.Lock()
+	defer sensitiveMutex.Unlock()
+	settings, _ := redactFieldNames(params)
+	for name, value := range sensitiveValues[key] {
+		if setting, found := settings[name]; found {
+			*setting.field(params) = value
+		}
+	}
+}
+
+// forget the values held under the key
+func releaseSensitiveParams(key string) {
+	sensitiveMutex.Lock()
+	defer sensitiveMutex.Unlock()
+	delete(sensitiveValues, key)
+}
+
+// forget the values held for every instance
+func releaseAllSensitiveParams() {
+	sensitiveMutex.Lock()
+	defer sensitiveMutex.Unlock()
+	sensitiveValues = make(map[string]map[string]string)
+}
+
+// a copy of a record, or the entries holding records, with the fields named in redact_fields masked so the
+// record can be logged
+func redactRecord(params *SqlParams, record interface{}) interface{} {
+	_, recordFields := redactFieldNames(params)
+	if len(recordFields) == 0 {
+		return record
+	}
+	return redactRecordValue(record, recordFields)
+}
+
+func redactRecordValue(value interface{}, recordFields map[string]bool) interface{} {
+	switch typedVal := value.(type) {
+	case map[string]string:
+		redacted := make(map[string]string, len(typedVal))
+		for key, val := range typedVal {
+			if recordFields[key] {
+				val = redactedValue
+			}
+			redacted[key] = val
+		}
+		return redacted
+	case recordValType:
+		return redactRecordValue(map[string]interface{}(typedVal), recordFields)
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(typedVal))
+		for key, val := range typedVal {
+			if recordFields[key] {
+				redacted[key] = redactedValue
+			} else {
+				redacted[key] = redactRecordValue(val, recordFields)
+			}
+		}
+		return redacted
+	case map[interface{}]interface{}:
+		redacted := make(map[interface{}]interface{}, len(typedVal))
+		for key, val := range typedVal {
+			if recordFields[keyToStr(key)] {
+				redacted[key] = redactedValue
+			} else {
+				redacted[key] = redactRecordValue(val, recordFields)
+			}
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(typedVal))
+		for idx, val := range typedVal {
+			redacted[idx] = redactRecordValue(val, recordFields)
+		}
+		return redacted
+	}
+	return value
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedactConnectionStr(t *testing.T) {
+	tests := []struct {
+		connStr  string
+		expected string
+	}{
+		{"postgres://fluent:secret@db:5432/logs?sslmode=disable", "postgres://fluent:*****@db:5432/logs?sslmode=disable"},
+		{"sqlserver://fluent:p%40ss@db:1433?database=logs", "sqlserver://fluent:*****@db:1433?database=logs"},
+		{"postgres://fluent@db/logs", "postgres://fluent@db/logs"},
+		{"https://vault:8200/v1/secret/data/db?token=abc&version=2", "https://vault:8200/v1/secret/data/db?token=*****&version=2"},
+		{"host=db user=fluent password='se cret' dbname=logs", "host=db user=fluent password=***** dbname=logs"},
+		{"host=db PASSWORD = secret", "host=db PASSWORD = *****"},
+		{"server=db;user id=fluent;pwd=secret;database=logs", "server=db;user id=fluent;pwd=*****;database=logs"},
+		{"fluent:secret@tcp(db:3306)/logs?parseTime=true", "fluent:*****@tcp(db:3306)/logs?parseTime=true"},
+		{"fluent:p@ss@tcp(db)/logs", "fluent:*****@tcp(db)/logs"},
+		{"file:/var/lib/logs.db?_txlock=immediate", "file:/var/lib/logs.db?_txlock=immediate"},
+	}
+	for _, test := range tests {
+		if redacted := redactConnectionStr(test.connStr); redacted != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.connStr, redacted, test.expected)
+		}
+	}
+}
+
+func TestRedactedParams(t *testing.T) {
+	params := &SqlParams{Host: "db", User: "fluent", Password: "secret", DSN: "fluent:secret@tcp(db)/logs",
+		RedactFields: "db_user, api_key"}
+	redacted := redactedParams(params)
+	if redacted.Password != redactedValue || redacted.DSN != "fluent:*****@tcp(db)/logs" || redacted.User != redactedValue {
+		t.Errorf("got password %s, DSN %s and user %s, expected them redacted", redacted.Password, redacted.DSN, redacted.User)
+	}
+	if redacted.Host != "db" || redacted.SecretURL != "" {
+		t.Errorf("got host %s and secret URL %s, expected them unchanged", redacted.Host, redacted.SecretURL)
+	}
+	if params.Password != "secret" || params.User != "fluent" {
+		t.Errorf("the original params were changed")
+	}
+}
+
+func TestHoldSensitiveParams(t *testing.T) {
+	const key = "redact-test"
+	defer releaseSensitiveParams(key)
+	params := &SqlParams{User: "fluent", Password: "secret", RedactFields: "db_user"}
+
+	stored := holdSensitiveParams(key, params)
+	if stored.Password != redactedValue || stored.User != redactedValue {
+		t.Fatalf("got password %s and user %s to store, expected them redacted", stored.Password, stored.User)
+	}
+	retrieved := *stored
+	restoreSensitiveParams(key, &retrieved)
+	if retrieved.Password != "secret" || retrieved.User != "fluent" {
+		t.Errorf("got password %s and user %s, expected the real values back", retrieved.Password, retrieved.User)
+	}
+
+	releaseSensitiveParams(key)
+	retrieved = *stored
+	restoreSensitiveParams(key, &retrieved)
+	if retrieved.Password != redactedValue {
+		t.Errorf("got password %s once released, expected it to stay redacted", retrieved.Password)
+	}
+}
+
+func TestRedactRecord(t *testing.T) {
+	record := map[interface{}]interface{}{
+		"msg":      "login",
+		"password": "x",
+		"nested":   map[interface{}]interface{}{"password": "y", "n": int64(1)},
+		"list":     []interface{}{map[string]interface{}{"password": "z", "ok": true}},
+	}
+	params := &SqlParams{RedactFields: "password, db_user"}
+	expected := map[interface{}]interface{}{
+		"msg":      "login",
+		"password": redactedValue,
+		"nested":   map[interface{}]interface{}{"password": redactedValue, "n": int64(1)},
+		"list":     []interface{}{map[string]interface{}{"password": redactedValue, "ok": true}},
+	}
+	if redacted := redactRecord(params, record); !reflect.DeepEqual(redacted, expected) {
+		t.Errorf("got %v, expected %v", redacted, expected)
+	}
+	if record["password"] != "x" {
+		t.Errorf("the original record was changed")
+	}
+
+	flat := map[string]string{"password": "x", "msg": "login"}
+	if redacted := redactRecord(params, flat); !reflect.DeepEqual(redacted, map[string]string{"password": redactedValue, "msg": "login"}) {
+		t.Errorf("got %v, expected the password redacted", redacted)
+	}
+
+	// db_user names a setting, so without any record fields the record is left as it is
+	params.RedactFields = "db_user"
+	if redacted := redactRecord(params, record); !reflect.DeepEqual(redacted, record) {
+		t.Errorf("got %v, expected the record unchanged", redacted)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+// Some things need to live for as long as a plugin instance, such as background workers. These can't be held in the
+// JSON context we give Fluent Bit, so we keep them in a registry keyed by the instance, and release them when the
+// instance exits
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the resources held for each plugin instance
+type instanceResources struct {
+	workers    []*backgroundWorker
+	tenants    *tenantResources
+	aggregator *windowAggregator
+	spool      *diskSpool
+	pool       *dbPool
+	metrics    *http.Server
+}
+
+var resourcesMutex sync.Mutex
+var resourcesRegistry = make(map[string]*instanceResources)
+var contextCounter int64 = 0
+
+// each instance gets a unique id when it is initialized, so we can tell apart instances that have
+// been given the same (or no) plugin_instance_id
+func nextContextId() string {
+	return strconv.FormatInt(atomic.AddInt64(&contextCounter, 1), 10)
+}
+
+// the key into the registry for the instance the params belong to
+func instanceKey(params *SqlParams) string {
+	return params.PluginName + "/" + params.InstanceName + "/" + params.ContextId
+}
+
+// get the resources for the instance, creating the entry if needed
+func getResources(params *SqlParams) *instanceResources {
+	resourcesMutex.Lock()
+	defer resourcesMutex.Unlock()
+	resources, found := resourcesRegistry[instanceKey(params)]
+	if !found {
+		resources = &instanceResources{pool: &dbPool{}}
+		resourcesRegistry[instanceKey(params)] = resources
+	}
+	return resources
+}
+
+// stop and release everything held for the instance
+func releaseInstanceResources(params *SqlParams) {
+	resourcesMutex.Lock()
+	resources, found := resourcesRegistry[instanceKey(params)]
+	delete(resourcesRegistry, instanceKey(params))
+	resourcesMutex.Unlock()
+	releaseSensitiveParams(instanceKey(params))
+
+	if found {
+		resources.release()
+	}
+}
+
+// used when we're told to exit but don't know which instance, so everything is released
+func releaseAllInstanceResources() {
+	resourcesMutex.Lock()
+	registry := resourcesRegistry
+	resourcesRegistry = make(map[string]*instanceResources)
+	resourcesMutex.Unlock()
+	releaseAllSensitiveParams()
+
+	for _, resources := range registry {
+		resources.release()
+	}
+}
+
+func (resources *instanceResources) release() {
+	for _, worker := range resources.workers {
+		worker.stopWorker()
+	}
+	resources.workers = nil
+	resources.spool = nil
+	// the workers have stopped, so we can write out any windows still open
+	if resources.aggregator != nil {
+		resources.aggregator.flushWindows(true)
+		resources.aggregator = nil
+	}
+	if resources.tenants != nil {
+		resources.tenants.release()
+		resources.tenants = nil
+	}
+	if resources.metrics != nil {
+		stopMetricsServer(resources.metrics)
+		resources.metrics = nil
+	}
+	if err := resources.pool.close(); err != nil {
+		log.Printf("error closing connection pool - %v", err)
+	}
+}
+
+// a goroutine that performs a task at a regular interval until it is stopped
+type backgroundWorker struct {
+	name string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// start a worker for the instance, the worker is registered so it is stopped when the instance is released
+func startWorker(params *SqlParams, name string, interval time.Duration, task func()) *backgroundWorker {
+	worker := &backgroundWorker{name: name, stop: make(chan struct{}), done: make(chan struct{})}
+	log.Printf("[%s]%s starting %s worker, running every %v", params.PluginName, params.InstanceName, name, interval)
+
+	go func() {
+		defer close(worker.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-worker.stop:
+				return
+			case <-ticker.C:
+				task()
+			}
+		}
+	}()
+
+	resources := getResources(params)
+	resourcesMutex.Lock()
+	resources.workers = append(resources.workers, worker)
+	resourcesMutex.Unlock()
+	return worker
+}
+
+// ask the worker to stop and wait for any task in progress to complete
+func (worker *backgroundWorker) stopWorker() {
+	close(worker.stop)
+	<-worker.done
+}
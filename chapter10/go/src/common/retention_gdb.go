@@ -0,0 +1,124 @@
+package main
+
+// For databases where the table isn't partitioned, a background worker enforces the retention period by deleting
+// the rows whose time_column is older than the retention. Rows are deleted in small batches, with a pause
+// between batches, so we never hold long locks on a table that is also being written to
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+const defaultRetentionInterval = time.Hour
+const defaultRetentionBatchSize = 1000
+const defaultRetentionRateLimit = 2
+
+// check the settings for the purge - only relevant if we have a retention period and we're not partitioning
+func validateRetentionParams(params *SqlParams) error {
+	if len(params.Retention) == 0 || len(params.PartitionBy) > 0 {
+		return nil
+	}
+	if len(params.TimeColumn) == 0 {
+		return errors.New(Plugin_Retention + " needs a " + Plugin_TimeColumn + " for " + params.PluginName)
+	}
+	if isTableTemplate(params.TableName) {
+		return errors.New(Plugin_Retention + " can't be used with a " + Plugin_TableName + " template for " + params.PluginName)
+	}
+	if params.DBType != PostgresDBType && params.DBType != mysqlDBType {
+		return errors.New(Plugin_Retention + " is not supported for " + params.DBType)
+	}
+	if params.RetentionBatch <= 0 {
+		params.RetentionBatch = defaultRetentionBatchSize
+	}
+	if params.RetentionRate <= 0 {
+		params.RetentionRate = defaultRetentionRateLimit
+	}
+	return nil
+}
+
+// the statement to delete a batch of expired rows. Postgres doesn't support a limit on a delete, so we
+// select the physical row ids of the batch instead
+func buildPurgeExpr(params *SqlParams) string {
+	batchStr := strconv.Itoa(params.RetentionBatch)
+	if params.DBType == PostgresDBType {
+		return "DELETE FROM " + params.TableName + " WHERE ctid IN (SELECT ctid FROM " + params.TableName +
+			" WHERE " + params.TimeColumn + " < $1 LIMIT " + batchStr + ")"
+	}
+	return "DELETE FROM " + params.TableName + " WHERE " + params.TimeColumn + " < ? LIMIT " + batchStr
+}
+
+// delete the expired rows batch by batch, until there are none left or we run out of time. Anything left
+// will be picked up the next time the worker runs
+func purgeExpiredRows(params *SqlParams) (int64, error) {
+	retention, err := parseDurationStr(params.Retention)
+	if err != nil || retention <= 0 {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), maintenanceTimeout)
+	defer cancel()
+
+	db, err := getDB(params)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().UTC().Add(-retention)
+	sqlStmt := buildPurgeExpr(params)
+	pause := time.Second / time.Duration(params.RetentionRate)
+	var purged int64 = 0
+
+	for {
+		result, err := db.ExecContext(ctx, sqlStmt, cutoff)
+		if err != nil {
+			return purged, err
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return purged, err
+		}
+		purged = purged + deleted
+		if deleted < int64(params.RetentionBatch) {
+			return purged, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return purged, nil
+		case <-time.After(pause):
+		}
+	}
+}
+
+// run a purge and report on how it went
+func runRetentionPurge(params *SqlParams) {
+	start := time.Now()
+	purged, err := purgeExpiredRows(params)
+	total := incrementMetric(params, "retention_purged_rows_total", map[string]string{"table": params.TableName}, purged)
+	if err != nil {
+		incrementMetric(params, "retention_purge_errors_total", map[string]string{"table": params.TableName}, 1)
+		log.Printf("[%s]%s retention purge of %s failed after deleting %d rows - %v", params.PluginName, params.InstanceName, params.TableName, purged, err)
+		return
+	}
+	log.Printf("[%s]%s retention purge of %s deleted %d rows older than %s in %v, %d rows purged in total",
+		params.PluginName, params.InstanceName, params.TableName, purged, params.Retention, time.Since(start), total)
+}
+
+// start the worker that will purge the expired rows, if we have a retention period and aren't using partitions
+func startRetentionPurge(params *SqlParams) {
+	if len(params.Retention) == 0 || len(params.PartitionBy) > 0 {
+		return
+	}
+
+	interval, err := parseDurationStr(params.RetentionCheck)
+	if err != nil || interval <= 0 {
+		interval = defaultRetentionInterval
+	}
+	workerParams := *params
+	startWorker(params, "retention", interval, func() {
+		runRetentionPurge(&workerParams)
+	})
+}
@@ -0,0 +1,264 @@
+package main
+
+// Allows the output table_name to be a template that is resolved for each record, e.g. logs_${tag[1]}_${record['level']}_%Y%m%d
+// The template can use:
+//   ${tag}            - the whole tag
+//   ${tag[n]}         - the nth part of the tag when split on '.', starting from 0
+//   ${record['key']}  - a value from the record, nested values can be reached with record['a']['b'] or $a['b']
+//   %Y %y %m %d %H %M %S %j - the event timestamp in UTC formatted as per strftime
+// As the resolved name ends up in the SQL we check it against an allowlist and/or a regular expression.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// if no table_regex or table_allowlist is configured, resolved names have to be simple identifiers (optionally schema qualified)
+const defaultTableRegex = `^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`
+
+type templatePartKind int
+
+const (
+	literalPart templatePartKind = iota
+	tagPart
+	tagIndexPart
+	recordPart
+	timePart
+)
+
+type templatePart struct {
+	kind    templatePartKind
+	literal string     // the text for a literal, or the strftime character for a time part
+	tagIdx  int        // the tag element for tagIndexPart
+	path    recordPath // the record accessor for recordPart
+}
+
+// the parsed form of a template - the table_name or tenant_key
+type recordTemplate struct {
+	text   string
+	parts  []templatePart
+	static bool
+}
+
+// the parsed form of the table_name along with the checks applied to the resolved names
+type tableTemplate struct {
+	*recordTemplate
+	allowlist map[string]bool
+	nameRegex *regexp.Regexp
+}
+
+// the strftime characters we support in table name templates
+var strftimeLayouts = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'H': "15",
+	'M': "04",
+	'S': "05",
+	'j': "002",
+}
+
+// does the table name (or other template) need resolving per record
+func isTableTemplate(tableName string) bool {
+	return strings.Contains(tableName, "${") || strings.Contains(tableName, "%")
+}
+
+// parse the template text into its literal and variable parts
+func parseRecordTemplate(text string) (*recordTemplate, error) {
+	tmpl := &recordTemplate{text: text, static: !isTableTemplate(text)}
+	if tmpl.static {
+		return tmpl, nil
+	}
+
+	literal := ""
+	for len(text) > 0 {
+		switch {
+		case strings.HasPrefix(text, "${"):
+			end := strings.IndexByte(text, '}')
+			if end < 0 {
+				return nil, errors.New("missing } in " + tmpl.text)
+			}
+			part, err := parseTemplateVariable(text[2:end])
+			if err != nil {
+				return nil, err
+			}
+			if len(literal) > 0 {
+				tmpl.parts = append(tmpl.parts, templatePart{kind: literalPart, literal: literal})
+				literal = ""
+			}
+			tmpl.parts = append(tmpl.parts, part)
+			text = text[end+1:]
+
+		case text[0] == '%' && len(text) > 1:
+			if text[1] == '%' {
+				literal = literal + "%"
+			} else {
+				if _, known := strftimeLayouts[text[1]]; !known {
+					return nil, errors.New("unsupported time format %" + string(text[1]) + " in " + tmpl.text)
+				}
+				if len(literal) > 0 {
+					tmpl.parts = append(tmpl.parts, templatePart{kind: literalPart, literal: literal})
+					literal = ""
+				}
+				tmpl.parts = append(tmpl.parts, templatePart{kind: timePart, literal: string(text[1])})
+			}
+			text = text[2:]
+
+		default:
+			literal = literal + text[:1]
+			text = text[1:]
+		}
+	}
+	if len(literal) > 0 {
+		tmpl.parts = append(tmpl.parts, templatePart{kind: literalPart, literal: literal})
+	}
+	return tmpl, nil
+}
+
+// parse the table name template along with the allowlist and regex that will be applied
+func parseTableTemplate(params *SqlParams) (*tableTemplate, error) {
+	parsed, err := parseRecordTemplate(params.TableName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s - %v", Plugin_TableName, err)
+	}
+	tmpl := &tableTemplate{recordTemplate: parsed}
+	if tmpl.static {
+		return tmpl, nil
+	}
+
+	if len(strings.TrimSpace(params.TableAllowlist)) > 0 {
+		tmpl.allowlist = make(map[string]bool)
+		for _, name := range strings.Split(params.TableAllowlist, ",") {
+			tmpl.allowlist[strings.TrimSpace(name)] = true
+		}
+	}
+
+	regexStr := params.TableRegex
+	if len(regexStr) == 0 && tmpl.allowlist == nil {
+		regexStr = defaultTableRegex
+	}
+	if len(regexStr) > 0 {
+		tmpl.nameRegex, err = regexp.Compile(regexStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s - %v", Plugin_TableRegex, err)
+		}
+	}
+
+	return tmpl, nil
+}
+
+// work out what a ${...} variable refers to
+func parseTemplateVariable(variable string) (templatePart, error) {
+	variable = strings.TrimSpace(variable)
+	if variable == "tag" {
+		return templatePart{kind: tagPart}, nil
+	}
+	if strings.HasPrefix(variable, "tag[") && strings.HasSuffix(variable, "]") {
+		idx, err := strconv.Atoi(variable[4 : len(variable)-1])
+		if err != nil || idx < 0 {
+			return templatePart{}, errors.New("invalid tag index in " + variable)
+		}
+		return templatePart{kind: tagIndexPart, tagIdx: idx}, nil
+	}
+	path, err := parseRecordPath(variable)
+	if err != nil {
+		return templatePart{}, err
+	}
+	return templatePart{kind: recordPart, path: path}, nil
+}
+
+// produce the text for the record from the template. An error means a value the template needs is missing
+func (tmpl *recordTemplate) expand(recd FlushRecord) (string, error) {
+	if tmpl.static {
+		return tmpl.text, nil
+	}
+
+	var result strings.Builder
+	for _, part := range tmpl.parts {
+		switch part.kind {
+		case literalPart:
+			result.WriteString(part.literal)
+		case tagPart:
+			result.WriteString(recd.Tag)
+		case tagIndexPart:
+			tagParts := strings.Split(recd.Tag, ".")
+			if part.tagIdx >= len(tagParts) {
+				return "", fmt.Errorf("tag %s has no element %d", recd.Tag, part.tagIdx)
+			}
+			result.WriteString(tagParts[part.tagIdx])
+		case recordPart:
+			val, found := lookupRecordPath(recd.Record, part.path)
+			if !found || val == nil {
+				return "", fmt.Errorf("record has no value for %v needed by %s", part.path, tmpl.text)
+			}
+			result.WriteString(typeToStr(toDBValue(val), false))
+		case timePart:
+			result.WriteString(recd.Timestamp.UTC().Format(strftimeLayouts[part.literal[0]]))
+		}
+	}
+	return result.String(), nil
+}
+
+// produce the table name for the record. An error means the record can't be routed and should be rejected
+func (tmpl *tableTemplate) resolve(params *SqlParams, recd FlushRecord) (string, error) {
+	if tmpl.static {
+		return params.TableName, nil
+	}
+
+	tableName, err := tmpl.expand(recd)
+	if err != nil {
+		return "", err
+	}
+	if tmpl.allowlist != nil && !tmpl.allowlist[tableName] {
+		return "", errors.New("table " + tableName + " is not in the " + Plugin_TableAllowlist)
+	}
+	if tmpl.nameRegex != nil && !tmpl.nameRegex.MatchString(tableName) {
+		return "", errors.New("table " + tableName + " does not match " + tmpl.nameRegex.String())
+	}
+	return tableName, nil
+}
+
+// records grouped by the table they resolve to - the order the tables were first seen is retained, as is the
+// order of the records for each table
+type tableGroup struct {
+	tableName string
+	records   []FlushRecord
+	unhashed  bool // the records don't carry the hash_column, such as those for the unmatched_table
+}
+
+// split the records by their resolved table name. Records we can't resolve a table for are returned separately
+// along with the reason. In cdc mode the order of the changes matters, so rather than gathering all the records for
+// a table together, a new group is started each time the table changes
+func (tmpl *tableTemplate) groupRecords(params *SqlParams, records []FlushRecord) ([]*tableGroup, []FlushRecord, []error) {
+	var groups []*tableGroup
+	var groupIdx = make(map[string]*tableGroup)
+	var unrouted []FlushRecord
+	var unroutedErrs []error
+
+	for _, recd := range records {
+		tableName, err := tmpl.resolve(params, recd)
+		if err != nil {
+			unrouted = append(unrouted, recd)
+			unroutedErrs = append(unroutedErrs, err)
+			continue
+		}
+		group, found := groupIdx[tableName]
+		if params.WriteMode == writeModeCDC {
+			found = len(groups) > 0 && groups[len(groups)-1].tableName == tableName
+			if found {
+				group = groups[len(groups)-1]
+			}
+		}
+		if !found {
+			group = &tableGroup{tableName: tableName}
+			groupIdx[tableName] = group
+			groups = append(groups, group)
+		}
+		group.records = append(group.records, recd)
+	}
+	return groups, unrouted, unroutedErrs
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolveTableTemplate(t *testing.T) {
+	recd := FlushRecord{
+		Tag:       "app.web.prod",
+		Timestamp: time.Date(2024, 2, 9, 23, 5, 7, 0, time.FixedZone("CET", 3600)),
+		Record: RowDefinition{
+			"level":      []byte("error"),
+			"kubernetes": map[interface{}]interface{}{"namespace": "shop"},
+		},
+	}
+	tests := []struct {
+		tableName string
+		allowlist string
+		regex     string
+		expected  string
+	}{
+		{"app_logs", "", "", "app_logs"},
+		{"logs_${tag[1]}", "", "", "logs_web"},
+		{"logs_${record['level']}", "", "", "logs_error"},
+		{"logs_${record['kubernetes']['namespace']}", "", "", "logs_shop"},
+		{"logs_${$kubernetes['namespace']}", "", "", "logs_shop"},
+		{"logs_%Y%m%d", "", "", "logs_20240209"},
+		{"logs_%H%M%S_%j_%y", "", "", "logs_220507_040_24"},
+		{"logs_${tag[0]}_${tag[2]}", "logs_app_prod,logs_app_test", "", "logs_app_prod"},
+		{"logs.${tag[1]}", "", `^logs\.[a-z]+$`, "logs.web"},
+	}
+	for _, test := range tests {
+		params := &SqlParams{TableName: test.tableName, TableAllowlist: test.allowlist, TableRegex: test.regex}
+		tmpl, err := parseTableTemplate(params)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.tableName, err)
+			continue
+		}
+		tableName, err := tmpl.resolve(params, recd)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.tableName, err)
+		} else if tableName != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.tableName, tableName, test.expected)
+		}
+	}
+}
+
+func TestResolveTableTemplateRejects(t *testing.T) {
+	recd := FlushRecord{Tag: "app.web", Record: RowDefinition{"level": "error", "bad": "x; DROP TABLE y", "null": nil}}
+	tests := []struct {
+		tableName string
+		allowlist string
+		regex     string
+	}{
+		{"logs_${tag[5]}", "", ""},
+		{"logs_${record['missing']}", "", ""},
+		{"logs_${record['null']}", "", ""},
+		{"logs_${record['bad']}", "", ""},
+		{"logs_${record['level']}", "logs_info", ""},
+		{"logs_${record['level']}", "", "^logs_(info|warn)$"},
+	}
+	for _, test := range tests {
+		params := &SqlParams{TableName: test.tableName, TableAllowlist: test.allowlist, TableRegex: test.regex}
+		tmpl, err := parseTableTemplate(params)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.tableName, err)
+			continue
+		}
+		if tableName, err := tmpl.resolve(params, recd); err == nil {
+			t.Errorf("%s: resolved to %s, expected an error", test.tableName, tableName)
+		}
+	}
+}
+
+func TestParseTableTemplateErrors(t *testing.T) {
+	for _, params := range []*SqlParams{
+		{TableName: "logs_${tag[1]"},
+		{TableName: "logs_${tag[x]}"},
+		{TableName: "logs_${tag[-1]}"},
+		{TableName: "logs_%Q"},
+		{TableName: "logs_${record['level'}"},
+		{TableName: "logs_${tag}", TableRegex: "("},
+	} {
+		if _, err := parseTableTemplate(params); err == nil {
+			t.Errorf("%s: expected an error", params.TableName)
+		}
+	}
+}
+
+func TestGroupRecords(t *testing.T) {
+	records := []FlushRecord{
+		{Tag: "a.web", Record: RowDefinition{"n": 1}},
+		{Tag: "a.db", Record: RowDefinition{"n": 2}},
+		{Tag: "a", Record: RowDefinition{"n": 3}},
+		{Tag: "a.web", Record: RowDefinition{"n": 4}},
+	}
+	params := &SqlParams{TableName: "logs_${tag[1]}", WriteMode: writeModeInsert}
+	tmpl, err := parseTableTemplate(params)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	groups, unrouted, unroutedErrs := tmpl.groupRecords(params, records)
+	if len(unrouted) != 1 || len(unroutedErrs) != 1 || unrouted[0].Record["n"] != 3 {
+		t.Errorf("got unrouted %v, expected the record without a second tag element", unrouted)
+	}
+	if len(groups) != 2 || groups[0].tableName != "logs_web" || groups[1].tableName != "logs_db" {
+		t.Fatalf("got groups %v, expected logs_web then logs_db", groups)
+	}
+	if len(groups[0].records) != 2 || groups[0].records[0].Record["n"] != 1 || groups[0].records[1].Record["n"] != 4 {
+		t.Errorf("got %v for logs_web, expected records 1 and 4 in order", groups[0].records)
+	}
+
+	// the order of the changes matters in cdc mode, so a new group is started each time the table changes
+	params.WriteMode = writeModeCDC
+	groups, _, _ = tmpl.groupRecords(params, records)
+	if len(groups) != 3 || groups[0].tableName != "logs_web" || groups[1].tableName != "logs_db" || groups[2].tableName != "logs_web" {
+		t.Errorf("got %d groups in cdc mode, expected logs_web, logs_db and logs_web", len(groups))
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+// Rather than writing the db_password in the Fluent Bit configuration, the password can come from a secret source -
+// a file such as a Docker or Kubernetes secret (db_password_file), an environment variable (db_password_env), or a
+// provider named by db_secret_provider, such as a Vault style HTTP secret store. The password is only held in memory,
+// so it never appears in the plugin's context or the environment variables the input keeps its settings in.
+// Connections are opened through a connector that asks for the password each time, and when the database rejects
+// it the password is fetched again, so a rotated password is picked up without restarting Fluent Bit.
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const secretProviderFile = "file"
+const secretProviderEnv = "env"
+const secretProviderHTTP = "http"
+const defaultSecretField = "password"
+const secretFetchTimeout = 10 * time.Second
+
+// a password fetched within this time isn't fetched again, so a password that is simply wrong doesn't have every
+// connection attempt calling the secret store
+const secretRefreshInterval = 10 * time.Second
+
+// a source of the database password
+type secretProvider interface {
+	// identifies the secret for the cache and the logs, so it mustn't include the secret itself
+	source() string
+	// retrieve the current password
+	fetch(ctx context.Context) (string, error)
+}
+
+// the providers that can be named by db_secret_provider. db_password_file and db_password_env are shorthand for the
+// file and env providers
+var secretProviders = map[string]func(params *SqlParams) (secretProvider, error){
+	secretProviderFile: newFileSecret,
+	secretProviderEnv:  newEnvSecret,
+	secretProviderHTTP: newHTTPSecret,
+}
+
+// a password fetched from a provider, and when
+type cachedSecret struct {
+	value     string
+	fetchedAt time.Time
+}
+
+var secretMutex sync.Mutex
+var secretCache = make(map[string]cachedSecret)
+
+// a password held in a file, read each time it is fetched so a replaced file is picked up
+type fileSecret struct {
+	path string
+}
+
+func newFileSecret(params *SqlParams) (secretProvider, error) {
+	if len(params.PasswordFile) == 0 {
+		return nil, errors.New("the " + secretProviderFile + " secret provider needs a " + Plugin_PasswordFile + " for " + params.PluginName)
+	}
+	return fileSecret{path: params.PasswordFile}, nil
+}
+
+func (secret fileSecret) source() string {
+	return secretProviderFile + ":" + secret.path
+}
+
+// secrets mounted from Kubernetes or written with echo usually end with a new line, which isn't part of the password
+func (secret fileSecret) fetch(ctx context.Context) (string, error) {
+	content, err := os.ReadFile(secret.path)
+	if err != nil {
+		return "", errors.New(Plugin_PasswordFile + " can't be read - " + err.Error())
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// a password held in an environment variable
+type envSecret struct {
+	name string
+}
+
+func newEnvSecret(params *SqlParams) (secretProvider, error) {
+	if len(params.PasswordEnv) == 0 {
+		return nil, errors.New("the " + secretProviderEnv + " secret provider needs a " + Plugin_PasswordEnv + " for " + params.PluginName)
+	}
+	return envSecret{name: params.PasswordEnv}, nil
+}
+
+func (secret envSecret) source() string {
+	return secretProviderEnv + ":" + secret.name
+}
+
+func (secret envSecret) fetch(ctx context.Context) (string, error) {
+	value, found := os.LookupEnv(secret.name)
+	if !found {
+		return "", errors.New(Plugin_PasswordEnv + " " + secret.name + " is not set")
+	}
+	return value, nil
+}
+
+// a password held in an HTTP secret store. The response is a JSON object holding the password in the
+// db_secret_field, either at the top level or within a data object as Vault's key value engines return it
+// (data.data for version 2). The token, if needed, is read from the db_secret_token_file each time, so it can be
+// rotated as well, and is sent as both a Vault token and a bearer token
+type httpSecret struct {
+	url       string
+	field     string
+	tokenFile string
+}
+
+func newHTTPSecret(params *SqlParams) (secretProvider, error) {
+	secretURL, err := url.Parse(params.SecretURL)
+	if err != nil || len(params.SecretURL) == 0 {
+		return nil, errors.New("the " + secretProviderHTTP + " secret provider needs a valid " + Plugin_SecretURL + " for " + params.PluginName)
+	}
+	if secretURL.Scheme != "http" && secretURL.Scheme != "https" {
+		return nil, errors.New(Plugin_SecretURL + " should be an http or https URL for " + params.PluginName)
+	}
+	field := params.SecretField
+	if len(field) == 0 {
+		field = defaultSecretField
+	}
+	return httpSecret{url: params.SecretURL, field: field, tokenFile: params.SecretTokenFile}, nil
+}
+
+func (secret httpSecret) source() string {
+	return secretProviderHTTP + ":" + redactConnectionStr(secret.url) + "#" + secret.field
+}
+
+func (secret httpSecret) fetch(ctx context.Context) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, secret.url, nil)
+	if err != nil {
+		return "", err
+	}
+	if len(secret.tokenFile) > 0 {
+		token, err := os.ReadFile(secret.tokenFile)
+		if err != nil {
+			return "", errors.New(Plugin_SecretTokenFile + " can't be read - " + err.Error())
+		}
+		request.Header.Set("X-Vault-Token", strings.TrimSpace(string(token)))
+		request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	// the client's errors include the URL, which may hold a token
+	response, err := http.DefaultClient.Do(request)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return "", errors.New("secret store request failed - " + urlErr.Err.Error())
+	}
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("secret store returned %s", response.Status)
+	}
+	var body map[string]interface{}
+	if err = json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return "", errors.New("secret store response isn't a JSON object - " + err.Error())
+	}
+	value, found := secretField(body, secret.field)
+	if !found {
+		return "", errors.New("secret store response doesn't hold " + secret.field)
+	}
+	return value, nil
+}
+
+// find the field in the response, looking within the data objects when it isn't at the top level
+func secretField(body map[string]interface{}, field string) (string, bool) {
+	if value, found := body[field].(string); found {
+		return value, true
+	}
+	if data, found := body["data"].(map[string]interface{}); found {
+		return secretField(data, field)
+	}
+	return "", false
+}
+
+// the provider for the password, or nil when the db_password is used as it is
+func getSecretProvider(params *SqlParams) (secretProvider, error) {
+	name := params.SecretProvider
+	switch {
+	case len(name) > 0:
+	case len(params.PasswordFile) > 0:
+		name = secretProviderFile
+	case len(params.PasswordEnv) > 0:
+		name = secretProviderEnv
+	}
+	if len(name) == 0 {
+		return nil, nil
+	}
+	newProvider, known := secretProviders[name]
+	if !known {
+		return nil, errors.New("Unknown " + Plugin_SecretProvider + " " + name + " for " + params.PluginName)
+	}
+	return newProvider(params)
+}
+
+// check only one source of the password is given, and that its provider has what it needs
+func validateSecretParams(params *SqlParams) error {
+	params.PasswordFile = strings.TrimSpace(params.PasswordFile)
+	params.PasswordEnv = strings.TrimSpace(params.PasswordEnv)
+	params.SecretProvider = strings.ToLower(strings.TrimSpace(params.SecretProvider))
+	params.SecretURL = strings.TrimSpace(params.SecretURL)
+	params.SecretField = strings.TrimSpace(params.SecretField)
+	params.SecretTokenFile = strings.TrimSpace(params.SecretTokenFile)
+
+	// naming the file or env provider only says how the db_password_file or db_password_env is used, so it isn't
+	// another source of the password
+	var sources []string
+	for key, value := range map[string]string{Plugin_Password: params.Password, Plugin_PasswordFile: params.PasswordFile,
+		Plugin_PasswordEnv: params.PasswordEnv, Plugin_SecretProvider: params.SecretProvider} {
+		isShorthand := key == Plugin_SecretProvider && (value == secretProviderFile || value == secretProviderEnv)
+		if len(value) > 0 && !isShorthand {
+			sources = append(sources, key)
+		}
+	}
+	if len(sources) > 1 {
+		return errors.New("only one of " + Plugin_Password + ", " + Plugin_PasswordFile + ", " + Plugin_PasswordEnv + " and " +
+			Plugin_SecretProvider + " can be set for " + params.PluginName)
+	}
+
+	provider, err := getSecretProvider(params)
+	if err != nil || provider == nil {
+		return err
+	}
+	if len(params.DSN) > 0 {
+		return errors.New(sources[0] + " can't be combined with a " + Plugin_DSN + " for " + params.PluginName)
+	}
+	if !getDialect(params).usesServer() {
+		return errors.New(sources[0] + " is not applicable to " + params.DBType + " for " + params.PluginName)
+	}
+	if params.SecretProvider == secretProviderHTTP && strings.HasPrefix(strings.ToLower(params.SecretURL), "http:") {
+		log.Printf("[%s]%s %s isn't using https - the password will be sent unencrypted", params.PluginName, params.InstanceName, Plugin_SecretURL)
+	}
+	return nil
+}
+
+// the password from the provider, fetched when it isn't already held or when refresh asks for it again
+func getSecret(ctx context.Context, params *SqlParams, provider secretProvider, refresh bool) (string, error) {
+	secretMutex.Lock()
+	defer secretMutex.Unlock()
+
+	cached, found := secretCache[provider.source()]
+	if found && (!refresh || time.Since(cached.fetchedAt) < secretRefreshInterval) {
+		return cached.value, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, secretFetchTimeout)
+	defer cancel()
+	value, err := provider.fetch(ctx)
+	if err != nil {
+		return "", errors.New("unable to fetch the password from " + provider.source() + " - " + err.Error())
+	}
+	if found && value == cached.value {
+		log.Printf("[%s]%s password from %s is unchanged", params.PluginName, params.InstanceName, provider.source())
+	}
+	secretCache[provider.source()] = cachedSecret{value: value, fetchedAt: time.Now()}
+	return value, nil
+}
+
+// opens connections with the password from the secret provider, fetching it again once when the database
+// rejects it
+type secretConnector struct {
+	params   *SqlParams
+	provider secretProvider
+	driver   driver.Driver
+}
+
+func (connector *secretConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := connector.connect(ctx, false)
+	if err != nil && getDialect(connector.params).authFailed(err) {
+		log.Printf("[%s]%s authentication failed, fetching the password from %s again - %v", connector.params.PluginName,
+			connector.params.InstanceName, connector.provider.source(), err)
+		conn, err = connector.connect(ctx, true)
+	}
+	return conn, err
+}
+
+func (connector *secretConnector) connect(ctx context.Context, refresh bool) (driver.Conn, error) {
+	password, err := getSecret(ctx, connector.params, connector.provider, refresh)
+	if err != nil {
+		return nil, err
+	}
+	connParams := *connector.params
+	connParams.Password = password
+	connStr := buildConnectionStr(&connParams)
+
+	// the drivers that can take a context use it, so the connection doesn't outlast the caller's timeout
+	if driverCtx, isCtx := connector.driver.(driver.DriverContext); isCtx {
+		dsnConnector, err := driverCtx.OpenConnector(connStr)
+		if err != nil {
+			return nil, err
+		}
+		return dsnConnector.Connect(ctx)
+	}
+	return connector.driver.Open(connStr)
+}
+
+func (connector *secretConnector) Driver() driver.Driver {
+	return connector.driver
+}
+
+// open the database, using a secretConnector when the password comes from a provider
+func openDB(params *SqlParams) (*sql.DB, error) {
+	provider, err := getSecretProvider(params)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(params.DBType, buildConnectionStr(params))
+	if err != nil || provider == nil {
+		return db, err
+	}
+
+	// database/sql doesn't give access to the registered drivers, so we take the driver from a handle we don't use
+	dbDriver := db.Driver()
+	db.Close()
+	return sql.OpenDB(&secretConnector{params: params, provider: provider, driver: dbDriver}), nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// a secret store serving the body for each path, and checking the token when one is expected
+type testSecretStore struct {
+	mutex     sync.Mutex
+	responses map[string]string
+	token     string
+	requests  int
+}
+
+func (store *testSecretStore) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.requests++
+	if len(store.token) > 0 && (request.Header.Get("X-Vault-Token") != store.token || request.Header.Get("Authorization") != "Bearer "+store.token) {
+		http.Error(writer, "permission denied", http.StatusForbidden)
+		return
+	}
+	body, found := store.responses[request.URL.Path]
+	if !found {
+		http.NotFound(writer, request)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write([]byte(body))
+}
+
+func (store *testSecretStore) set(path string, body string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.responses[path] = body
+}
+
+func newTestSecretStore(t *testing.T) (*testSecretStore, *httptest.Server) {
+	store := &testSecretStore{responses: map[string]string{
+		"/v1/secret/db":      `{"lease_duration": 3600, "data": {"password": "kv1-pass", "user": "logs"}}`,
+		"/v1/secret/data/db": `{"data": {"data": {"password": "kv2-pass"}, "metadata": {"version": 3}}}`,
+		"/plain":             `{"password": "plain-pass"}`,
+		"/other":             `{"data": {"db_pass": "other-pass"}}`,
+		"/missing":           `{"data": {"data": {"user": "logs"}}}`,
+		"/text":              `password=secret`,
+	}}
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+	return store, server
+}
+
+func TestHTTPSecretFetch(t *testing.T) {
+	store, server := newTestSecretStore(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("s.token\n"), 0600); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	store.token = "s.token"
+
+	tests := []struct {
+		path      string
+		field     string
+		tokenFile string
+		expected  string
+		errText   string
+	}{
+		{"/v1/secret/db", "", tokenFile, "kv1-pass", ""},
+		{"/v1/secret/data/db", "", tokenFile, "kv2-pass", ""},
+		{"/plain", "", tokenFile, "plain-pass", ""},
+		{"/other", "db_pass", tokenFile, "other-pass", ""},
+		{"/missing", "", tokenFile, "", "doesn't hold password"},
+		{"/text", "", tokenFile, "", "isn't a JSON object"},
+		{"/unknown", "", tokenFile, "", "404 Not Found"},
+		{"/v1/secret/db", "", "", "", "403 Forbidden"},
+		{"/v1/secret/db", "", filepath.Join(t.TempDir(), "none"), "", Plugin_SecretTokenFile + " can't be read"},
+	}
+	for _, test := range tests {
+		provider, err := newHTTPSecret(&SqlParams{SecretURL: server.URL + test.path, SecretField: test.field, SecretTokenFile: test.tokenFile})
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", test.path, err)
+		}
+		value, err := provider.fetch(context.Background())
+		if len(test.errText) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.errText) {
+				t.Errorf("%s: got %v, expected an error containing %s", test.path, err, test.errText)
+			}
+			continue
+		}
+		if err != nil || value != test.expected {
+			t.Errorf("%s: got %s and %v, expected %s", test.path, value, err, test.expected)
+		}
+	}
+}
+
+func TestHTTPSecretUnavailable(t *testing.T) {
+	_, server := newTestSecretStore(t)
+	secretURL := server.URL + "/plain?token=abc123"
+	server.Close()
+
+	provider, err := newHTTPSecret(&SqlParams{SecretURL: secretURL})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := provider.fetch(context.Background()); err == nil || strings.Contains(err.Error(), "abc123") {
+		t.Errorf("got %v, expected an error without the URL's token", err)
+	}
+}
+
+// a driver accepting only the current password, rejecting others as Postgres does
+type testAuthDriver struct {
+	mutex    sync.Mutex
+	password string
+	opened   int
+}
+
+func (authDriver *testAuthDriver) Open(connStr string) (driver.Conn, error) {
+	authDriver.mutex.Lock()
+	defer authDriver.mutex.Unlock()
+	if !strings.Contains(connStr, " password="+pgConnValue(authDriver.password)+" ") {
+		return nil, &pq.Error{Code: "28P01", Message: "password authentication failed"}
+	}
+	authDriver.opened++
+	return &testConn{connector: &testConnector{}}, nil
+}
+
+func (authDriver *testAuthDriver) rotate(password string) {
+	authDriver.mutex.Lock()
+	defer authDriver.mutex.Unlock()
+	authDriver.password = password
+}
+
+// as if the password had been fetched longer ago than the refresh interval
+func expireSecret(provider secretProvider) {
+	secretMutex.Lock()
+	defer secretMutex.Unlock()
+	cached := secretCache[provider.source()]
+	cached.fetchedAt = time.Now().Add(-2 * secretRefreshInterval)
+	secretCache[provider.source()] = cached
+}
+
+func TestSecretRotation(t *testing.T) {
+	store, server := newTestSecretStore(t)
+	params := &SqlParams{PluginName: "gdb-test", DBType: PostgresDBType, Host: "db", Port: "5432", User: "logs", DBName: "logs",
+		SecretProvider: secretProviderHTTP, SecretURL: server.URL + "/rotated"}
+	store.set("/rotated", `{"data": {"data": {"password": "first"}}}`)
+	provider, err := getSecretProvider(params)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	authDriver := &testAuthDriver{password: "first"}
+	connector := &secretConnector{params: params, provider: provider, driver: authDriver}
+
+	if _, err := connector.Connect(context.Background()); err != nil || store.requests != 1 {
+		t.Fatalf("got %v after %d requests, expected to connect with the first password", err, store.requests)
+	}
+	if _, err := connector.Connect(context.Background()); err != nil || store.requests != 1 {
+		t.Errorf("got %v after %d requests, expected the password to be held", err, store.requests)
+	}
+
+	// the password is rotated, and the rejected password is fetched again
+	store.set("/rotated", `{"data": {"data": {"password": "second"}}}`)
+	authDriver.rotate("second")
+	expireSecret(provider)
+	if _, err := connector.Connect(context.Background()); err != nil || store.requests != 2 || authDriver.opened != 3 {
+		t.Errorf("got %v after %d requests, expected to connect with the rotated password", err, store.requests)
+	}
+
+	// a password just fetched isn't fetched again, so a wrong password doesn't have every attempt calling the store
+	authDriver.rotate("third")
+	if _, err := connector.Connect(context.Background()); !getDialect(params).authFailed(err) || store.requests != 2 {
+		t.Errorf("got %v after %d requests, expected the authentication to fail without a fetch", err, store.requests)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+// When the database can't be reached we would normally ask Fluent Bit to retry, which means everything depends on
+// Fluent Bit's retry limits and buffering. With spool_dir set, chunks that fail with a retryable error are written to
+// segment files in a directory for the instance, and a background worker replays them in order once the database is
+// available again. While there is anything in the spool, new chunks are added to the spool rather than written
+// directly, so the records still reach the database in the order we received them.
+// Each line of a segment file is a chunk as JSON. When the spool grows beyond spool_max_size the oldest segments
+// are dropped. As the spool directory is named after the plugin_instance_id, instances sharing a spool_dir need
+// different ids, and the spool survives a restart.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const spoolSuffix = ".spool"
+const defaultSpoolMaxSize = 100 * 1024 * 1024
+const defaultSpoolSegmentSize = 8 * 1024 * 1024
+const defaultSpoolReplayInterval = 30 * time.Second
+
+// a chunk as it is held in the spool
+type spooledChunk struct {
+	Records []spooledRecord `json:"records"`
+}
+
+type spooledRecord struct {
+	Tag       string      `json:"tag"`
+	Timestamp time.Time   `json:"ts"`
+	Record    interface{} `json:"record"`
+}
+
+// the spool for an instance
+type diskSpool struct {
+	mutex       sync.Mutex
+	dir         string
+	maxSize     int64
+	segmentSize int64
+	writeSeq    int64  // the segment being appended to
+	replaying   string // the segment being replayed, which mustn't be dropped
+}
+
+// parse a size such as 512K, 100M or 1G, a plain number is bytes
+func parseSizeStr(sizeStr string) (int64, error) {
+	sizeStr = strings.ToUpper(strings.TrimSpace(sizeStr))
+	if len(sizeStr) == 0 {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	switch sizeStr[len(sizeStr)-1] {
+	case 'K':
+		multiplier = 1024
+	case 'M':
+		multiplier = 1024 * 1024
+	case 'G':
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		sizeStr = sizeStr[:len(sizeStr)-1]
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid size " + sizeStr)
+	}
+	return size * multiplier, nil
+}
+
+// check the spool settings
+func validateSpoolParams(params *SqlParams) error {
+	params.SpoolDir = strings.TrimSpace(params.SpoolDir)
+	if len(params.SpoolDir) == 0 {
+		return nil
+	}
+	if _, err := parseSizeStr(params.SpoolMaxSize); err != nil {
+		return errors.New(Plugin_SpoolMaxSize + " - " + err.Error())
+	}
+	if _, err := parseSizeStr(params.SpoolSegment); err != nil {
+		return errors.New(Plugin_SpoolSegmentSize + " - " + err.Error())
+	}
+	if _, err := parseDurationStr(params.SpoolReplay); err != nil {
+		return errors.New(Plugin_SpoolReplayInterval + " - " + err.Error())
+	}
+	return nil
+}
+
+// the directory for the instance's spool, named so it is the same each time the instance starts
+func spoolInstanceDir(params *SqlParams) string {
+	name := params.PluginName + "_" + params.InstanceName
+	if len(params.InstanceName) == 0 {
+		name = params.PluginName + "_default"
+	}
+	return filepath.Join(params.SpoolDir, regexp.MustCompile(`[^A-Za-z0-9_.-]`).ReplaceAllString(name, "_"))
+}
+
+func segmentName(seq int64) string {
+	return fmt.Sprintf("%020d%s", seq, spoolSuffix)
+}
+
+// the segment files in the order they were written, which is the order of their names
+func (spool *diskSpool) segments() ([]string, error) {
+	entries, err := os.ReadDir(spool.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), spoolSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// set up the spool for the instance, and the worker that replays it
+func startSpool(params *SqlParams) error {
+	if len(params.SpoolDir) == 0 {
+		return nil
+	}
+	spool := &diskSpool{dir: spoolInstanceDir(params)}
+	spool.maxSize, _ = parseSizeStr(params.SpoolMaxSize)
+	if spool.maxSize <= 0 {
+		spool.maxSize = defaultSpoolMaxSize
+	}
+	spool.segmentSize, _ = parseSizeStr(params.SpoolSegment)
+	if spool.segmentSize <= 0 {
+		spool.segmentSize = defaultSpoolSegmentSize
+	}
+	if err := os.MkdirAll(spool.dir, 0700); err != nil {
+		return err
+	}
+
+	// anything left from a previous run is replayed first, and we start a new segment so we never append to a
+	// segment that may have been left with a partial line
+	names, err := spool.segments()
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		lastSeq, _ := strconv.ParseInt(strings.TrimSuffix(names[len(names)-1], spoolSuffix), 10, 64)
+		spool.writeSeq = lastSeq + 1
+		log.Printf("[%s]%s found %d spool segments in %s to replay", params.PluginName, params.InstanceName, len(names), spool.dir)
+	}
+
+	resources := getResources(params)
+	resourcesMutex.Lock()
+	resources.spool = spool
+	resourcesMutex.Unlock()
+
+	interval, err := parseDurationStr(params.SpoolReplay)
+	if err != nil || interval <= 0 {
+		interval = defaultSpoolReplayInterval
+	}
+	workerParams := *params
+	startWorker(params, "spool replay", interval, func() {
+		spool.replay(&workerParams)
+	})
+	return nil
+}
+
+func getSpool(params *SqlParams) *diskSpool {
+	resources := getResources(params)
+	resourcesMutex.Lock()
+	defer resourcesMutex.Unlock()
+	return resources.spool
+}
+
+// write the records to the database, using the spool if the database isn't available or there are
+// already chunks waiting in the spool
+func writeChunk(params *SqlParams, records []FlushRecord) (writeOutcome, error) {
+	spool := getSpool(params)
+	if spool == nil {
+		return execInsert(params, records)
+	}
+
+	if !spool.isEmpty() {
+		if err := spool.append(params, records); err != nil {
+			return writeRetry, err
+		}
+		return writeOk, nil
+	}
+
+	outcome, err := execInsert(params, records)
+	if outcome == writeRetry {
+		if spoolErr := spool.append(params, records); spoolErr != nil {
+			log.Printf("[%s]%s unable to spool chunk - %v", params.PluginName, params.InstanceName, spoolErr)
+			return outcome, err
+		}
+		log.Printf("[%s]%s database unavailable, spooled %d records - %v", params.PluginName, params.InstanceName, len(records), err)
+		return writeOk, nil
+	}
+	return outcome, err
+}
+
+func (spool *diskSpool) isEmpty() bool {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	names, err := spool.segments()
+	return err == nil && len(names) == 0
+}
+
+// add a chunk to the end of the spool, then drop the oldest segments if the spool is over its size limit
+func (spool *diskSpool) append(params *SqlParams, records []FlushRecord) error {
+	chunk := spooledChunk{}
+	for _, recd := range records {
+		chunk.Records = append(chunk.Records, spooledRecord{Tag: recd.Tag, Timestamp: recd.Timestamp, Record: normalizeForJSON(recd.Record)})
+	}
+	line, err := json.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+
+	segmentPath := filepath.Join(spool.dir, segmentName(spool.writeSeq))
+	if info, err := os.Stat(segmentPath); err == nil && info.Size() >= spool.segmentSize {
+		spool.writeSeq++
+		segmentPath = filepath.Join(spool.dir, segmentName(spool.writeSeq))
+	}
+	segment, err := os.OpenFile(segmentPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = segment.Write(append(line, '\n')); err == nil {
+		err = segment.Sync()
+	}
+	if closeErr := segment.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	incrementMetric(params, "spooled_chunks_total", nil, 1)
+
+	spool.enforceMaxSize(params)
+	return nil
+}
+
+// drop the oldest segments until the spool is within its size limit. The segment being written to is kept
+func (spool *diskSpool) enforceMaxSize(params *SqlParams) {
+	names, err := spool.segments()
+	if err != nil {
+		return
+	}
+	var total int64 = 0
+	sizes := make(map[string]int64)
+	for _, name := range names {
+		if info, err := os.Stat(filepath.Join(spool.dir, name)); err == nil {
+			sizes[name] = info.Size()
+			total = total + info.Size()
+		}
+	}
+	for _, name := range names {
+		if total <= spool.maxSize || name == segmentName(spool.writeSeq) {
+			return
+		}
+		if name == spool.replaying {
+			continue
+		}
+		if err := os.Remove(filepath.Join(spool.dir, name)); err != nil {
+			log.Printf("[%s]%s unable to drop spool segment %s - %v", params.PluginName, params.InstanceName, name, err)
+			continue
+		}
+		total = total - sizes[name]
+		incrementMetric(params, "spool_dropped_bytes_total", nil, sizes[name])
+		log.Printf("[%s]%s spool over %d bytes, dropped the oldest segment %s of %d bytes", params.PluginName, params.InstanceName, spool.maxSize, name, sizes[name])
+	}
+}
+
+// convert the JSON back into the form msgpack gives us, so the records are handled in the same way as new ones
+func fromSpoolJSON(data interface{}) interface{} {
+	switch val := data.(type) {
+	case map[string]interface{}:
+		result := make(map[interface{}]interface{}, len(val))
+		for k, v := range val {
+			result[k] = fromSpoolJSON(v)
+		}
+		return result
+	case []interface{}:
+		for i, v := range val {
+			val[i] = fromSpoolJSON(v)
+		}
+		return val
+	case json.Number:
+		if intVal, err := val.Int64(); err == nil {
+			return intVal
+		}
+		floatVal, _ := val.Float64()
+		return floatVal
+	default:
+		return val
+	}
+}
+
+// replay the spooled chunks, oldest first, while the database is available. Each segment is removed once all its
+// chunks are written. If we have to stop part way through a segment, it is rewritten with just the chunks remaining
+func (spool *diskSpool) replay(params *SqlParams) {
+	for {
+		spool.mutex.Lock()
+		names, err := spool.segments()
+		if err != nil || len(names) == 0 {
+			spool.mutex.Unlock()
+			return
+		}
+		// stop appending to the segment we're about to replay
+		if names[0] == segmentName(spool.writeSeq) {
+			spool.writeSeq++
+		}
+		spool.replaying = names[0]
+		spool.mutex.Unlock()
+
+		if !testConnectionOk(params) {
+			spool.clearReplaying()
+			return
+		}
+		done := spool.replaySegment(params, names[0])
+		spool.clearReplaying()
+		if !done {
+			return
+		}
+	}
+}
+
+func (spool *diskSpool) clearReplaying() {
+	spool.mutex.Lock()
+	spool.replaying = ""
+	spool.mutex.Unlock()
+}
+
+// write the chunks in the segment, returning true if the whole segment was written
+func (spool *diskSpool) replaySegment(params *SqlParams, name string) bool {
+	segmentPath := filepath.Join(spool.dir, name)
+	content, err := os.ReadFile(segmentPath)
+	if err != nil {
+		log.Printf("[%s]%s unable to read spool segment %s - %v", params.PluginName, params.InstanceName, name, err)
+		return false
+	}
+
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	for idx, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		chunk := spooledChunk{}
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.UseNumber()
+		if err := decoder.Decode(&chunk); err != nil {
+			log.Printf("[%s]%s skipping unreadable chunk in spool segment %s - %v", params.PluginName, params.InstanceName, name, err)
+			continue
+		}
+		var records []FlushRecord
+		for _, spooled := range chunk.Records {
+			record, _ := fromSpoolJSON(spooled.Record).(map[interface{}]interface{})
+			records = append(records, FlushRecord{Tag: spooled.Tag, Timestamp: spooled.Timestamp, Record: RowDefinition(record)})
+		}
+
+		outcome, err := execInsert(params, records)
+		switch outcome {
+		case writeRetry:
+			log.Printf("[%s]%s spool replay interrupted, will try again - %v", params.PluginName, params.InstanceName, err)
+			spool.rewriteSegment(params, segmentPath, lines[idx:])
+			return false
+		case writeFailed:
+			log.Printf("[%s]%s spooled chunk of %d records could not be written, dropping it - %v", params.PluginName, params.InstanceName, len(records), err)
+		default:
+			incrementMetric(params, "spool_replayed_chunks_total", nil, 1)
+		}
+	}
+
+	if err = os.Remove(segmentPath); err != nil {
+		log.Printf("[%s]%s unable to remove replayed spool segment %s - %v", params.PluginName, params.InstanceName, name, err)
+		return false
+	}
+	log.Printf("[%s]%s replayed spool segment %s", params.PluginName, params.InstanceName, name)
+	return true
+}
+
+// replace the segment with the chunks still to be written
+func (spool *diskSpool) rewriteSegment(params *SqlParams, segmentPath string, lines []string) {
+	tmpPath := segmentPath + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err == nil {
+		writer := bufio.NewWriter(tmpFile)
+		for _, line := range lines {
+			writer.WriteString(line + "\n")
+		}
+		if err = writer.Flush(); err == nil {
+			err = tmpFile.Sync()
+		}
+		tmpFile.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, segmentPath)
+	}
+	if err != nil {
+		log.Printf("[%s]%s unable to update spool segment %s, chunks may be replayed twice - %v", params.PluginName, params.InstanceName, segmentPath, err)
+	}
+}
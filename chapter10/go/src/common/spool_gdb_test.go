@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSizeStr(t *testing.T) {
+	tests := []struct {
+		sizeStr  string
+		expected int64
+	}{
+		{"", 0},
+		{"100", 100},
+		{"8k", 8 * 1024},
+		{"8M", 8 * 1024 * 1024},
+		{"1G", 1024 * 1024 * 1024},
+		{" 2 g ", 2 * 1024 * 1024 * 1024},
+	}
+	for _, test := range tests {
+		size, err := parseSizeStr(test.sizeStr)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.sizeStr, err)
+		} else if size != test.expected {
+			t.Errorf("%q: got %d, expected %d", test.sizeStr, size, test.expected)
+		}
+	}
+	for _, sizeStr := range []string{"abc", "1T", "K", "1.5M"} {
+		if _, err := parseSizeStr(sizeStr); err == nil {
+			t.Errorf("%q: expected an error", sizeStr)
+		}
+	}
+}
+
+func TestSpoolAppendAndDrop(t *testing.T) {
+	params := &SqlParams{PluginName: "gdb-test"}
+	// a segment size of 1 byte puts each chunk in a segment of its own
+	spool := &diskSpool{dir: t.TempDir(), maxSize: defaultSpoolMaxSize, segmentSize: 1}
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	appendChunk := func(n int64) {
+		if err := spool.append(params, []FlushRecord{{Tag: "app", Timestamp: at, Record: RowDefinition{"n": n, "msg": []byte("x")}}}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	segmentsAre := func(expected ...int64) {
+		t.Helper()
+		var expectedNames []string
+		for _, seq := range expected {
+			expectedNames = append(expectedNames, segmentName(seq))
+		}
+		names, err := spool.segments()
+		if err != nil || !reflect.DeepEqual(names, expectedNames) {
+			t.Errorf("got segments %v %v, expected %v", names, err, expectedNames)
+		}
+	}
+
+	for n := int64(0); n < 3; n++ {
+		appendChunk(n)
+	}
+	segmentsAre(0, 1, 2)
+
+	// the chunk is read back in the form msgpack gives us
+	content, err := os.ReadFile(filepath.Join(spool.dir, segmentName(0)))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	chunk := spooledChunk{}
+	decoder := json.NewDecoder(strings.NewReader(string(content)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&chunk); err != nil || len(chunk.Records) != 1 {
+		t.Fatalf("got %v %v, expected a chunk of one record", chunk, err)
+	}
+	record := fromSpoolJSON(chunk.Records[0].Record)
+	if !reflect.DeepEqual(record, map[interface{}]interface{}{"n": int64(0), "msg": "x"}) || !chunk.Records[0].Timestamp.Equal(at) {
+		t.Errorf("got %v at %v, expected n 0 and msg x at %v", record, chunk.Records[0].Timestamp, at)
+	}
+
+	// over the limit the oldest segments are dropped until there are two left
+	spool.maxSize = 2 * int64(len(content))
+	appendChunk(3)
+	segmentsAre(2, 3)
+
+	// the segment being replayed is kept, as is the one being written to
+	spool.maxSize = int64(len(content))
+	spool.replaying = segmentName(2)
+	appendChunk(4)
+	segmentsAre(2, 4)
+}
+
+func TestRewriteSegment(t *testing.T) {
+	params := &SqlParams{PluginName: "gdb-test"}
+	spool := &diskSpool{dir: t.TempDir()}
+	segmentPath := filepath.Join(spool.dir, segmentName(0))
+	if err := os.WriteFile(segmentPath, []byte("{\"a\":1}\n{\"b\":2}\n{\"c\":3}\n"), 0600); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	spool.rewriteSegment(params, segmentPath, []string{"{\"b\":2}", "{\"c\":3}"})
+	content, err := os.ReadFile(segmentPath)
+	if err != nil || string(content) != "{\"b\":2}\n{\"c\":3}\n" {
+		t.Errorf("got %q %v, expected the last two chunks", content, err)
+	}
+	if _, err := os.Stat(segmentPath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary segment was left behind")
+	}
+}
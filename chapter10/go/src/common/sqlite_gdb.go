@@ -0,0 +1,138 @@
+package main
+
+// the dialect for SQLite, using the modernc.org/sqlite driver which is pure Go, so the plugins can still be built
+// without cgo dependencies beyond Fluent Bit's. The db_name is the path to the database file - there is no server,
+// so the db_host, db_port and db_user aren't needed. The output creates the file if it doesn't exist.
+// As applications may be writing to the same file, we wait for their locks rather than failing straight away, and
+// our write transactions take the write lock when they begin so they aren't caught out part way through.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"modernc.org/sqlite"
+)
+
+type sqliteDialect struct {
+	standardSavepoints
+}
+
+// how long we wait for another connection's lock on the file, in milliseconds
+const sqliteBusyTimeout = 5000
+
+// SQLite result codes - see https://www.sqlite.org/rescode.html. The extended codes carry the primary code in
+// the low byte
+var sqliteRetryCodes = map[int]bool{
+	5:  true, // SQLITE_BUSY - another connection holds the lock
+	6:  true, // SQLITE_LOCKED - a table is locked
+	10: true, // SQLITE_IOERR
+	13: true, // SQLITE_FULL - the disk is full
+	14: true, // SQLITE_CANTOPEN - e.g. the volume holding the file isn't mounted yet
+}
+var sqliteRecordCodes = map[int]bool{
+	18: true, // SQLITE_TOOBIG - string or blob too big
+	19: true, // SQLITE_CONSTRAINT - covers unique, not null, check and foreign key constraints
+	20: true, // SQLITE_MISMATCH - data type mismatch
+}
+
+func (sqliteDialect) usesServer() bool {
+	return false
+}
+
+func (sqliteDialect) connectionStr(params *SqlParams) string {
+	connStr := "file:" + params.DBName + "?_pragma=busy_timeout(" + strconv.Itoa(sqliteBusyTimeout) + ")&_txlock=immediate"
+	for _, option := range driverOptions(params) {
+		connStr = connStr + "&" + url.QueryEscape(option[0]) + "=" + url.QueryEscape(option[1])
+	}
+	return connStr
+}
+
+func (sqliteDialect) quoteIdent(name string) string {
+	return "\"" + strings.ReplaceAll(name, "\"", "\"\"") + "\""
+}
+
+func (sqliteDialect) bindVar(idx int) string {
+	return "?"
+}
+
+func (sqliteDialect) limitQuery(sqlStmt string, limit int, offset int) string {
+	sqlStmt = sqlStmt + " LIMIT " + strconv.Itoa(limit)
+	if offset > 0 {
+		sqlStmt = sqlStmt + " OFFSET " + strconv.Itoa(offset)
+	}
+	return sqlStmt
+}
+
+func (dialect sqliteDialect) insertExpr(table string, cols []string, rowCount int) string {
+	rows := make([]string, rowCount)
+	for idx := range rows {
+		rows[idx] = "(" + strings.Join(rowPlaceholders(dialect, idx*len(cols)+1, len(cols)), ",") + ")"
+	}
+	return "INSERT INTO " + table + " (" + strings.Join(cols, ",") + ") VALUES " + strings.Join(rows, ",")
+}
+
+// within the update the unqualified column names refer to the existing row
+func (dialect sqliteDialect) upsertExpr(table string, cols []string, conflictCols []string, updates func(existing, incoming func(string) string) []string) string {
+	sqlStmt := dialect.insertExpr(table, cols, 1) + " ON CONFLICT (" + strings.Join(conflictCols, ", ") + ")"
+
+	var assignments []string
+	if updates != nil {
+		assignments = updates(func(col string) string { return col }, func(col string) string { return "excluded." + col })
+	}
+	if len(assignments) == 0 {
+		return sqlStmt + " DO NOTHING"
+	}
+	return sqlStmt + " DO UPDATE SET " + strings.Join(assignments, ", ")
+}
+
+// the driver gives us the rowid of the inserted row, which is the key when the table has an integer primary key
+func (sqliteDialect) insertReturningId(ctx context.Context, conn dbConn, sqlStmt string, args []interface{}, keyCol string) (interface{}, error) {
+	result, err := conn.ExecContext(ctx, sqlStmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		return nil, nil
+	}
+	return result.LastInsertId()
+}
+
+// SQLite has no bulk loading statement, but as it is in process, a prepared insert within the transaction is as
+// quick as it gets
+func (dialect sqliteDialect) bulkLoad(ctx context.Context, tx *sql.Tx, table string, cols []string, rows [][]interface{}) error {
+	stmt, err := tx.PrepareContext(ctx, dialect.insertExpr(table, cols, 1))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		if _, err = stmt.ExecContext(ctx, row...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sqliteDialect) classifyError(err error) (dbErrorClass, bool) {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return errClassNone, false
+	}
+	code := sqliteErr.Code() & 0xff
+	if sqliteRetryCodes[code] {
+		return errClassRetry, true
+	}
+	if sqliteRecordCodes[code] {
+		return errClassRecord, true
+	}
+	return errClassFatal, true
+}
+
+// a local file has no password
+func (sqliteDialect) authFailed(err error) bool {
+	return false
+}
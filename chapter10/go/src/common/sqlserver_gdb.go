@@ -0,0 +1,203 @@
+package main
+
+// the dialect for Microsoft SQL Server (and Azure SQL), using the pure Go microsoft/go-mssqldb driver. SQL Server
+// differs from the others in a number of ways - identifiers are quoted with brackets, bind variables are named
+// @p1, @p2 and so on, queries are limited with TOP or OFFSET ... FETCH, upserts are written as a MERGE, and
+// savepoints are set with SAVE TRANSACTION and never released.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	mssql "github.com/microsoft/go-mssqldb"
+)
+
+type sqlserverDialect struct{}
+
+// SQL Server error numbers - see https://learn.microsoft.com/en-us/sql/relational-databases/errors-events/database-engine-events-and-errors
+var sqlserverRetryErrors = map[int32]bool{
+	233:   true, // the connection was closed by the server
+	1205:  true, // chosen as the deadlock victim
+	1222:  true, // lock request time out
+	4060:  true, // cannot open the database - e.g. it is recovering or failing over
+	10053: true, // transport level error, connection aborted
+	10054: true, // transport level error, connection reset
+	10928: true, // Azure resource limit reached
+	10929: true, // Azure resource limit reached
+	40197: true, // Azure service error processing the request
+	40501: true, // Azure service is busy
+	40613: true, // Azure database isn't currently available
+	49918: true, // Azure not enough resources
+	49919: true, // Azure too many operations in progress
+	49920: true, // Azure service is busy
+}
+var sqlserverRecordErrors = map[int32]bool{
+	220:  true, // arithmetic overflow for the data type
+	241:  true, // conversion failed for a date or time
+	245:  true, // conversion failed
+	515:  true, // cannot insert NULL
+	547:  true, // conflict with a foreign key or check constraint
+	2601: true, // duplicate key in a unique index
+	2627: true, // violation of a primary key or unique constraint
+	2628: true, // string or binary data would be truncated
+	8114: true, // error converting the data type
+	8115: true, // arithmetic overflow converting the value
+	8152: true, // string or binary data would be truncated
+}
+var sqlserverAuthErrors = map[int32]bool{
+	18456: true, // login failed
+	18487: true, // password expired
+	18488: true, // password must be changed
+}
+
+func (sqlserverDialect) usesServer() bool {
+	return true
+}
+
+// the URL form of the connection string, so the user and password are escaped. Without TLS we leave the
+// driver's default, which only encrypts the login
+func (sqlserverDialect) connectionStr(params *SqlParams) string {
+	query := url.Values{"database": {params.DBName}}
+	if tlsEnabled(params) {
+		query.Set("encrypt", "true")
+		query.Set("TrustServerCertificate", strconv.FormatBool(!tlsVerify(params)))
+		if len(params.TLSCAFile) > 0 {
+			query.Set("certificate", params.TLSCAFile)
+		}
+		if len(params.TLSServerName) > 0 {
+			query.Set("hostNameInCertificate", params.TLSServerName)
+		}
+	}
+	connectURL := url.URL{
+		Scheme:   sqlserverDBType,
+		User:     url.UserPassword(params.User, params.Password),
+		Host:     net.JoinHostPort(params.Host, params.Port),
+		RawQuery: addDriverOptions(query, params).Encode(),
+	}
+	return connectURL.String()
+}
+
+func (sqlserverDialect) quoteIdent(name string) string {
+	return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+}
+
+func (sqlserverDialect) bindVar(idx int) string {
+	return "@p" + strconv.Itoa(idx)
+}
+
+// a query that just wants the first rows uses TOP, otherwise OFFSET ... FETCH which needs the query to be ordered
+func (sqlserverDialect) limitQuery(sqlStmt string, limit int, offset int) string {
+	if offset == 0 && strings.HasPrefix(sqlStmt, "SELECT ") {
+		return "SELECT TOP " + strconv.Itoa(limit) + " " + strings.TrimPrefix(sqlStmt, "SELECT ")
+	}
+	if !strings.Contains(strings.ToUpper(sqlStmt), " ORDER BY ") {
+		sqlStmt = sqlStmt + " ORDER BY (SELECT NULL)"
+	}
+	return sqlStmt + " OFFSET " + strconv.Itoa(offset) + " ROWS FETCH NEXT " + strconv.Itoa(limit) + " ROWS ONLY"
+}
+
+func (dialect sqlserverDialect) insertExpr(table string, cols []string, rowCount int) string {
+	rows := make([]string, rowCount)
+	for idx := range rows {
+		rows[idx] = "(" + strings.Join(rowPlaceholders(dialect, idx*len(cols)+1, len(cols)), ",") + ")"
+	}
+	return "INSERT INTO " + table + " (" + strings.Join(cols, ",") + ") VALUES " + strings.Join(rows, ",")
+}
+
+// a MERGE of the incoming row into the table, matching rows on the conflict columns. HOLDLOCK stops another
+// connection inserting the same row between the match and the insert
+func (dialect sqlserverDialect) upsertExpr(table string, cols []string, conflictCols []string, updates func(existing, incoming func(string) string) []string) string {
+	existing := func(col string) string { return "existing." + col }
+	incoming := func(col string) string { return "incoming." + col }
+
+	matches := make([]string, len(conflictCols))
+	for idx, col := range conflictCols {
+		matches[idx] = existing(col) + " = " + incoming(col)
+	}
+	incomingCols := make([]string, len(cols))
+	for idx, col := range cols {
+		incomingCols[idx] = incoming(col)
+	}
+
+	sqlStmt := "MERGE INTO " + table + " WITH (HOLDLOCK) AS existing USING (VALUES (" + strings.Join(rowPlaceholders(dialect, 1, len(cols)), ",") +
+		")) AS incoming (" + strings.Join(cols, ",") + ") ON " + strings.Join(matches, " AND ")
+	if updates != nil {
+		if assignments := updates(existing, incoming); len(assignments) > 0 {
+			sqlStmt = sqlStmt + " WHEN MATCHED THEN UPDATE SET " + strings.Join(assignments, ", ")
+		}
+	}
+	return sqlStmt + " WHEN NOT MATCHED THEN INSERT (" + strings.Join(cols, ",") + ") VALUES (" + strings.Join(incomingCols, ",") + ");"
+}
+
+// the generated key is returned with an OUTPUT clause, which for an insert goes before the values and for a
+// MERGE at the end. A MERGE that leaves the existing row alone outputs nothing
+func (sqlserverDialect) insertReturningId(ctx context.Context, conn dbConn, sqlStmt string, args []interface{}, keyCol string) (interface{}, error) {
+	output := " OUTPUT INSERTED." + keyCol
+	if strings.HasPrefix(sqlStmt, "MERGE ") {
+		sqlStmt = strings.TrimSuffix(sqlStmt, ";") + output + ";"
+	} else if idx := strings.Index(sqlStmt, ") VALUES "); idx >= 0 {
+		sqlStmt = sqlStmt[:idx+1] + output + sqlStmt[idx+1:]
+	}
+
+	var id interface{}
+	err := conn.QueryRowContext(ctx, sqlStmt, args...).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return toDBValue(id), nil
+}
+
+func (sqlserverDialect) savepoint(name string) string {
+	return "SAVE TRANSACTION " + name
+}
+
+func (sqlserverDialect) rollbackToSavepoint(name string) string {
+	return "ROLLBACK TRANSACTION " + name
+}
+
+func (sqlserverDialect) releaseSavepoint(name string) string {
+	return ""
+}
+
+// use the bulk copy protocol, which streams the rows to the server
+func (sqlserverDialect) bulkLoad(ctx context.Context, tx *sql.Tx, table string, cols []string, rows [][]interface{}) error {
+	stmt, err := tx.PrepareContext(ctx, mssql.CopyIn(table, mssql.BulkOptions{}, cols...))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		if _, err = stmt.ExecContext(ctx, row...); err != nil {
+			return err
+		}
+	}
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
+
+func (sqlserverDialect) classifyError(err error) (dbErrorClass, bool) {
+	var msErr mssql.Error
+	if !errors.As(err, &msErr) {
+		return errClassNone, false
+	}
+	if sqlserverRetryErrors[msErr.Number] {
+		return errClassRetry, true
+	}
+	if sqlserverRecordErrors[msErr.Number] {
+		return errClassRecord, true
+	}
+	return errClassFatal, true
+}
+
+func (sqlserverDialect) authFailed(err error) bool {
+	var msErr mssql.Error
+	return errors.As(err, &msErr) && sqlserverAuthErrors[msErr.Number]
+}
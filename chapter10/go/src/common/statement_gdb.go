@@ -0,0 +1,173 @@
+package main
+
+// Some databases only allow logs to be written through a stored procedure or a particular statement, so as well as
+// the insert and cdc write modes we support:
+//   statement - the statement is given with named placeholders that are bound to values from the record. A placeholder
+//               is a colon followed by an attribute name e.g. :level, or a record accessor in braces e.g. :{$log['msg']}
+//               e.g. INSERT INTO app_logs (lvl, msg) VALUES (:level, :{$log['msg']})
+//   procedure - the procedure is called with the values of the procedure_args, a comma separated list of record
+//               accessors, in the order given e.g. $level, $log['msg']
+// A missing value is bound as NULL. The statements are prepared once per transaction and executed for each record,
+// using the same savepoints and error handling as inserts.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const writeModeStatement = "statement"
+const writeModeProcedure = "procedure"
+
+// the statement to execute for each record, and the record values bound to each placeholder in order
+type boundStatement struct {
+	sql   string
+	paths []recordPath
+}
+
+// replace the named placeholders with the bind variables for the database. Anything within quotes is left alone,
+// as is the Postgres :: cast
+func parseStatementTemplate(params *SqlParams, text string) (*boundStatement, error) {
+	stmt := &boundStatement{}
+	var sqlStr strings.Builder
+	var quote byte = 0
+	pos := 0
+	for pos < len(text) {
+		ch := text[pos]
+		switch {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"' || ch == '`':
+			quote = ch
+		case ch == ':' && pos+1 < len(text) && text[pos+1] == ':':
+			sqlStr.WriteString("::")
+			pos = pos + 2
+			continue
+		case ch == ':' && pos+1 < len(text) && text[pos+1] == '{':
+			end := strings.IndexByte(text[pos:], '}')
+			if end < 0 {
+				return nil, errors.New("missing } in " + Plugin_Statement)
+			}
+			path, err := parseRecordPath(text[pos+2 : pos+end])
+			if err != nil {
+				return nil, errors.New("invalid placeholder in " + Plugin_Statement + " - " + err.Error())
+			}
+			stmt.paths = append(stmt.paths, path)
+			sqlStr.WriteString(bindVar(params, len(stmt.paths)))
+			pos = pos + end + 1
+			continue
+		case ch == ':' && pos+1 < len(text) && isNameChar(text[pos+1]):
+			end := pos + 1
+			for end < len(text) && isNameChar(text[end]) {
+				end++
+			}
+			stmt.paths = append(stmt.paths, recordPath{text[pos+1 : end]})
+			sqlStr.WriteString(bindVar(params, len(stmt.paths)))
+			pos = end
+			continue
+		}
+		sqlStr.WriteByte(ch)
+		pos++
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote in " + Plugin_Statement)
+	}
+	stmt.sql = sqlStr.String()
+	return stmt, nil
+}
+
+func isNameChar(ch byte) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') || ch == '_'
+}
+
+// build the call for the procedure, with a bind variable for each argument
+func buildProcedureStatement(params *SqlParams) (*boundStatement, error) {
+	paths, err := parseRecordPathList(params.ProcedureArgs)
+	if err != nil {
+		return nil, errors.New("invalid " + Plugin_ProcedureArgs + " " + err.Error())
+	}
+	placeholders := make([]string, len(paths))
+	for idx := range paths {
+		placeholders[idx] = bindVar(params, idx+1)
+	}
+	// SQL Server executes a procedure rather than calling it
+	if params.DBType == sqlserverDBType {
+		return &boundStatement{sql: "EXEC " + params.Procedure + " " + strings.Join(placeholders, ", "), paths: paths}, nil
+	}
+	return &boundStatement{sql: "CALL " + params.Procedure + "(" + strings.Join(placeholders, ", ") + ")", paths: paths}, nil
+}
+
+// the statement for the statement or procedure write mode
+func buildBoundStatement(params *SqlParams) (*boundStatement, error) {
+	if params.WriteMode == writeModeProcedure {
+		return buildProcedureStatement(params)
+	}
+	return parseStatementTemplate(params, params.Statement)
+}
+
+// check the settings needed by the statement and procedure write modes
+func validateStatementParams(params *SqlParams) error {
+	if params.WriteMode == writeModeProcedure {
+		params.Procedure = strings.TrimSpace(params.Procedure)
+		if !regexp.MustCompile(defaultTableRegex).MatchString(params.Procedure) {
+			return errors.New(Plugin_WriteMode + " " + writeModeProcedure + " needs a valid " + Plugin_Procedure + " for " + params.PluginName)
+		}
+	} else if len(strings.TrimSpace(params.Statement)) == 0 {
+		return errors.New(Plugin_WriteMode + " " + writeModeStatement + " needs a " + Plugin_Statement + " for " + params.PluginName)
+	}
+	_, err := buildBoundStatement(params)
+	return err
+}
+
+// the values from the record for each of the placeholders
+func (stmt *boundStatement) args(values RowDefinition) []interface{} {
+	args := make([]interface{}, len(stmt.paths))
+	for idx, path := range stmt.paths {
+		if val, found := lookupRecordPath(values, path); found {
+			args[idx] = toDBValue(val)
+		}
+	}
+	return args
+}
+
+// the statements prepared within a transaction, so each is only prepared once however many records use it.
+// The prepared statements belong to the transaction, so are closed when it commits or rolls back
+type statementCache struct {
+	tx       *sql.Tx
+	prepared map[string]*sql.Stmt
+	bound    *boundStatement
+}
+
+func newStatementCache(tx *sql.Tx) *statementCache {
+	return &statementCache{tx: tx, prepared: make(map[string]*sql.Stmt)}
+}
+
+// the statement for the statement or procedure write mode, which only needs building once for the transaction
+func (cache *statementCache) boundStatement(params *SqlParams) (*boundStatement, error) {
+	if cache.bound == nil {
+		bound, err := buildBoundStatement(params)
+		if err != nil {
+			return nil, err
+		}
+		cache.bound = bound
+	}
+	return cache.bound, nil
+}
+
+// execute the statement, preparing it the first time
+func (cache *statementCache) exec(ctx context.Context, sqlStmt string, args ...interface{}) error {
+	stmt, found := cache.prepared[sqlStmt]
+	if !found {
+		var err error
+		if stmt, err = cache.tx.PrepareContext(ctx, sqlStmt); err != nil {
+			return err
+		}
+		cache.prepared[sqlStmt] = stmt
+	}
+	_, err := stmt.ExecContext(ctx, args...)
+	return err
+}
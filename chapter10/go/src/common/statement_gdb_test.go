@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStatementTemplate(t *testing.T) {
+	tests := []struct {
+		dbType   string
+		text     string
+		expected string
+		paths    []recordPath
+	}{
+		{PostgresDBType, "INSERT INTO logs (lvl, msg) VALUES (:level, :msg)", "INSERT INTO logs (lvl, msg) VALUES ($1, $2)",
+			[]recordPath{{"level"}, {"msg"}}},
+		{mysqlDBType, "INSERT INTO logs (lvl, msg) VALUES (:level, :msg)", "INSERT INTO logs (lvl, msg) VALUES (?, ?)",
+			[]recordPath{{"level"}, {"msg"}}},
+		{sqlserverDBType, "INSERT INTO logs VALUES (:level)", "INSERT INTO logs VALUES (@p1)", []recordPath{{"level"}}},
+		{oracleDBType, "INSERT INTO logs VALUES (:level)", "INSERT INTO logs VALUES (:1)", []recordPath{{"level"}}},
+		{PostgresDBType, "INSERT INTO logs VALUES (:{$log['msg']}, :{$kubernetes['labels']['app']})", "INSERT INTO logs VALUES ($1, $2)",
+			[]recordPath{{"log", "msg"}, {"kubernetes", "labels", "app"}}},
+		{PostgresDBType, "INSERT INTO logs VALUES (:at::timestamptz, :n::int)", "INSERT INTO logs VALUES ($1::timestamptz, $2::int)",
+			[]recordPath{{"at"}, {"n"}}},
+		{PostgresDBType, "INSERT INTO logs VALUES (':not_bound', \":nor_this\", :level)", "INSERT INTO logs VALUES (':not_bound', \":nor_this\", $1)",
+			[]recordPath{{"level"}}},
+		{mysqlDBType, "INSERT INTO `:odd` VALUES ('it''s :x', :level)", "INSERT INTO `:odd` VALUES ('it''s :x', ?)", []recordPath{{"level"}}},
+		{PostgresDBType, "SELECT 1 WHERE a = ': '", "SELECT 1 WHERE a = ': '", nil},
+		{PostgresDBType, "INSERT INTO logs VALUES (:level, :level)", "INSERT INTO logs VALUES ($1, $2)", []recordPath{{"level"}, {"level"}}},
+	}
+	for _, test := range tests {
+		stmt, err := parseStatementTemplate(&SqlParams{DBType: test.dbType}, test.text)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.text, err)
+			continue
+		}
+		if stmt.sql != test.expected {
+			t.Errorf("%s %s: got %s, expected %s", test.dbType, test.text, stmt.sql, test.expected)
+		}
+		if !reflect.DeepEqual(stmt.paths, test.paths) {
+			t.Errorf("%s: got paths %v, expected %v", test.text, stmt.paths, test.paths)
+		}
+	}
+}
+
+func TestParseStatementTemplateErrors(t *testing.T) {
+	for _, text := range []string{
+		"INSERT INTO logs VALUES ('open, :level)",
+		"INSERT INTO logs VALUES (:{$log['msg']",
+		"INSERT INTO logs VALUES (:{$log['msg'})",
+	} {
+		if _, err := parseStatementTemplate(&SqlParams{DBType: PostgresDBType}, text); err == nil {
+			t.Errorf("%s: expected an error", text)
+		}
+	}
+}
+
+func TestBuildProcedureStatement(t *testing.T) {
+	tests := []struct {
+		dbType   string
+		expected string
+	}{
+		{PostgresDBType, "CALL write_log($1, $2)"},
+		{mysqlDBType, "CALL write_log(?, ?)"},
+		{sqlserverDBType, "EXEC write_log @p1, @p2"},
+		{oracleDBType, "CALL write_log(:1, :2)"},
+	}
+	for _, test := range tests {
+		params := &SqlParams{DBType: test.dbType, WriteMode: writeModeProcedure, Procedure: "write_log", ProcedureArgs: "$level, $log['msg']"}
+		stmt, err := buildBoundStatement(params)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.dbType, err)
+			continue
+		}
+		if stmt.sql != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.dbType, stmt.sql, test.expected)
+		}
+		if !reflect.DeepEqual(stmt.paths, []recordPath{{"level"}, {"log", "msg"}}) {
+			t.Errorf("%s: got paths %v", test.dbType, stmt.paths)
+		}
+	}
+}
+
+func TestBoundStatementArgs(t *testing.T) {
+	stmt, err := parseStatementTemplate(&SqlParams{DBType: PostgresDBType}, "SELECT :level, :{$log['msg']}, :missing")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	args := stmt.args(RowDefinition{"level": []byte("error"), "log": map[interface{}]interface{}{"msg": "failed"}})
+	if !reflect.DeepEqual(args, []interface{}{"error", "failed", nil}) {
+		t.Errorf("got %v, expected error, failed and nil", args)
+	}
+}
+
+func TestValidateStatementParams(t *testing.T) {
+	tests := []struct {
+		params SqlParams
+		valid  bool
+	}{
+		{SqlParams{DBType: PostgresDBType, WriteMode: writeModeStatement, Statement: "INSERT INTO logs VALUES (:level)"}, true},
+		{SqlParams{DBType: PostgresDBType, WriteMode: writeModeStatement, Statement: " "}, false},
+		{SqlParams{DBType: PostgresDBType, WriteMode: writeModeProcedure, Procedure: "logs.write_log", ProcedureArgs: "$level"}, true},
+		{SqlParams{DBType: PostgresDBType, WriteMode: writeModeProcedure, Procedure: "write_log; DROP TABLE logs"}, false},
+		{SqlParams{DBType: PostgresDBType, WriteMode: writeModeProcedure, Procedure: "write_log", ProcedureArgs: "$log['msg'"}, false},
+	}
+	for _, test := range tests {
+		if err := validateStatementParams(&test.params); (err == nil) != test.valid {
+			t.Errorf("%s%s: got %v, expected valid %t", test.params.Statement, test.params.Procedure, err, test.valid)
+		}
+	}
+}
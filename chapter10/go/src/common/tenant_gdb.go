@@ -0,0 +1,258 @@
+package main
+
+// Support for hosting a database per tenant. The tenant_key is a template (such as ${tag[1]} or ${record['tenant']})
+// that gives the tenant for each record, and the tenant_map_file provides the connection details for each tenant as JSON:
+//
+//	{
+//	  "acme":   {"db_host": "10.0.0.1", "db_port": "5432", "db_user": "acme", "db_password": "secret", "db_name": "logs", "db_type": "postgres"},
+//	  "globex": {"db_host": "10.0.0.2", "db_name": "globex_logs"}
+//	}
+//
+// Any value not given for a tenant is taken from the plugin's own configuration. Records for tenants not in the map go to
+// the tenant named by tenant_default, or if that isn't set, to the database in the plugin's own configuration.
+// Each tenant gets its own connection pool which lives for as long as the plugin instance.
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+)
+
+// the connection details for a tenant, using the same names as the plugin configuration
+type tenantConnection struct {
+	Host         string `json:"db_host,omitempty"`
+	Port         string `json:"db_port,omitempty"`
+	User         string `json:"db_user,omitempty"`
+	Password     string `json:"db_password,omitempty"`
+	PasswordFile string `json:"db_password_file,omitempty"`
+	PasswordEnv  string `json:"db_password_env,omitempty"`
+	DBName       string `json:"db_name,omitempty"`
+	DBType       string `json:"db_type,omitempty"`
+	DSN          string `json:"db_dsn,omitempty"`
+}
+
+// the tenant details and connection pools held for the plugin instance
+type tenantResources struct {
+	connections map[string]tenantConnection
+	pools       map[string]*dbPool
+}
+
+// read and parse the tenant map file
+func loadTenantMap(params *SqlParams) (map[string]tenantConnection, error) {
+	content, err := os.ReadFile(params.TenantMapFile)
+	if err != nil {
+		return nil, err
+	}
+	tenants := make(map[string]tenantConnection)
+	if err = json.Unmarshal(content, &tenants); err != nil {
+		return nil, errors.New("unable to parse " + params.TenantMapFile + " - " + err.Error())
+	}
+	return tenants, nil
+}
+
+// the params to use for a tenant - starting with the plugin's own and overriding the connection details
+func tenantParams(params *SqlParams, tenant string, conn tenantConnection) *SqlParams {
+	result := *params
+	result.InstanceName = params.InstanceName + "[" + tenant + "]"
+	if len(conn.Host) > 0 {
+		result.Host = conn.Host
+	}
+	if len(conn.Port) > 0 {
+		result.Port = conn.Port
+	}
+	if len(conn.User) > 0 {
+		result.User = conn.User
+	}
+	// a password given for the tenant replaces however the plugin's own is sourced
+	if len(conn.Password) > 0 || len(conn.PasswordFile) > 0 || len(conn.PasswordEnv) > 0 {
+		result.Password = conn.Password
+		result.PasswordFile = conn.PasswordFile
+		result.PasswordEnv = conn.PasswordEnv
+		result.SecretProvider = ""
+	}
+	if len(conn.DBName) > 0 {
+		result.DBName = conn.DBName
+	}
+	if len(conn.DBType) > 0 {
+		result.DBType = conn.DBType
+	}
+	// the tenant's DSN holds its credentials
+	if len(conn.DSN) > 0 {
+		result.DSN = conn.DSN
+		result.PasswordFile = ""
+		result.PasswordEnv = ""
+		result.SecretProvider = ""
+	}
+	return &result
+}
+
+// check the tenant settings, including that every tenant in the map has usable connection details
+func validateTenantParams(params *SqlParams) error {
+	if len(params.TenantKey) == 0 {
+		return nil
+	}
+	if _, err := parseRecordTemplate(params.TenantKey); err != nil {
+		return errors.New("invalid " + Plugin_TenantKey + " - " + err.Error())
+	}
+	if len(params.TenantMapFile) == 0 {
+		return errors.New(Plugin_TenantKey + " needs a " + Plugin_TenantMapFile + " for " + params.PluginName)
+	}
+	// the tenants are committed separately, so when only some succeed the others need to be retried without writing
+	// the successful tenants' records twice
+	if len(params.HashColumn) == 0 && len(params.SpoolDir) == 0 {
+		return errors.New(Plugin_TenantKey + " needs a " + Plugin_HashColumn + " or " + Plugin_SpoolDir + " for " + params.PluginName +
+			", so a retry doesn't write the records of the tenants already written again")
+	}
+
+	tenants, err := loadTenantMap(params)
+	if err != nil {
+		return err
+	}
+	for tenant, conn := range tenants {
+		if err = validateSqlParams(tenantParams(params, tenant, conn)); err != nil {
+			return errors.New("tenant " + tenant + " - " + err.Error())
+		}
+	}
+	if len(params.TenantDefault) > 0 {
+		if _, found := tenants[params.TenantDefault]; !found {
+			return errors.New(Plugin_TenantDefault + " " + params.TenantDefault + " is not in " + params.TenantMapFile)
+		}
+	}
+	return nil
+}
+
+// get the tenant details for the instance, loading the map the first time
+func getTenantResources(params *SqlParams) (*tenantResources, error) {
+	resources := getResources(params)
+	resourcesMutex.Lock()
+	defer resourcesMutex.Unlock()
+	if resources.tenants != nil {
+		return resources.tenants, nil
+	}
+
+	connections, err := loadTenantMap(params)
+	if err != nil {
+		return nil, err
+	}
+	resources.tenants = &tenantResources{connections: connections, pools: make(map[string]*dbPool)}
+	return resources.tenants, nil
+}
+
+// the connection pool for the tenant, which is opened the first time it is used
+func (tenants *tenantResources) pool(tenant string) *dbPool {
+	resourcesMutex.Lock()
+	defer resourcesMutex.Unlock()
+	pool, found := tenants.pools[tenant]
+	if !found {
+		pool = &dbPool{}
+		tenants.pools[tenant] = pool
+	}
+	return pool
+}
+
+func (tenants *tenantResources) release() {
+	for tenant, pool := range tenants.pools {
+		if err := pool.close(); err != nil {
+			log.Printf("error closing connections for tenant %s - %v", tenant, err)
+		}
+	}
+	tenants.pools = make(map[string]*dbPool)
+}
+
+// the records destined for a tenant's database
+type tenantGroup struct {
+	tenant  string
+	params  *SqlParams
+	records []FlushRecord
+}
+
+// split the records by the tenant they belong to. Records whose tenant isn't known go to the default
+// tenant, or if there isn't one, the database the plugin is configured with - which we identify with an empty name
+func (tenants *tenantResources) groupRecords(params *SqlParams, records []FlushRecord) ([]*tenantGroup, error) {
+	keyTemplate, err := parseRecordTemplate(params.TenantKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []*tenantGroup
+	var groupIdx = make(map[string]*tenantGroup)
+	for _, recd := range records {
+		tenant, err := keyTemplate.expand(recd)
+		tenant = strings.TrimSpace(tenant)
+		if _, known := tenants.connections[tenant]; err != nil || !known {
+			tenant = params.TenantDefault
+		}
+
+		group, found := groupIdx[tenant]
+		if !found {
+			group = &tenantGroup{tenant: tenant, params: params}
+			if len(tenant) > 0 {
+				group.params = tenantParams(params, tenant, tenants.connections[tenant])
+			}
+			groupIdx[tenant] = group
+			groups = append(groups, group)
+		}
+		group.records = append(group.records, recd)
+	}
+	return groups, nil
+}
+
+// write the records to each of the tenant databases. Each tenant is written in its own transaction, so a problem with
+// one tenant doesn't stop the others being written. Once a tenant has committed, a retry of the whole chunk would
+// write its records a second time, so the records of the tenants needing a retry are added to the spool instead. Without
+// a spool the hash_column (which validateTenantParams then requires) lets the retry skip the records already written
+func execTenantInsert(params *SqlParams, records []FlushRecord) (writeOutcome, error) {
+	tenants, err := getTenantResources(params)
+	if err != nil {
+		log.Printf("[%s]%s tenant map error - %v", params.PluginName, params.InstanceName, err)
+		return writeFailed, err
+	}
+	groups, err := tenants.groupRecords(params, records)
+	if err != nil {
+		return writeFailed, err
+	}
+
+	var result writeOutcome = writeOk
+	var resultErr error = nil
+	var retryRecords []FlushRecord
+	committed := false
+	for _, group := range groups {
+		outcome, err := tenants.writeGroup(group)
+		switch outcome {
+		case writeOk:
+			committed = true
+		case writeRetry:
+			retryRecords = append(retryRecords, group.records...)
+		}
+		if outcome > result {
+			result = outcome
+			resultErr = err
+		}
+	}
+
+	if len(retryRecords) == 0 {
+		return result, resultErr
+	}
+	spool := getSpool(params)
+	if !committed || spool == nil {
+		return writeRetry, resultErr
+	}
+	if err := spool.append(params, retryRecords); err != nil {
+		log.Printf("[%s]%s unable to spool %d records for the tenants to retry, the chunk will be retried for every tenant - %v",
+			params.PluginName, params.InstanceName, len(retryRecords), err)
+		return writeRetry, resultErr
+	}
+	log.Printf("[%s]%s spooled %d records for the tenants to retry - %v", params.PluginName, params.InstanceName, len(retryRecords), resultErr)
+	return writeOk, nil
+}
+
+// write a tenant's records, using its own pool unless it is the database in the plugin's configuration
+func (tenants *tenantResources) writeGroup(group *tenantGroup) (writeOutcome, error) {
+	var pool *dbPool = nil
+	if len(group.tenant) > 0 {
+		pool = tenants.pool(group.tenant)
+	}
+	return execInsertTo(group.params, group.records, pool)
+}
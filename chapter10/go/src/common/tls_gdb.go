@@ -0,0 +1,158 @@
+package main
+
+// TLS for the database connections, configured with the same option names as Fluent Bit's own TLS settings. TLS
+// is off unless asked for, so local and test setups work without certificates. Each driver takes its TLS settings
+// in its own way, so the dialects add them to the connection string - here we check the settings and build the
+// TLS configuration for the drivers that are given one.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"hash/fnv"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const tlsOn = "on"
+const tlsOff = "off"
+
+// the values Fluent Bit accepts for an on/off setting
+var tlsFlagValues = map[string]string{
+	"on": tlsOn, "true": tlsOn, "yes": tlsOn,
+	"off": tlsOff, "false": tlsOff, "no": tlsOff,
+}
+
+// the TLS settings each database's driver can't take, as the driver only offers them through a wallet or
+// connector rather than the connection string
+var tlsUnsupported = map[string][]string{
+	sqlserverDBType:  {Plugin_TLSCertFile, Plugin_TLSKeyFile},
+	oracleDBType:     {Plugin_TLSCAFile, Plugin_TLSCertFile, Plugin_TLSKeyFile, Plugin_TLSServerName},
+	clickhouseDBType: {Plugin_TLSCAFile, Plugin_TLSCertFile, Plugin_TLSKeyFile, Plugin_TLSServerName},
+}
+
+// normalise an on/off setting, using the default when it isn't set
+func parseTLSFlag(key string, value string, defaultValue string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if len(value) == 0 {
+		return defaultValue, nil
+	}
+	flag, found := tlsFlagValues[value]
+	if !found {
+		return "", errors.New(key + " should be on or off, not " + value)
+	}
+	return flag, nil
+}
+
+func tlsEnabled(params *SqlParams) bool {
+	return params.TLS == tlsOn
+}
+
+// the server's certificate is verified unless we've been told not to
+func tlsVerify(params *SqlParams) bool {
+	return params.TLSVerify != tlsOff
+}
+
+// check the TLS settings, loading the certificates so a missing or unreadable file is reported at startup
+func validateTLSParams(params *SqlParams) error {
+	var err error
+	if params.TLS, err = parseTLSFlag(Plugin_TLS, params.TLS, tlsOff); err != nil {
+		return err
+	}
+	if params.TLSVerify, err = parseTLSFlag(Plugin_TLSVerify, params.TLSVerify, tlsOn); err != nil {
+		return err
+	}
+	params.TLSCAFile = strings.TrimSpace(params.TLSCAFile)
+	params.TLSCertFile = strings.TrimSpace(params.TLSCertFile)
+	params.TLSKeyFile = strings.TrimSpace(params.TLSKeyFile)
+	params.TLSServerName = strings.TrimSpace(params.TLSServerName)
+	settings := map[string]string{
+		Plugin_TLSCAFile:     params.TLSCAFile,
+		Plugin_TLSCertFile:   params.TLSCertFile,
+		Plugin_TLSKeyFile:    params.TLSKeyFile,
+		Plugin_TLSServerName: params.TLSServerName,
+	}
+
+	if !tlsEnabled(params) {
+		for key, value := range settings {
+			if len(value) > 0 {
+				log.Printf("[%s]%s %s has no effect without %s on", params.PluginName, params.InstanceName, key, Plugin_TLS)
+			}
+		}
+		return nil
+	}
+	if !getDialect(params).usesServer() {
+		return errors.New(Plugin_TLS + " is not applicable to " + params.DBType + " for " + params.PluginName)
+	}
+	for _, key := range tlsUnsupported[params.DBType] {
+		if len(settings[key]) > 0 {
+			return errors.New(key + " is not supported for " + params.DBType + " in " + params.PluginName)
+		}
+	}
+	// the Postgres driver only verifies the certificate against the db_host, so it can't check another name
+	if params.DBType == PostgresDBType && len(params.TLSServerName) > 0 && tlsVerify(params) {
+		return errors.New(Plugin_TLSServerName + " can't be verified for " + params.DBType + " in " + params.PluginName +
+			" - the certificate is verified against the " + Plugin_Host)
+	}
+	if (len(params.TLSCertFile) == 0) != (len(params.TLSKeyFile) == 0) {
+		return errors.New(Plugin_TLSCertFile + " and " + Plugin_TLSKeyFile + " need to be set together for " + params.PluginName)
+	}
+	if !tlsVerify(params) {
+		log.Printf("[%s]%s %s is off - the database's certificate won't be verified", params.PluginName, params.InstanceName, Plugin_TLSVerify)
+	}
+
+	_, err = buildTLSConfig(params)
+	return err
+}
+
+// the TLS configuration for the drivers that take one rather than file names in the connection string
+func buildTLSConfig(params *SqlParams) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: !tlsVerify(params),
+		ServerName:         params.TLSServerName,
+	}
+	if len(params.TLSCAFile) > 0 {
+		caPEM, err := os.ReadFile(params.TLSCAFile)
+		if err != nil {
+			return nil, errors.New(Plugin_TLSCAFile + " can't be read - " + err.Error())
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New(Plugin_TLSCAFile + " " + params.TLSCAFile + " doesn't contain any PEM certificates")
+		}
+	}
+	if len(params.TLSCertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(params.TLSCertFile, params.TLSKeyFile)
+		if err != nil {
+			return nil, errors.New(Plugin_TLSCertFile + " and " + Plugin_TLSKeyFile + " can't be loaded - " + err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// give the driver its TLS configuration when it takes one, so it is loaded once for the pool rather than for each
+// connection. Certificate files that can't be loaded stop the pool from opening
+func registerTLSConfig(params *SqlParams) error {
+	registrar, found := getDialect(params).(tlsRegistrar)
+	if !found || !tlsEnabled(params) || len(params.DSN) > 0 {
+		return nil
+	}
+	config, err := buildTLSConfig(params)
+	if err != nil {
+		return err
+	}
+	return registrar.registerTLS(tlsConfigName(params), config)
+}
+
+// a name for the TLS settings, so connections with the same settings share a registered configuration
+func tlsConfigName(params *SqlParams) string {
+	hash := fnv.New64a()
+	for _, value := range []string{params.TLSVerify, params.TLSCAFile, params.TLSCertFile, params.TLSKeyFile, params.TLSServerName} {
+		hash.Write([]byte(value))
+		hash.Write([]byte{0})
+	}
+	return "gdb_" + strconv.FormatUint(hash.Sum64(), 16)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestParseTLSFlag(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"", tlsOn},
+		{" On ", tlsOn},
+		{"true", tlsOn},
+		{"YES", tlsOn},
+		{"off", tlsOff},
+		{"False", tlsOff},
+		{"no", tlsOff},
+	}
+	for _, test := range tests {
+		flag, err := parseTLSFlag(Plugin_TLSVerify, test.value, tlsOn)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.value, err)
+		} else if flag != test.expected {
+			t.Errorf("%q: got %s, expected %s", test.value, flag, test.expected)
+		}
+	}
+	if _, err := parseTLSFlag(Plugin_TLS, "maybe", tlsOff); err == nil {
+		t.Errorf("maybe: expected an error")
+	}
+}
+
+func TestValidateTLSParams(t *testing.T) {
+	tests := []struct {
+		params SqlParams
+		valid  bool
+	}{
+		{SqlParams{DBType: PostgresDBType}, true},
+		{SqlParams{DBType: PostgresDBType, TLSServerName: "db.example.com"}, true},
+		{SqlParams{DBType: PostgresDBType, TLS: "yes"}, true},
+		{SqlParams{DBType: PostgresDBType, TLS: "sometimes"}, false},
+		{SqlParams{DBType: PostgresDBType, TLS: "on", TLSVerify: "sometimes"}, false},
+		{SqlParams{DBType: PostgresDBType, TLS: "on", TLSServerName: "db.example.com"}, false},
+		{SqlParams{DBType: PostgresDBType, TLS: "on", TLSVerify: "off", TLSServerName: "db.example.com"}, true},
+		{SqlParams{DBType: mysqlDBType, TLS: "on", TLSServerName: "db.example.com"}, true},
+		{SqlParams{DBType: mysqlDBType, TLS: "on", TLSCertFile: "/certs/client.pem"}, false},
+		{SqlParams{DBType: mysqlDBType, TLS: "on", TLSCAFile: "/missing/ca.pem"}, false},
+		{SqlParams{DBType: sqlserverDBType, TLS: "on", TLSKeyFile: "/certs/client.key", TLSCertFile: "/certs/client.pem"}, false},
+		{SqlParams{DBType: oracleDBType, TLS: "on", TLSServerName: "db.example.com"}, false},
+		{SqlParams{DBType: sqliteDBType, TLS: "on"}, false},
+	}
+	for _, test := range tests {
+		if err := validateTLSParams(&test.params); (err == nil) != test.valid {
+			t.Errorf("%s tls %s verify %s: got %v, expected valid %t", test.params.DBType, test.params.TLS, test.params.TLSVerify, err, test.valid)
+		}
+	}
+}
+
+func TestRegisterTLSConfig(t *testing.T) {
+	badCA := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(badCA, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	tests := []struct {
+		params SqlParams
+		valid  bool
+	}{
+		{SqlParams{DBType: mysqlDBType, TLS: tlsOn, TLSVerify: tlsOn, TLSServerName: "db.example.com"}, true},
+		{SqlParams{DBType: mysqlDBType, TLS: tlsOn, TLSVerify: tlsOff}, true},
+		{SqlParams{DBType: mysqlDBType, TLS: tlsOn, TLSVerify: tlsOn, TLSCAFile: badCA}, false},
+		{SqlParams{DBType: mysqlDBType, TLS: tlsOn, TLSVerify: tlsOn, TLSCAFile: "/missing/ca.pem"}, false},
+		{SqlParams{DBType: mysqlDBType, TLS: tlsOff, TLSCAFile: "/missing/ca.pem"}, true},
+		{SqlParams{DBType: PostgresDBType, TLS: tlsOn, TLSVerify: tlsOn, TLSCAFile: "/missing/ca.pem"}, true},
+	}
+	for _, test := range tests {
+		params := test.params
+		params.Host, params.Port, params.User, params.DBName = "db", "3306", "fluent", "logs"
+		err := registerTLSConfig(&params)
+		if (err == nil) != test.valid {
+			t.Errorf("%s tls %s ca %s: got %v, expected valid %t", params.DBType, params.TLS, params.TLSCAFile, err, test.valid)
+		}
+		// the driver only accepts a connection string naming a registered configuration
+		if err == nil && params.DBType == mysqlDBType {
+			if _, err := mysql.ParseDSN(buildConnectionStr(&params)); err != nil {
+				t.Errorf("%s tls %s: got %v, expected the connection string to name a registered configuration", params.DBType, params.TLS, err)
+			}
+		}
+	}
+}
@@ -28,6 +28,12 @@ func getParams(plugin unsafe.Pointer) (*SqlParams, error) {
 	params.Port = input.FLBPluginConfigKey(plugin, Plugin_Port)
 	params.User = input.FLBPluginConfigKey(plugin, Plugin_User)
 	params.Password = input.FLBPluginConfigKey(plugin, Plugin_Password)
+	params.PasswordFile = input.FLBPluginConfigKey(plugin, Plugin_PasswordFile)
+	params.PasswordEnv = input.FLBPluginConfigKey(plugin, Plugin_PasswordEnv)
+	params.SecretProvider = input.FLBPluginConfigKey(plugin, Plugin_SecretProvider)
+	params.SecretURL = input.FLBPluginConfigKey(plugin, Plugin_SecretURL)
+	params.SecretField = input.FLBPluginConfigKey(plugin, Plugin_SecretField)
+	params.SecretTokenFile = input.FLBPluginConfigKey(plugin, Plugin_SecretTokenFile)
 	params.SequencerCol = input.FLBPluginConfigKey(plugin, Plugin_Ordering)
 	params.TableName = input.FLBPluginConfigKey(plugin, Plugin_TableName)
 	params.DBName = input.FLBPluginConfigKey(plugin, Plugin_DBName)
@@ -35,6 +41,21 @@ func getParams(plugin unsafe.Pointer) (*SqlParams, error) {
 	params.PK = input.FLBPluginConfigKey(plugin, Plugin_PK)
 	params.ColsCSV = input.FLBPluginConfigKey(plugin, Plugin_ColsCSV)
 	params.WhereExpr = input.FLBPluginConfigKey(plugin, Plugin_WhereExpr)
+	params.CircuitCooldown = input.FLBPluginConfigKey(plugin, Plugin_CircuitBreakerCooldown)
+	params.PoolLifetime = input.FLBPluginConfigKey(plugin, Plugin_PoolMaxLifetime)
+	params.DSN = input.FLBPluginConfigKey(plugin, Plugin_DSN)
+	params.RedactFields = input.FLBPluginConfigKey(plugin, Plugin_RedactFields)
+	params.TLS = input.FLBPluginConfigKey(plugin, Plugin_TLS)
+	params.TLSVerify = input.FLBPluginConfigKey(plugin, Plugin_TLSVerify)
+	params.TLSCAFile = input.FLBPluginConfigKey(plugin, Plugin_TLSCAFile)
+	params.TLSCertFile = input.FLBPluginConfigKey(plugin, Plugin_TLSCertFile)
+	params.TLSKeyFile = input.FLBPluginConfigKey(plugin, Plugin_TLSKeyFile)
+	params.TLSServerName = input.FLBPluginConfigKey(plugin, Plugin_TLSServerName)
+
+	var err error
+	if params.DBOptions, err = getDriverOptions(params.DBType, func(key string) string { return input.FLBPluginConfigKey(plugin, key) }); err != nil {
+		return nil, err
+	}
 
 	freqStr := input.FLBPluginConfigKey(plugin, Plugin_QueryFrequency)
 	if len(freqStr) > 0 {
@@ -46,6 +67,24 @@ func getParams(plugin unsafe.Pointer) (*SqlParams, error) {
 		}
 	}
 
+	for _, setting := range []struct {
+		key   string
+		value *int
+	}{
+		{Plugin_CircuitBreakerFailures, &params.CircuitFailures},
+		{Plugin_PoolMaxOpen, &params.PoolMaxOpen},
+		{Plugin_PoolMaxIdle, &params.PoolMaxIdle},
+	} {
+		valueStr := strings.TrimSpace(input.FLBPluginConfigKey(plugin, setting.key))
+		if len(valueStr) > 0 {
+			value, err := strconv.Atoi(valueStr)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not numeric", setting.key)
+			}
+			*setting.value = value
+		}
+	}
+
 	params.DeleteAfterQuery = strings.Contains(strings.ToLower(input.FLBPluginConfigKey(plugin, Plugin_Delete)), "true")
 
 	return &params, nil
@@ -57,8 +96,9 @@ func cacheParams(params *SqlParams) {
 	paramsToEnv(params, PluginName)
 }
 
-// when we're given the instruction to shutdown, we don't want any cached data to be left dangling - so we need to clear down
+// when we're given the instruction to shutdown, we don't want any cached data or connections to be left dangling - so we need to clear down
 func releaseResources() error {
+	releaseAllInstanceResources()
 	clearEnvParams(PluginName)
 	return nil
 }
@@ -89,10 +129,13 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 		return input.FLB_ERROR
 	}
 	if strings.Contains(strings.ToLower(input.FLBPluginConfigKey(plugin, "Log_Level")), "debug") {
-		log.Printf("[%s] configured with %v\n", params.PluginName, params)
+		log.Printf("[%s] configured with %v\n", params.PluginName, SprintfParams(params, PluginName))
 	}
 
 	validateErr := validateSqlParams(params)
+	if validateErr == nil && params.DBType == clickhouseDBType {
+		validateErr = fmt.Errorf("%s can only be used by the output", clickhouseDBType)
+	}
 	if validateErr == nil {
 		cacheParams(params)
 		//log.Printf(SprintfParams(params, PluginName))
@@ -104,13 +147,19 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 
 }
 
-// we need to send the paload as a map of string/string but we receive it as a
-// vecordValType - which needs to become string-string
-func dataLineToStrMap(dataLine interface{}) map[string]string {
+// we receive the row as a recordValType and send it on as a map of the column names to the values. The values
+// the dialect has mapped into the record's types (such as Oracle's numbers) are kept as they are, and anything
+// else is sent as a string
+func dataLineToMap(dataLine interface{}) map[string]interface{} {
 	line := dataLine.(recordValType)
-	result := make(map[string]string)
+	result := make(map[string]interface{}, len(line))
 	for k, v := range line {
-		result[k] = typeToStr(v, false)
+		switch v.(type) {
+		case string, int64, float64:
+			result[k] = v
+		default:
+			result[k] = typeToStr(v, false)
+		}
 	}
 
 	return result
@@ -143,17 +192,17 @@ func FLBPluginInputCallback(data *unsafe.Pointer, size *C.size_t) int {
 		var entry []interface{} = nil
 		if dataCtr > 0 {
 			for dataLine := 0; dataLine < dataCtr; dataLine++ {
-				recd := dataLineToStrMap(dataSet[dataLine])
+				recd := dataLineToMap(dataSet[dataLine])
 				entry = []interface{}{flbTime, recd}
 			}
-			log.Printf("[%s] InputCallback - retrieved data %v\n", PluginName, entry)
+			log.Printf("[%s] InputCallback - retrieved data %v\n", PluginName, redactRecord(params, entry))
 		}
 
 		// the internal representation uses msgpack so now we need to compress the record
 		enc := input.NewEncoder()
 		packed, err := enc.Encode(entry)
 		if err != nil {
-			log.Printf("[%s] error: %s,\n Can't convert to msgpack: %v\n", PluginName, err, entry)
+			log.Printf("[%s] error: %s,\n Can't convert to msgpack: %v\n", PluginName, err, redactRecord(params, entry))
 			return input.FLB_ERROR
 		}
 
@@ -3,6 +3,8 @@ package main
 import (
 	"C"
 	"log"
+	"strconv"
+	"time"
 	"unsafe"
 
 	"github.com/fluent/fluent-bit-go/output"
@@ -32,6 +34,12 @@ func getParams(plugin unsafe.Pointer) (*SqlParams, error) {
 	params.Port = output.FLBPluginConfigKey(plugin, Plugin_Port)
 	params.User = output.FLBPluginConfigKey(plugin, Plugin_User)
 	params.Password = output.FLBPluginConfigKey(plugin, Plugin_Password)
+	params.PasswordFile = output.FLBPluginConfigKey(plugin, Plugin_PasswordFile)
+	params.PasswordEnv = output.FLBPluginConfigKey(plugin, Plugin_PasswordEnv)
+	params.SecretProvider = output.FLBPluginConfigKey(plugin, Plugin_SecretProvider)
+	params.SecretURL = output.FLBPluginConfigKey(plugin, Plugin_SecretURL)
+	params.SecretField = output.FLBPluginConfigKey(plugin, Plugin_SecretField)
+	params.SecretTokenFile = output.FLBPluginConfigKey(plugin, Plugin_SecretTokenFile)
 	params.SequencerCol = output.FLBPluginConfigKey(plugin, Plugin_Ordering)
 	params.TableName = output.FLBPluginConfigKey(plugin, Plugin_TableName)
 	params.DBName = output.FLBPluginConfigKey(plugin, Plugin_DBName)
@@ -39,12 +47,96 @@ func getParams(plugin unsafe.Pointer) (*SqlParams, error) {
 	params.PK = output.FLBPluginConfigKey(plugin, Plugin_PK)
 	params.ColsCSV = output.FLBPluginConfigKey(plugin, Plugin_ColsCSV)
 	params.WhereExpr = output.FLBPluginConfigKey(plugin, Plugin_WhereExpr)
+	params.DeadLetterTable = strings.TrimSpace(output.FLBPluginConfigKey(plugin, Plugin_DeadLetterTable))
+	params.TableAllowlist = output.FLBPluginConfigKey(plugin, Plugin_TableAllowlist)
+	params.TableRegex = strings.TrimSpace(output.FLBPluginConfigKey(plugin, Plugin_TableRegex))
+	params.TimeColumn = output.FLBPluginConfigKey(plugin, Plugin_TimeColumn)
+	params.PartitionBy = strings.TrimSpace(output.FLBPluginConfigKey(plugin, Plugin_PartitionBy))
+	params.PartitionCheck = output.FLBPluginConfigKey(plugin, Plugin_PartitionInterval)
+	params.Retention = output.FLBPluginConfigKey(plugin, Plugin_Retention)
+
+	params.RetentionCheck = output.FLBPluginConfigKey(plugin, Plugin_RetentionInterval)
+	params.MetricsListen = strings.TrimSpace(output.FLBPluginConfigKey(plugin, Plugin_MetricsListen))
+	params.TenantKey = strings.TrimSpace(output.FLBPluginConfigKey(plugin, Plugin_TenantKey))
+	params.TenantMapFile = strings.TrimSpace(output.FLBPluginConfigKey(plugin, Plugin_TenantMapFile))
+	params.TenantDefault = strings.TrimSpace(output.FLBPluginConfigKey(plugin, Plugin_TenantDefault))
+	params.UnmatchedTable = strings.TrimSpace(output.FLBPluginConfigKey(plugin, Plugin_UnmatchedTable))
+	params.WriteMode = output.FLBPluginConfigKey(plugin, Plugin_WriteMode)
+	params.OpField = output.FLBPluginConfigKey(plugin, Plugin_OpField)
+	params.ChildTables = output.FLBPluginConfigKey(plugin, Plugin_ChildTables)
+	params.ParentKey = output.FLBPluginConfigKey(plugin, Plugin_ParentKey)
+	params.ChildFKColumn = output.FLBPluginConfigKey(plugin, Plugin_ChildFKColumn)
+	params.Dimensions = output.FLBPluginConfigKey(plugin, Plugin_Dimensions)
+	params.AggregateWindow = output.FLBPluginConfigKey(plugin, Plugin_AggregateWindow)
+	params.AggregateKeys = output.FLBPluginConfigKey(plugin, Plugin_AggregateKeys)
+	params.AggregateFields = output.FLBPluginConfigKey(plugin, Plugin_AggregateFields)
+	params.Statement = output.FLBPluginConfigKey(plugin, Plugin_Statement)
+	params.Procedure = output.FLBPluginConfigKey(plugin, Plugin_Procedure)
+	params.ProcedureArgs = output.FLBPluginConfigKey(plugin, Plugin_ProcedureArgs)
+	params.HashColumn = output.FLBPluginConfigKey(plugin, Plugin_HashColumn)
+	params.HashDedup = output.FLBPluginConfigKey(plugin, Plugin_HashDedup)
+	params.SpoolDir = output.FLBPluginConfigKey(plugin, Plugin_SpoolDir)
+	params.SpoolMaxSize = output.FLBPluginConfigKey(plugin, Plugin_SpoolMaxSize)
+	params.SpoolSegment = output.FLBPluginConfigKey(plugin, Plugin_SpoolSegmentSize)
+	params.SpoolReplay = output.FLBPluginConfigKey(plugin, Plugin_SpoolReplayInterval)
+	params.CircuitCooldown = output.FLBPluginConfigKey(plugin, Plugin_CircuitBreakerCooldown)
+	params.PoolLifetime = output.FLBPluginConfigKey(plugin, Plugin_PoolMaxLifetime)
+	params.DSN = output.FLBPluginConfigKey(plugin, Plugin_DSN)
+	params.RedactFields = output.FLBPluginConfigKey(plugin, Plugin_RedactFields)
+	params.TLS = output.FLBPluginConfigKey(plugin, Plugin_TLS)
+	params.TLSVerify = output.FLBPluginConfigKey(plugin, Plugin_TLSVerify)
+	params.TLSCAFile = output.FLBPluginConfigKey(plugin, Plugin_TLSCAFile)
+	params.TLSCertFile = output.FLBPluginConfigKey(plugin, Plugin_TLSCertFile)
+	params.TLSKeyFile = output.FLBPluginConfigKey(plugin, Plugin_TLSKeyFile)
+	params.TLSServerName = output.FLBPluginConfigKey(plugin, Plugin_TLSServerName)
+
+	var err error
+	if params.DBOptions, err = getDriverOptions(params.DBType, func(key string) string { return output.FLBPluginConfigKey(plugin, key) }); err != nil {
+		return nil, err
+	}
+	if params.PartitionPremake, err = getIntParam(plugin, Plugin_PartitionPremake); err != nil {
+		return nil, err
+	}
+	if params.RetentionBatch, err = getIntParam(plugin, Plugin_RetentionBatchSize); err != nil {
+		return nil, err
+	}
+	if params.RetentionRate, err = getIntParam(plugin, Plugin_RetentionRateLimit); err != nil {
+		return nil, err
+	}
+	if params.DimensionCache, err = getIntParam(plugin, Plugin_DimensionCacheSize); err != nil {
+		return nil, err
+	}
+	if params.HashCache, err = getIntParam(plugin, Plugin_HashCacheSize); err != nil {
+		return nil, err
+	}
+	if params.CircuitFailures, err = getIntParam(plugin, Plugin_CircuitBreakerFailures); err != nil {
+		return nil, err
+	}
+	if params.PoolMaxOpen, err = getIntParam(plugin, Plugin_PoolMaxOpen); err != nil {
+		return nil, err
+	}
+	if params.PoolMaxIdle, err = getIntParam(plugin, Plugin_PoolMaxIdle); err != nil {
+		return nil, err
+	}
 
 	params.DeleteAfterQuery = strings.Contains(strings.ToLower(output.FLBPluginConfigKey(plugin, Plugin_Delete)), "true")
 
 	return &params, nil
 }
 
+// retrieve a numeric configuration value, if the value isn't set we return 0 so the default can be applied
+func getIntParam(plugin unsafe.Pointer, key string) (int, error) {
+	valueStr := strings.TrimSpace(output.FLBPluginConfigKey(plugin, key))
+	if len(valueStr) == 0 {
+		return 0, nil
+	}
+	value, err := strconv.Atoi(valueStr)
+	if err != nil {
+		return 0, errors.New(key + " is not numeric")
+	}
+	return value, nil
+}
+
 // The function that provides the details of the plugin to Fluent Bit to allow the association
 // of the plugin name to the config file, and allow the CLI help to show the plugin role.
 //
@@ -74,16 +166,36 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 	}
 
 	validateErr := validateSqlParams(params)
+	if validateErr == nil {
+		validateErr = validateOutputParams(params)
+	}
 	if validateErr != nil {
 		log.Printf("[%s] %s Configuration error -%s\n", params.PluginName, params.InstanceName, validateErr)
 		return output.FLB_ERROR
 	}
 
+	// the context id is needed first, as the connection test opens the instance's connection pool
+	params.ContextId = nextContextId()
 	connectWorks := testConnectionOk(params)
 	log.Printf("[%s] %s Init connection test successful %t\n", params.PluginName, params.InstanceName, connectWorks)
 	if !connectWorks {
+		releaseInstanceResources(params)
+		return output.FLB_ERROR
+	}
+
+	if err = startPartitionManagement(params); err != nil {
+		log.Printf("[%s] %s Partition management failed - %v\n", params.PluginName, params.InstanceName, err)
+		releaseInstanceResources(params)
+		return output.FLB_ERROR
+	}
+	startRetentionPurge(params)
+	startAggregation(params)
+	if err = startSpool(params); err != nil {
+		log.Printf("[%s] %s Unable to set up the spool - %v\n", params.PluginName, params.InstanceName, err)
+		releaseInstanceResources(params)
 		return output.FLB_ERROR
 	}
+	startMetricsServer(params)
 
 	//paramsToEnv(params, PluginName)
 	paramsJSON := paramsToJSON(params)
@@ -133,8 +245,9 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 	}
 
 	dec := output.NewDecoder(data, int(length))
+	tagStr := C.GoString(tag)
 
-	count := 0
+	var records []FlushRecord
 	for { // for as long as there is a data value to insert
 		ret, ts, record := output.GetRecord(dec)
 
@@ -145,20 +258,39 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 
 		// Print record keys and values
 		//log.Printf("[%s] record received:%v", PluginName, record)
-		count++
-		insertErr := execInsert(params, record)
-		if insertErr != nil {
-			log.Printf("[%s]%s Error during insert, returning fail\n%v", params.PluginName, params.InstanceName, insertErr)
-			return output.FLB_ERROR
-		}
+		records = append(records, FlushRecord{Tag: tagStr, Timestamp: flbTimeToTime(ts), Record: record})
+	}
+
+	outcome, insertErr := writeChunk(params, records)
+	switch outcome {
+	case writeRetry:
+		log.Printf("[%s]%s Retryable error during insert, asking for retry\n%v", params.PluginName, params.InstanceName, insertErr)
+		return output.FLB_RETRY
+	case writeFailed:
+		log.Printf("[%s]%s Error during insert, returning fail\n%v", params.PluginName, params.InstanceName, insertErr)
+		return output.FLB_ERROR
 	}
 
 	return output.FLB_OK
 }
 
+// Fluent Bit can give us the timestamp either as its own time type or as epoch seconds
+func flbTimeToTime(ts interface{}) time.Time {
+	switch t := ts.(type) {
+	case output.FLBTime:
+		return t.Time
+	case uint64:
+		return time.Unix(int64(t), 0)
+	default:
+		log.Printf("[%s] unexpected timestamp type %T, using current time", PluginName, ts)
+		return time.Now()
+	}
+}
+
 //export FLBPluginExit
 func FLBPluginExit() int {
-	log.Print("[%s] Exit called for unknown instance", PluginName)
+	log.Printf("[%s] Exit called for unknown instance", PluginName)
+	releaseAllInstanceResources()
 	return output.FLB_OK
 }
 
@@ -182,6 +314,7 @@ func FLBPluginExitCtx(ctx unsafe.Pointer) int {
 			return output.FLB_ERROR
 		}
 	}
+	releaseInstanceResources(params)
 	releaseResources()
 	return output.FLB_OK
 }
@@ -19,4 +19,14 @@ CREATE TABLE plugindest
     a_decimal decimal(20,10),
     primkey int NOT NULL AUTO_INCREMENT,
     PRIMARY KEY (primkey)
-);
\ No newline at end of file
+);
+CREATE TABLE gdb_dead_letter
+(
+    dl_key int NOT NULL AUTO_INCREMENT,
+    record text NOT NULL,
+    tag varchar(255),
+    event_time timestamp(6) NULL,
+    error_text text,
+    target_table varchar(255),
+    PRIMARY KEY (dl_key)
+);
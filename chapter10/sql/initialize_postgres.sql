@@ -10,3 +10,18 @@ CREATE TABLE pluginsrc
 
 ALTER TABLE IF EXISTS pluginsrc
     OWNER to "postgresUser";
+
+
+CREATE TABLE gdb_dead_letter
+(
+    dl_key serial NOT NULL,
+    record text NOT NULL,
+    tag text,
+    event_time timestamp with time zone,
+    error_text text,
+    target_table text,
+    PRIMARY KEY (dl_key)
+);
+
+ALTER TABLE IF EXISTS gdb_dead_letter
+    OWNER to "postgresUser";